@@ -0,0 +1,678 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/thisisnttheway/hx-monitor/db"
+	"github.com/thisisnttheway/hx-monitor/models"
+	"github.com/thisisnttheway/hx-monitor/phone"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type numberRequest struct {
+	Name   *string            `json:"name"`
+	Number *string            `json:"number"`
+	Script *models.CallScript `json:"script"`
+}
+
+type areaRequest struct {
+	Name       *string             `json:"name"`
+	NumberName *string             `json:"number_name"`
+	NextAction *time.Time          `json:"next_action"`
+	Paused     *bool               `json:"paused"`
+	SubAreas   *[]models.HXSubArea `json:"sub_areas"`
+}
+
+type subAreaRequest struct {
+	FullName *string `json:"full_name"`
+	Name     *string `json:"name"`
+	Active   *bool   `json:"active"`
+}
+
+// Writes a JSON response with the given status code
+func writeResponse(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	res, _ := json.Marshal(body)
+	fmt.Fprint(w, string(res))
+}
+
+func writeInternalError(w http.ResponseWriter, err error) {
+	writeResponse(w, http.StatusInternalServerError, ResponseError{Error: "Internal error", Data: err.Error()})
+}
+
+func writeNotFound(w http.ResponseWriter, kind string, name string) {
+	writeResponse(w, http.StatusNotFound, ResponseError{
+		Error: "Not found",
+		Data:  fmt.Sprintf("%s '%s' does not exist", kind, name),
+	})
+}
+
+func writeBadRequest(w http.ResponseWriter, err error) {
+	writeResponse(w, http.StatusBadRequest, ResponseError{Error: "Bad request", Data: err.Error()})
+}
+
+// Decodes a JSON request body, rejecting unknown fields
+func decodeBody(r *http.Request, target interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(target); err != nil {
+		return fmt.Errorf("invalid request body: %v", err)
+	}
+
+	return nil
+}
+
+// Parses the "limit" query parameter
+func parseLimit(r *http.Request, defaultLimit int64) (int64, error) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return defaultLimit, nil
+	}
+
+	limit, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || limit < 1 {
+		return 0, fmt.Errorf("limit must be a positive integer")
+	}
+
+	return limit, nil
+}
+
+// Looks up an area by the {name} route variable, writing an error response if that fails
+func lookupArea(w http.ResponseWriter, r *http.Request) (models.HXArea, bool) {
+	name := mux.Vars(r)["name"]
+	area, err := db.Areas.GetByName(r.Context(), name)
+	if errors.Is(err, db.ErrNotFound) {
+		writeNotFound(w, "Area", name)
+		return area, false
+	}
+	if err != nil {
+		writeInternalError(w, err)
+		return area, false
+	}
+
+	return area, true
+}
+
+// Looks up a number by the {name} route variable, writing an error response if that fails
+func lookupNumber(w http.ResponseWriter, r *http.Request) (models.Number, bool) {
+	name := mux.Vars(r)["name"]
+	number, err := db.Numbers.GetByName(r.Context(), name)
+	if errors.Is(err, db.ErrNotFound) {
+		writeNotFound(w, "Number", name)
+		return number, false
+	}
+	if err != nil {
+		writeInternalError(w, err)
+		return number, false
+	}
+
+	return number, true
+}
+
+func validateSubArea(subArea models.HXSubArea) error {
+	if strings.TrimSpace(subArea.Name) == "" || strings.TrimSpace(subArea.FullName) == "" {
+		return fmt.Errorf("sub areas require both 'name' and 'full_name'")
+	}
+
+	return nil
+}
+
+// Validates the sub areas of an area, whose names must be unique as they are looked up by name
+func validateSubAreas(subAreas []models.HXSubArea) error {
+	names := make(map[string]bool, len(subAreas))
+	for _, subArea := range subAreas {
+		if err := validateSubArea(subArea); err != nil {
+			return err
+		}
+		if names[subArea.Name] {
+			return fmt.Errorf("sub area '%s' is listed more than once", subArea.Name)
+		}
+		names[subArea.Name] = true
+	}
+
+	return nil
+}
+
+// Ensures a number with the given name exists
+func validateNumberName(ctx context.Context, numberName string) error {
+	_, err := db.Numbers.GetByName(ctx, numberName)
+	if errors.Is(err, db.ErrNotFound) {
+		return fmt.Errorf("number '%s' does not exist", numberName)
+	}
+
+	return err
+}
+
+// Applies a single targeted write to an area and writes an audit log entry with the area as stored afterwards.
+// The monitor writes areas at the same time, so only the fields changed by the action are written.
+func saveArea(w http.ResponseWriter, r *http.Request, action string, before models.HXArea, write func(ctx context.Context) error) {
+	if err := write(r.Context()); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	areaCache.Invalidate()
+
+	// The change is audited even if the area can not be read back
+	after, err := db.Areas.GetByID(r.Context(), before.ID)
+	if err != nil {
+		writeAuditLog(r, action, "hx_areas/"+before.Name, before, nil)
+		writeInternalError(w, err)
+		return
+	}
+
+	writeAuditLog(r, action, "hx_areas/"+before.Name, before, after)
+	writeResponse(w, http.StatusOK, ResponseOk{Message: "Ok", Data: after})
+}
+
+// =================================
+// NUMBERS
+
+// Get all numbers (/numbers)
+func adminGetNumbers(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	numbers, err := db.Numbers.List(r.Context())
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, ResponseOk{Message: "Ok", Data: numbers})
+}
+
+// Get a number by name (/numbers/{name})
+func adminGetNumber(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	number, ok := lookupNumber(w, r)
+	if !ok {
+		return
+	}
+
+	writeResponse(w, http.StatusOK, ResponseOk{Message: "Ok", Data: number})
+}
+
+// Create a number (/numbers)
+func adminCreateNumber(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	var req numberRequest
+	if err := decodeBody(r, &req); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	if req.Name == nil || req.Number == nil || *req.Name == "" || *req.Number == "" {
+		writeBadRequest(w, fmt.Errorf("'name' and 'number' are required"))
+		return
+	}
+	e164, err := phone.Normalize(*req.Number)
+	if err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	var script models.CallScript
+	if req.Script != nil {
+		if err := req.Script.Validate(); err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+		script = *req.Script
+	}
+
+	_, err = db.Numbers.GetByName(r.Context(), *req.Name)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		writeInternalError(w, err)
+		return
+	}
+	if err == nil {
+		writeResponse(w, http.StatusConflict, ResponseError{
+			Error: "Conflict",
+			Data:  fmt.Sprintf("Number '%s' already exists", *req.Name),
+		})
+		return
+	}
+
+	number := models.Number{
+		ID:     primitive.NewObjectID(),
+		Name:   *req.Name,
+		Number: e164,
+		Script: script,
+	}
+	if err := db.Numbers.Insert(r.Context(), number); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	writeAuditLog(r, "createNumber", "numbers/"+number.Name, nil, number)
+	writeResponse(w, http.StatusCreated, ResponseOk{Message: "Created", Data: number})
+}
+
+// Update a number (/numbers/{name})
+func adminUpdateNumber(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	number, ok := lookupNumber(w, r)
+	if !ok {
+		return
+	}
+
+	var req numberRequest
+	if err := decodeBody(r, &req); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	if req.Name != nil && *req.Name != number.Name {
+		// Areas reference numbers by name
+		writeBadRequest(w, fmt.Errorf("numbers cannot be renamed"))
+		return
+	}
+
+	updated := number
+	if req.Number != nil {
+		e164, err := phone.Normalize(*req.Number)
+		if err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+		updated.Number = e164
+	}
+	if req.Script != nil {
+		if err := req.Script.Validate(); err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+		updated.Script = *req.Script
+	}
+
+	if err := db.Numbers.Update(r.Context(), updated); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	writeAuditLog(r, "updateNumber", "numbers/"+number.Name, number, updated)
+	writeResponse(w, http.StatusOK, ResponseOk{Message: "Ok", Data: updated})
+}
+
+// Delete a number (/numbers/{name})
+func adminDeleteNumber(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	number, ok := lookupNumber(w, r)
+	if !ok {
+		return
+	}
+
+	count, err := db.Areas.CountByNumberName(r.Context(), number.Name)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if count > 0 {
+		writeResponse(w, http.StatusConflict, ResponseError{
+			Error: "Conflict",
+			Data:  fmt.Sprintf("Number '%s' is still used by %d area(s)", number.Name, count),
+		})
+		return
+	}
+
+	if err := db.Numbers.Delete(r.Context(), number.ID); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	writeAuditLog(r, "deleteNumber", "numbers/"+number.Name, number, nil)
+	writeResponse(w, http.StatusOK, ResponseOk{Message: "Deleted", Data: number})
+}
+
+// =================================
+// AREAS
+
+// Get all areas (/areas)
+func adminGetAreas(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	areas, err := db.Areas.List(r.Context())
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, ResponseOk{Message: "Ok", Data: areas})
+}
+
+// Get an area by name (/areas/{name})
+func adminGetArea(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	area, ok := lookupArea(w, r)
+	if !ok {
+		return
+	}
+
+	writeResponse(w, http.StatusOK, ResponseOk{Message: "Ok", Data: area})
+}
+
+// Create an area (/areas)
+func adminCreateArea(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	var req areaRequest
+	if err := decodeBody(r, &req); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	if req.Name == nil || req.NumberName == nil || *req.Name == "" {
+		writeBadRequest(w, fmt.Errorf("'name' and 'number_name' are required"))
+		return
+	}
+	if err := validateNumberName(r.Context(), *req.NumberName); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	_, err := db.Areas.GetByName(r.Context(), *req.Name)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		writeInternalError(w, err)
+		return
+	}
+	if err == nil {
+		writeResponse(w, http.StatusConflict, ResponseError{
+			Error: "Conflict",
+			Data:  fmt.Sprintf("Area '%s' already exists", *req.Name),
+		})
+		return
+	}
+
+	area := models.HXArea{
+		ID:         primitive.NewObjectID(),
+		Name:       *req.Name,
+		NumberName: *req.NumberName,
+		SubAreas:   []models.HXSubArea{},
+	}
+	if req.NextAction != nil {
+		area.NextAction = *req.NextAction
+	}
+	if req.Paused != nil {
+		area.Paused = *req.Paused
+	}
+	if req.SubAreas != nil {
+		if err := validateSubAreas(*req.SubAreas); err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+		area.SubAreas = *req.SubAreas
+	}
+
+	if err := db.Areas.Insert(r.Context(), area); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	areaCache.Invalidate()
+	writeAuditLog(r, "createArea", "hx_areas/"+area.Name, nil, area)
+	writeResponse(w, http.StatusCreated, ResponseOk{Message: "Created", Data: area})
+}
+
+// Update an area (/areas/{name})
+func adminUpdateArea(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	area, ok := lookupArea(w, r)
+	if !ok {
+		return
+	}
+
+	var req areaRequest
+	if err := decodeBody(r, &req); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	if req.Name != nil && *req.Name != area.Name {
+		// The frontend resolves areas by their name
+		writeBadRequest(w, fmt.Errorf("areas cannot be renamed"))
+		return
+	}
+
+	settings := db.AreaSettings{NextAction: req.NextAction, Paused: req.Paused, SubAreas: req.SubAreas}
+	if req.NumberName != nil {
+		if err := validateNumberName(r.Context(), *req.NumberName); err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+		settings.NumberName = req.NumberName
+	}
+	if req.SubAreas != nil {
+		if err := validateSubAreas(*req.SubAreas); err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+	}
+
+	saveArea(w, r, "updateArea", area, func(ctx context.Context) error {
+		return db.Areas.UpdateSettings(ctx, area.ID, settings)
+	})
+}
+
+// Delete an area (/areas/{name})
+func adminDeleteArea(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	area, ok := lookupArea(w, r)
+	if !ok {
+		return
+	}
+
+	if err := db.Areas.Delete(r.Context(), area.ID); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	areaCache.Invalidate()
+	writeAuditLog(r, "deleteArea", "hx_areas/"+area.Name, area, nil)
+	writeResponse(w, http.StatusOK, ResponseOk{Message: "Deleted", Data: area})
+}
+
+// Force an immediate re-check of an area (/areas/{name}/recheck)
+func adminRecheckArea(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	area, ok := lookupArea(w, r)
+	if !ok {
+		return
+	}
+
+	// The monitor picks up any area whose next_action lies in the past
+	saveArea(w, r, "recheckArea", area, func(ctx context.Context) error {
+		return db.Areas.Recheck(ctx, area.ID, time.Now().UTC())
+	})
+}
+
+// Reset the error counter of an area (/areas/{name}/reset-errors)
+func adminResetAreaErrors(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	area, ok := lookupArea(w, r)
+	if !ok {
+		return
+	}
+
+	saveArea(w, r, "resetAreaErrors", area, func(ctx context.Context) error {
+		return db.Areas.ResetErrors(ctx, area.ID)
+	})
+}
+
+// Pause monitoring of an area (/areas/{name}/pause)
+func adminPauseArea(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	area, ok := lookupArea(w, r)
+	if !ok {
+		return
+	}
+
+	saveArea(w, r, "pauseArea", area, func(ctx context.Context) error {
+		return db.Areas.SetPaused(ctx, area.ID, true)
+	})
+}
+
+// Resume monitoring of an area (/areas/{name}/resume)
+func adminResumeArea(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	area, ok := lookupArea(w, r)
+	if !ok {
+		return
+	}
+
+	saveArea(w, r, "resumeArea", area, func(ctx context.Context) error {
+		return db.Areas.SetPaused(ctx, area.ID, false)
+	})
+}
+
+// =================================
+// SUB AREAS
+
+// Add a sub area to an area (/areas/{name}/sub-areas)
+func adminCreateSubArea(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	area, ok := lookupArea(w, r)
+	if !ok {
+		return
+	}
+
+	var req subAreaRequest
+	if err := decodeBody(r, &req); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	subArea := models.HXSubArea{}
+	if req.Name != nil {
+		subArea.Name = *req.Name
+	}
+	if req.FullName != nil {
+		subArea.FullName = *req.FullName
+	}
+	if req.Active != nil {
+		subArea.Active = *req.Active
+	}
+	if err := validateSubArea(subArea); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	for _, s := range area.SubAreas {
+		if s.Name == subArea.Name {
+			writeResponse(w, http.StatusConflict, ResponseError{
+				Error: "Conflict",
+				Data:  fmt.Sprintf("Sub area '%s' already exists in area '%s'", subArea.Name, area.Name),
+			})
+			return
+		}
+	}
+
+	subAreas := append(append([]models.HXSubArea{}, area.SubAreas...), subArea)
+	saveArea(w, r, "createSubArea", area, func(ctx context.Context) error {
+		return db.Areas.SetSubAreas(ctx, area.ID, subAreas)
+	})
+}
+
+// Update a sub area (/areas/{name}/sub-areas/{subName})
+func adminUpdateSubArea(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	area, ok := lookupArea(w, r)
+	if !ok {
+		return
+	}
+
+	var req subAreaRequest
+	if err := decodeBody(r, &req); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+
+	subName := mux.Vars(r)["subName"]
+	subAreas := append([]models.HXSubArea{}, area.SubAreas...)
+
+	found := false
+	for i, s := range subAreas {
+		if s.Name != subName {
+			continue
+		}
+
+		if req.Name != nil && *req.Name != subName {
+			for _, other := range area.SubAreas {
+				if other.Name == *req.Name {
+					writeResponse(w, http.StatusConflict, ResponseError{
+						Error: "Conflict",
+						Data:  fmt.Sprintf("Sub area '%s' already exists in area '%s'", *req.Name, area.Name),
+					})
+					return
+				}
+			}
+			s.Name = *req.Name
+		}
+		if req.FullName != nil {
+			s.FullName = *req.FullName
+		}
+		if req.Active != nil {
+			s.Active = *req.Active
+		}
+		if err := validateSubArea(s); err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+
+		subAreas[i] = s
+		found = true
+		break
+	}
+
+	if !found {
+		writeNotFound(w, "Sub area", subName)
+		return
+	}
+
+	saveArea(w, r, "updateSubArea", area, func(ctx context.Context) error {
+		return db.Areas.SetSubAreas(ctx, area.ID, subAreas)
+	})
+}
+
+// Delete a sub area (/areas/{name}/sub-areas/{subName})
+func adminDeleteSubArea(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	area, ok := lookupArea(w, r)
+	if !ok {
+		return
+	}
+
+	subName := mux.Vars(r)["subName"]
+	subAreas := []models.HXSubArea{}
+	for _, s := range area.SubAreas {
+		if s.Name != subName {
+			subAreas = append(subAreas, s)
+		}
+	}
+
+	if len(subAreas) == len(area.SubAreas) {
+		writeNotFound(w, "Sub area", subName)
+		return
+	}
+
+	saveArea(w, r, "deleteSubArea", area, func(ctx context.Context) error {
+		return db.Areas.SetSubAreas(ctx, area.ID, subAreas)
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/thisisnttheway/hx-monitor/db"
+	"github.com/thisisnttheway/hx-monitor/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type apiKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// Returned once on creation, the plain key cannot be recovered afterwards
+type apiKeyCreated struct {
+	Key    string        `json:"key"`
+	APIKey models.APIKey `json:"api_key"`
+}
+
+// Get all API keys (/api-keys)
+func adminGetApiKeys(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	keys, err := db.APIKeys.List(r.Context())
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, ResponseOk{Message: "Ok", Data: keys})
+}
+
+// Create an API key (/api-keys)
+func adminCreateApiKey(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	var req apiKeyRequest
+	if err := decodeBody(r, &req); err != nil {
+		writeBadRequest(w, err)
+		return
+	}
+	if req.Name == "" || len(req.Scopes) == 0 {
+		writeBadRequest(w, fmt.Errorf("'name' and 'scopes' are required"))
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(allScopes, scope) {
+			writeBadRequest(w, fmt.Errorf("unknown scope '%s', must be one of %v", scope, allScopes))
+			return
+		}
+	}
+
+	key, err := generateApiKey()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	apiKey := models.APIKey{
+		ID:        primitive.NewObjectID(),
+		Name:      req.Name,
+		Prefix:    key[:len(apiKeyPrefix)+6],
+		KeyHash:   hashApiKey(key),
+		Scopes:    req.Scopes,
+		CreatedAt: time.Now(),
+		CreatedBy: actorFromRequest(r),
+	}
+	if err := db.APIKeys.Insert(r.Context(), apiKey); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	writeAuditLog(r, "createApiKey", "api_keys/"+apiKey.ID.Hex(), nil, apiKey)
+	writeResponse(w, http.StatusCreated, ResponseOk{
+		Message: "Created",
+		Data:    apiKeyCreated{Key: key, APIKey: apiKey},
+	})
+}
+
+// Revoke an API key (/api-keys/{id})
+func adminRevokeApiKey(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	idString := mux.Vars(r)["id"]
+	id, err := primitive.ObjectIDFromHex(idString)
+	if err != nil {
+		writeBadRequest(w, fmt.Errorf("invalid API key ID '%s'", idString))
+		return
+	}
+
+	apiKey, err := db.APIKeys.GetByID(r.Context(), id)
+	if errors.Is(err, db.ErrNotFound) {
+		writeNotFound(w, "API key", idString)
+		return
+	}
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	revoked := apiKey
+	revoked.Revoked = true
+	if err := db.APIKeys.Revoke(r.Context(), id); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	writeAuditLog(r, "revokeApiKey", "api_keys/"+idString, apiKey, revoked)
+	writeResponse(w, http.StatusOK, ResponseOk{Message: "Revoked", Data: revoked})
+}
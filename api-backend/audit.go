@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/thisisnttheway/hx-monitor/db"
+	"github.com/thisisnttheway/hx-monitor/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Returns the IP address of the client that sent a request
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// Writes an audit log entry for a change made through the admin API.
+// Failures are logged but never abort the request, as the change has already been applied.
+func writeAuditLog(r *http.Request, action string, target string, before interface{}, after interface{}) {
+	entry := models.AuditLogEntry{
+		ID:       primitive.NewObjectID(),
+		Time:     time.Now(),
+		Actor:    actorFromRequest(r),
+		Action:   action,
+		Target:   target,
+		Before:   before,
+		After:    after,
+		RemoteIP: remoteIP(r),
+	}
+
+	slog.Info("AUDIT",
+		"actor", entry.Actor,
+		"action", entry.Action,
+		"target", entry.Target,
+		"remoteIp", entry.RemoteIP,
+	)
+
+	if err := db.AuditLog.Insert(r.Context(), entry); err != nil {
+		slog.Error("AUDIT", "action", "insertAuditLog", "error", err)
+	}
+}
+
+// Get audit log entries, newest first (/audit)
+func getAuditLog(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	limit, err := parseLimit(r, 100)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, ResponseError{Error: "Bad request", Data: err.Error()})
+		return
+	}
+
+	entries, err := db.AuditLog.List(
+		r.Context(),
+		r.URL.Query().Get("target"),
+		r.URL.Query().Get("actor"),
+		limit,
+	)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, ResponseOk{Message: "Ok", Data: entries})
+}
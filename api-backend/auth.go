@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/thisisnttheway/hx-monitor/db"
+)
+
+const (
+	ScopeReadStatus      string = "status:read"
+	ScopeReadTranscripts string = "transcripts:read"
+	ScopeAdmin           string = "admin"
+
+	apiKeyPrefix string = "hxk_"
+
+	// last_used of API keys is only updated if it is older than this, so that reads do not cause writes
+	apiKeyLastUsedResolution time.Duration = 5 * time.Minute
+)
+
+var allScopes = []string{ScopeReadStatus, ScopeReadTranscripts, ScopeAdmin}
+
+type contextKey string
+
+const principalKey contextKey = "principal"
+
+// Authenticated caller of a request
+type Principal struct {
+	Actor  string
+	Source string // "static", "apiKey" or "oidc"
+	Scopes []string
+}
+
+func (p Principal) HasScope(scope string) bool {
+	// Admins may do anything
+	return slices.Contains(p.Scopes, scope) || slices.Contains(p.Scopes, ScopeAdmin)
+}
+
+type AuthConfiguration struct {
+	// { "<token>": "<actor>" }, tokens with full access from ADMIN_API_TOKENS
+	StaticTokens map[string]string
+
+	// Scopes that do not require authentication
+	PublicScopes []string
+
+	OidcVerifier    *oidc.IDTokenVerifier
+	OidcScopesClaim string
+	OidcActorClaim  string
+}
+
+var authConfig AuthConfiguration = AuthConfiguration{
+	StaticTokens: make(map[string]string),
+}
+
+// Set up authentication from env vars
+func setUpAuthConfig() {
+	// Static admin tokens, formatted as "<actor>:<token>,<actor>:<token>"
+	for _, pair := range strings.Split(os.Getenv("ADMIN_API_TOKENS"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		actor, token, found := strings.Cut(strings.TrimSpace(pair), ":")
+		if !found || actor == "" || token == "" {
+			slog.Error("AUTH", "message", "Ignoring malformed entry in ADMIN_API_TOKENS", "actor", actor)
+			continue
+		}
+
+		authConfig.StaticTokens[token] = actor
+	}
+
+	// The status map is public by default, transcripts too as the frontend shows them
+	authConfig.PublicScopes = []string{}
+	if getEnvBool("PUBLIC_STATUS", true) {
+		authConfig.PublicScopes = append(authConfig.PublicScopes, ScopeReadStatus)
+	}
+	if getEnvBool("PUBLIC_TRANSCRIPTS", true) {
+		authConfig.PublicScopes = append(authConfig.PublicScopes, ScopeReadTranscripts)
+	}
+
+	issuer := os.Getenv("OIDC_ISSUER_URL")
+	if issuer != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		provider, err := oidc.NewProvider(ctx, issuer)
+		if err != nil {
+			slog.Error("AUTH", "message", "Failed setting up OIDC provider, JWT authentication is disabled", "issuer", issuer, "error", err)
+		} else {
+			audience := os.Getenv("OIDC_AUDIENCE")
+			authConfig.OidcVerifier = provider.Verifier(&oidc.Config{
+				ClientID:          audience,
+				SkipClientIDCheck: audience == "",
+			})
+		}
+
+		authConfig.OidcScopesClaim = getEnv("OIDC_SCOPES_CLAIM", "scope")
+		authConfig.OidcActorClaim = getEnv("OIDC_ACTOR_CLAIM", "sub")
+	}
+
+	slog.Info("AUTH",
+		"staticTokens", len(authConfig.StaticTokens),
+		"publicScopes", authConfig.PublicScopes,
+		"oidcEnabled", authConfig.OidcVerifier != nil,
+	)
+}
+
+// Returns the principal of an authenticated request
+func principalFromRequest(r *http.Request) (Principal, bool) {
+	p, ok := r.Context().Value(principalKey).(Principal)
+	return p, ok
+}
+
+// Returns the actor of an authenticated request
+func actorFromRequest(r *http.Request) string {
+	p, ok := principalFromRequest(r)
+	if !ok {
+		return "anonymous"
+	}
+
+	return p.Actor
+}
+
+// Extracts a credential from either the Authorization or X-API-Key header
+func credentialFromRequest(r *http.Request) string {
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		return strings.TrimSpace(token)
+	}
+
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+// Resolves a credential to a principal
+func authenticate(ctx context.Context, credential string) (Principal, error) {
+	for token, actor := range authConfig.StaticTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(credential)) == 1 {
+			return Principal{Actor: actor, Source: "static", Scopes: allScopes}, nil
+		}
+	}
+
+	if strings.HasPrefix(credential, apiKeyPrefix) {
+		return authenticateApiKey(ctx, credential)
+	}
+
+	if authConfig.OidcVerifier != nil && strings.Count(credential, ".") == 2 {
+		return authenticateJwt(ctx, credential)
+	}
+
+	return Principal{}, fmt.Errorf("unknown credential")
+}
+
+func authenticateApiKey(ctx context.Context, key string) (Principal, error) {
+	apiKey, err := db.APIKeys.GetActiveByHash(ctx, hashApiKey(key))
+	if errors.Is(err, db.ErrNotFound) {
+		return Principal{}, fmt.Errorf("unknown or revoked API key")
+	}
+	if err != nil {
+		return Principal{}, err
+	}
+
+	if now := time.Now(); now.Sub(apiKey.LastUsed) > apiKeyLastUsedResolution {
+		if err := db.APIKeys.SetLastUsed(ctx, apiKey.ID, now); err != nil {
+			slog.Warn("AUTH", "message", "Failed updating last use of API key", "apiKey", apiKey.Name, "error", err)
+		}
+	}
+
+	return Principal{Actor: "apikey:" + apiKey.Name, Source: "apiKey", Scopes: apiKey.Scopes}, nil
+}
+
+func authenticateJwt(ctx context.Context, rawToken string) (Principal, error) {
+	token, err := authConfig.OidcVerifier.Verify(ctx, rawToken)
+	if err != nil {
+		return Principal{}, fmt.Errorf("invalid JWT: %v", err)
+	}
+
+	var claims map[string]interface{}
+	if err := token.Claims(&claims); err != nil {
+		return Principal{}, fmt.Errorf("invalid JWT claims: %v", err)
+	}
+
+	// Scopes may either be a space separated string or a list of strings
+	var scopes []string
+	switch v := claims[authConfig.OidcScopesClaim].(type) {
+	case string:
+		scopes = strings.Fields(v)
+	case []interface{}:
+		for _, s := range v {
+			if str, ok := s.(string); ok {
+				scopes = append(scopes, str)
+			}
+		}
+	}
+
+	// Drop scopes that carry no meaning for this API
+	scopes = slices.DeleteFunc(scopes, func(s string) bool {
+		return !slices.Contains(allScopes, s)
+	})
+
+	actor, _ := claims[authConfig.OidcActorClaim].(string)
+	if actor == "" {
+		actor = token.Subject
+	}
+
+	return Principal{Actor: "oidc:" + actor, Source: "oidc", Scopes: scopes}, nil
+}
+
+// Only lets through requests that are allowed to use the given scope
+func requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			credential := credentialFromRequest(r)
+			if credential == "" {
+				if slices.Contains(authConfig.PublicScopes, scope) {
+					next.ServeHTTP(w, r)
+					return
+				}
+
+				w.Header().Set("WWW-Authenticate", `Bearer realm="hx-monitor"`)
+				writeError(w, r, http.StatusUnauthorized, problemUnauthorized, "Unauthorized", "Missing credentials")
+				return
+			}
+
+			principal, err := authenticate(r.Context(), credential)
+			if err != nil {
+				slog.Warn("AUTH", "message", "Rejected request", "path", r.URL.Path, "remoteIp", remoteIP(r), "error", err)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="hx-monitor", error="invalid_token"`)
+				writeError(w, r, http.StatusUnauthorized, problemUnauthorized, "Unauthorized", "Invalid credentials")
+				return
+			}
+
+			if !principal.HasScope(scope) && !slices.Contains(authConfig.PublicScopes, scope) {
+				slog.Warn("AUTH", "message", "Insufficient scope", "actor", principal.Actor, "requiredScope", scope)
+				writeError(w, r, http.StatusForbidden, problemForbidden, "Forbidden", fmt.Sprintf("Scope '%s' is required", scope))
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), principalKey, principal)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Generates a new random API key
+func generateApiKey() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return apiKeyPrefix + hex.EncodeToString(b), nil
+}
+
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get a boolean environment variable with a default value
+func getEnvBool(key string, defaultValue bool) bool {
+	v, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		slog.Error("AUTH", "message", fmt.Sprintf("Was unable to parse env var '%s'", key), "error", err)
+		return defaultValue
+	}
+
+	return b
+}
+
+// Get environment variable with a default value
+func getEnv(key string, defaultValue string) string {
+	val, ok := os.LookupEnv(key)
+	if ok {
+		return val
+	} else {
+		return defaultValue
+	}
+}
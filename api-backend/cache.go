@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thisisnttheway/hx-monitor/db"
+	"github.com/thisisnttheway/hx-monitor/models"
+)
+
+const (
+	maxCacheControlAge time.Duration = 5 * time.Minute
+
+	// Used when no area is scheduled to be checked, e.g. when all are paused or overdue
+	defaultCacheControlAge time.Duration = 30 * time.Second
+)
+
+// In-process cache of all hx_areas documents
+type AreaCache struct {
+	mu        sync.RWMutex
+	areas     []models.HXArea
+	expiresAt time.Time
+	ttl       time.Duration
+}
+
+var areaCache *AreaCache = &AreaCache{}
+
+// Set up the area cache from env vars
+func setUpAreaCache() {
+	ttl, err := time.ParseDuration(getEnv("AREA_CACHE_TTL", "30s"))
+	if err != nil {
+		slog.Error("CACHE", "message", "Was unable to parse env var 'AREA_CACHE_TTL'", "error", err)
+		ttl = 30 * time.Second
+	}
+
+	areaCache.ttl = ttl
+	slog.Info("CACHE", "areaCacheTtl", ttl)
+}
+
+// Returns all areas, either from cache or from the DB
+func (c *AreaCache) GetAll(ctx context.Context) ([]models.HXArea, error) {
+	c.mu.RLock()
+	if c.areas != nil && time.Now().Before(c.expiresAt) {
+		defer c.mu.RUnlock()
+		return c.areas, nil
+	}
+	c.mu.RUnlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Another request may have refreshed the cache in the meantime
+	if c.areas != nil && time.Now().Before(c.expiresAt) {
+		return c.areas, nil
+	}
+
+	areas, err := db.Areas.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Areas change once a check completes, so the cache must not outlive the next scheduled check
+	expiresAt := time.Now().Add(c.ttl)
+	if next, ok := earliestNextAction(areas); ok && next.Before(expiresAt) {
+		expiresAt = next
+	}
+
+	c.areas, c.expiresAt = areas, expiresAt
+	slog.Debug("CACHE", "action", "refreshAreas", "amount", len(areas), "expiresAt", expiresAt)
+
+	return areas, nil
+}
+
+// Returns a single area by name from the cache, reporting whether it exists
+func (c *AreaCache) GetByName(ctx context.Context, name string) (models.HXArea, bool, error) {
+	areas, err := c.GetAll(ctx)
+	if err != nil {
+		return models.HXArea{}, false, err
+	}
+
+	for _, area := range areas {
+		if area.Name == name {
+			return area, true, nil
+		}
+	}
+
+	return models.HXArea{}, false, nil
+}
+
+// Drops all cached areas
+func (c *AreaCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.areas = nil
+	slog.Debug("CACHE", "action", "invalidate")
+}
+
+// Invalidates the cache whenever hx_areas changes, e.g. due to the monitor writing results.
+// Not every DB supports this (MongoDB requires a replica set); Without it the cache relies on its TTL alone.
+func (c *AreaCache) WatchChanges(ctx context.Context) {
+	changes, err := db.Areas.Watch(ctx)
+	if err != nil {
+		slog.Warn("CACHE", "message", "Watching changes is unavailable, relying on TTL", "error", err)
+		return
+	}
+
+	slog.Info("CACHE", "action", "watchChanges", "collection", db.AreaCollection)
+	for range changes {
+		c.Invalidate()
+	}
+
+	if ctx.Err() == nil {
+		slog.Warn("CACHE", "message", "Watching changes ended, relying on TTL")
+	}
+}
+
+// Returns the earliest next_action of the given areas that lies in the future.
+// Paused areas are not checked, and overdue ones are checked whenever the monitor gets to them, so both are skipped.
+func earliestNextAction(areas []models.HXArea) (time.Time, bool) {
+	now := time.Now()
+
+	var earliest time.Time
+	for _, area := range areas {
+		if area.Paused || !area.NextAction.After(now) {
+			continue
+		}
+		if earliest.IsZero() || area.NextAction.Before(earliest) {
+			earliest = area.NextAction
+		}
+	}
+
+	return earliest, !earliest.IsZero()
+}
+
+// Sets Cache-Control based on when the given areas are due to be updated.
+// Shared caches may only store areas that anyone can read without credentials.
+func setAreaCacheControl(w http.ResponseWriter, r *http.Request, areas []models.HXArea) {
+	maxAge := defaultCacheControlAge
+	if next, ok := earliestNextAction(areas); ok {
+		maxAge = min(time.Until(next), maxCacheControlAge)
+	}
+
+	visibility := "public"
+	if !slices.Contains(authConfig.PublicScopes, ScopeReadStatus) || credentialFromRequest(r) != "" {
+		visibility = "private"
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d", visibility, int(math.Floor(maxAge.Seconds()))))
+	w.Header().Add("Vary", "Authorization, X-API-Key")
+}
+
+// Sets an ETag for the given body and reports whether the client already has it
+func checkETag(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+
+	return false
+}
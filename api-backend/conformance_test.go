@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/thisisnttheway/hx-monitor-api/openapi"
+	"github.com/thisisnttheway/hx-monitor/configuration"
+	"github.com/thisisnttheway/hx-monitor/db"
+	"github.com/thisisnttheway/hx-monitor/logger"
+	"github.com/thisisnttheway/hx-monitor/migrations"
+	"github.com/thisisnttheway/hx-monitor/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const conformanceToken = "s3cr3t"
+
+// Placeholders with a pattern, e.g. "{name:[^/]+}", are documented without it
+var routeVariablePattern = regexp.MustCompile(`\{(\w+):[^}]*\}`)
+
+type registeredRoute struct {
+	Method   string
+	Template string
+}
+
+// Checks the routes against the OpenAPI document the API serves.
+// Every route registered with the router must be documented, and its responses must match the document.
+type conformance struct {
+	t       *testing.T
+	baseUrl string
+	client  *http.Client
+	doc     openapi.Document
+}
+
+func TestOpenApiConformance(t *testing.T) {
+	server := newConformanceServer(t)
+	c := &conformance{t: t, baseUrl: server.URL, client: server.Client()}
+
+	_, _, body, err := c.request(http.MethodGet, apiBase+"openapi.json", nil)
+	if err != nil {
+		t.Fatalf("could not fetch OpenAPI document: %v", err)
+	}
+	if err := json.Unmarshal(body, &c.doc); err != nil {
+		t.Fatalf("could not parse OpenAPI document: %v", err)
+	}
+
+	routes, err := registeredRoutes(newRouter())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("documented", func(t *testing.T) { c.withT(t).checkDocumented(routes) })
+	t.Run("reads", func(t *testing.T) { c.withT(t).checkReads(routes) })
+	t.Run("unknownObjects", func(t *testing.T) { c.withT(t).checkUnknownObjects(routes) })
+	t.Run("writes", func(t *testing.T) { c.withT(t).checkWrites() })
+}
+
+// Serves the API like main does, on a migrated SQLite database with one number and area
+func newConformanceServer(t *testing.T) *httptest.Server {
+	t.Setenv("DB_DRIVER", configuration.DriverSqlite)
+	t.Setenv("SQLITE_PATH", filepath.Join(t.TempDir(), "hx.db"))
+	t.Setenv("ADMIN_API_TOKENS", "conformance:"+conformanceToken)
+	t.Setenv("RATE_LIMIT_RPS", "0")
+
+	cfg, err := configuration.Load("")
+	if err == nil {
+		err = cfg.ValidateDatabase()
+	}
+	if err != nil {
+		t.Fatalf("invalid configuration: %v", err)
+	}
+	configuration.Use(cfg)
+	if err := logger.Setup(cfg.Logging); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := db.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Disconnect(context.Background()) })
+	if err := migrations.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	number := models.Number{ID: primitive.NewObjectID(), Name: "zurich", Number: "+41440000000"}
+	area := models.HXArea{
+		ID:         primitive.NewObjectID(),
+		Name:       "zurich",
+		NumberName: number.Name,
+		NextAction: time.Now().Add(time.Hour).UTC(),
+		SubAreas:   []models.HXSubArea{{Name: "ctr", FullName: "Zurich CTR", Active: true}},
+		RetryState: models.RetryNone,
+	}
+	if err := db.Numbers.Insert(ctx, number); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Areas.Insert(ctx, area); err != nil {
+		t.Fatal(err)
+	}
+
+	setUpAuthConfig()
+	setUpCors()
+	setUpRateLimiter()
+	setUpAreaCache()
+
+	server := httptest.NewServer(corsMiddleware(rateLimitMiddleware(newRouter())))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (c *conformance) withT(t *testing.T) *conformance {
+	copied := *c
+	copied.t = t
+	return &copied
+}
+
+// Returns every method and path template the router serves, sorted by template
+func registeredRoutes(router *mux.Router) ([]registeredRoute, error) {
+	var routes []registeredRoute
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Prefixes of subrouters and catch-all handlers
+			return nil
+		}
+
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		template = routeVariablePattern.ReplaceAllString(template, "{$1}")
+
+		for _, method := range methods {
+			routes = append(routes, registeredRoute{Method: method, Template: template})
+		}
+		return nil
+	})
+
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Template != routes[j].Template {
+			return routes[i].Template < routes[j].Template
+		}
+		return routes[i].Method < routes[j].Method
+	})
+	return routes, err
+}
+
+func operation(doc *openapi.Document, method string, template string) *openapi.Operation {
+	item, exists := doc.Paths[template]
+	if !exists || item == nil {
+		return nil
+	}
+
+	switch method {
+	case http.MethodGet:
+		return item.Get
+	case http.MethodPost:
+		return item.Post
+	case http.MethodPut:
+		return item.Put
+	case http.MethodPatch:
+		return item.Patch
+	case http.MethodDelete:
+		return item.Delete
+	}
+	return nil
+}
+
+// Every registered route must be documented, and every documented operation must be registered
+func (c *conformance) checkDocumented(routes []registeredRoute) {
+	registered := make(map[registeredRoute]bool)
+	for _, route := range routes {
+		registered[route] = true
+		if operation(&c.doc, route.Method, route.Template) == nil {
+			c.t.Errorf("%s %s is not documented", route.Method, route.Template)
+		}
+	}
+
+	for template := range c.doc.Paths {
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+			if operation(&c.doc, method, template) != nil && !registered[registeredRoute{method, template}] {
+				c.t.Errorf("%s %s is documented but not registered", method, template)
+			}
+		}
+	}
+}
+
+// Calls every GET route, filling in path parameters with the seeded objects
+func (c *conformance) checkReads(routes []registeredRoute) {
+	for _, route := range routes {
+		if route.Method != http.MethodGet {
+			continue
+		}
+
+		path := resolvePath(route.Template, "zurich", "ctr", "zurich")
+		path = strings.ReplaceAll(path, "{id}", primitive.NilObjectID.Hex())
+		c.check(route.Method, route.Template, path, nil, 0)
+	}
+}
+
+// Calls every route with path parameters for objects that do not exist, which must result in a documented error
+func (c *conformance) checkUnknownObjects(routes []registeredRoute) {
+	for _, route := range routes {
+		if !strings.Contains(route.Template, "{") {
+			continue
+		}
+
+		path := resolvePath(route.Template, "does-not-exist", "does-not-exist", "does-not-exist")
+		path = strings.ReplaceAll(path, "{id}", primitive.NilObjectID.Hex())
+
+		var body interface{}
+		if route.Method == http.MethodPost || route.Method == http.MethodPatch {
+			body = map[string]interface{}{}
+		}
+		c.check(route.Method, route.Template, path, body, 0)
+	}
+}
+
+// Walks a temporary number, area, sub area and API key through every route that changes data, and sets a log level
+func (c *conformance) checkWrites() {
+	name := "conformance"
+	numbers, areas := adminBase+"numbers", adminBase+"areas"
+	area, subArea := areas+"/"+name, areas+"/"+name+"/sub-areas/"+name
+
+	steps := []struct {
+		method   string
+		template string
+		path     string
+		body     interface{}
+		expected int
+	}{
+		{http.MethodPost, numbers, numbers, map[string]interface{}{"name": name, "number": "+41000000000"}, http.StatusCreated},
+		{http.MethodPost, numbers, numbers, map[string]interface{}{"name": name, "number": "+41000000000"}, http.StatusConflict},
+		{http.MethodPatch, numbers + "/{name}", numbers + "/" + name, map[string]interface{}{"number": "+41000000001"}, http.StatusOK},
+		{http.MethodPost, areas, areas, map[string]interface{}{"name": name, "number_name": name, "paused": true, "next_action": "2099-01-01T00:00:00Z"}, http.StatusCreated},
+		{http.MethodPost, areas, areas, map[string]interface{}{"name": name, "number_name": name}, http.StatusConflict},
+		{http.MethodPost, areas, areas, map[string]interface{}{"name": name + "-2", "number_name": name, "sub_areas": []map[string]interface{}{{"name": name, "full_name": name}, {"name": name, "full_name": name}}}, http.StatusBadRequest},
+		{http.MethodPatch, areas + "/{name}", area, map[string]interface{}{"paused": true}, http.StatusOK},
+		{http.MethodPatch, areas + "/{name}", area, map[string]interface{}{"sub_areas": []map[string]interface{}{{"name": name, "full_name": name}, {"name": name, "full_name": name}}}, http.StatusBadRequest},
+		{http.MethodPost, areas + "/{name}/resume", area + "/resume", nil, http.StatusOK},
+		{http.MethodPost, areas + "/{name}/pause", area + "/pause", nil, http.StatusOK},
+		{http.MethodPost, areas + "/{name}/recheck", area + "/recheck", nil, http.StatusOK},
+		{http.MethodPost, areas + "/{name}/reset-errors", area + "/reset-errors", nil, http.StatusOK},
+		{http.MethodPost, areas + "/{name}/sub-areas", area + "/sub-areas", map[string]interface{}{"name": name, "full_name": name}, http.StatusOK},
+		{http.MethodPost, areas + "/{name}/sub-areas", area + "/sub-areas", map[string]interface{}{"name": name, "full_name": name}, http.StatusConflict},
+		{http.MethodPatch, areas + "/{name}/sub-areas/{subName}", subArea, map[string]interface{}{"active": true}, http.StatusOK},
+		{http.MethodDelete, areas + "/{name}/sub-areas/{subName}", subArea, nil, http.StatusOK},
+		{http.MethodDelete, numbers + "/{name}", numbers + "/" + name, nil, http.StatusConflict},
+		{http.MethodDelete, areas + "/{name}", area, nil, http.StatusOK},
+		{http.MethodDelete, numbers + "/{name}", numbers + "/" + name, nil, http.StatusOK},
+		{http.MethodPut, adminBase + "loglevel", adminBase + "loglevel?component=CACHE&level=debug", nil, http.StatusOK},
+		{http.MethodPut, adminBase + "loglevel", adminBase + "loglevel?level=verbose", nil, http.StatusBadRequest},
+		{http.MethodPut, adminBase + "loglevel", adminBase + "loglevel?component=CACHE", nil, http.StatusOK},
+	}
+	for _, s := range steps {
+		c.check(s.method, s.template, s.path, s.body, s.expected)
+	}
+
+	apiKeys := adminBase + "api-keys"
+	body := c.check(http.MethodPost, apiKeys, apiKeys, map[string]interface{}{"name": name, "scopes": []string{ScopeReadStatus}}, http.StatusCreated)
+	var envelope struct {
+		Data apiKeyCreated `json:"data"`
+	}
+	if json.Unmarshal(body, &envelope) != nil || envelope.Data.APIKey.ID.IsZero() {
+		c.t.Errorf("no API key was created to revoke")
+		return
+	}
+	c.check(http.MethodDelete, apiKeys+"/{id}", apiKeys+"/"+envelope.Data.APIKey.ID.Hex(), nil, http.StatusOK)
+}
+
+// Calls a route and validates the response against the document. Unless expected is 0, the status must match it.
+// Returns the body of the response.
+func (c *conformance) check(method string, template string, path string, body interface{}, expected int) []byte {
+	c.t.Helper()
+
+	op := operation(&c.doc, method, template)
+	if op == nil {
+		c.t.Errorf("%s %s is not documented", method, template)
+		return nil
+	}
+
+	status, contentType, responseBody, err := c.request(method, path, body)
+	if err != nil {
+		c.t.Errorf("%s %s: %v", method, path, err)
+		return nil
+	}
+
+	if expected != 0 && status != expected {
+		c.t.Errorf("%s %s: expected status %d, got %d: %s", method, path, expected, status, responseBody)
+		return responseBody
+	}
+
+	response, documented := op.Responses[strconv.Itoa(status)]
+	if !documented {
+		c.t.Errorf("%s %s: status %d is not documented for %s", method, path, status, template)
+		return responseBody
+	}
+	if len(response.Content) == 0 {
+		return responseBody
+	}
+
+	contentType, _, _ = mime.ParseMediaType(contentType)
+	mediaType, hasContent := response.Content[contentType]
+	if !hasContent {
+		c.t.Errorf("%s %s: content type '%s' is not documented for status %d", method, path, contentType, status)
+		return responseBody
+	}
+
+	if err := c.doc.ValidateJSON(mediaType.Schema, responseBody); err != nil {
+		c.t.Errorf("%s %s (%d): %v", method, path, status, err)
+	}
+	return responseBody
+}
+
+func (c *conformance) request(method string, path string, body interface{}) (int, string, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return 0, "", nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, c.baseUrl+path, reader)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+conformanceToken)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header.Get("Content-Type"), responseBody, err
+}
+
+// Fills in the path parameters of areas, sub areas and numbers
+func resolvePath(template string, areaName string, subAreaName string, numberName string) string {
+	name := areaName
+	if strings.Contains(template, "/numbers/") {
+		name = numberName
+	}
+
+	path := strings.ReplaceAll(template, "{name}", name)
+	return strings.ReplaceAll(path, "{subName}", subAreaName)
+}
@@ -1,55 +1,76 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"slices"
 	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/thisisnttheway/hx-monitor/db"
 	"github.com/thisisnttheway/hx-monitor/models"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // Prints various information about a request to stdout
 func logResponse(r *http.Request) {
-	headers, _ := json.Marshal(r.Header)
 	slog.Info("SERVER",
 		"path", strings.TrimPrefix(r.URL.Path, apiBase),
 		"method", r.Method,
-		"body", r.Body,
-		"headers", headers,
+		"remoteIp", remoteIP(r),
 	)
+
+	// Headers are only of interest when debugging, as they make up most of the log volume
+	if slog.Default().Enabled(r.Context(), slog.LevelDebug) {
+		redactedHeaders := r.Header.Clone()
+		for _, h := range []string{"Authorization", "X-Api-Key"} {
+			if redactedHeaders.Get(h) != "" {
+				redactedHeaders.Set(h, "<redacted>")
+			}
+		}
+
+		headers, _ := json.Marshal(redactedHeaders)
+		slog.Debug("SERVER", "path", r.URL.Path, "headers", string(headers))
+	}
+}
+
+// Writes an area response that clients may cache until the areas are due to be updated
+func writeAreaResponse(w http.ResponseWriter, r *http.Request, body interface{}, areas []models.HXArea) {
+	res, _ := json.Marshal(body)
+
+	setAreaCacheControl(w, r, areas)
+	if checkETag(w, r, res) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	fmt.Fprint(w, string(res))
 }
 
 // Get all areas
 func getAreas(w http.ResponseWriter, r *http.Request) {
 	logResponse(r)
 
-	hxAreas, err := db.GetDocument[models.HXArea](
-		"hx_areas",
-		bson.M{},
-	)
+	hxAreas, err := areaCache.GetAll(r.Context())
+	if err == nil && len(hxAreas) == 0 {
+		err = fmt.Errorf("the database returned nothing for the given query: %v", bson.M{})
+	}
 
-	var s interface{}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		s = ResponseError{
+		res, _ := json.Marshal(ResponseError{
 			Error: "Internal error",
 			Data:  err.Error(),
-		}
-	} else {
-		s = ResponseOk{
-			Message: "Ok",
-			Data:    hxAreas,
-		}
+		})
+		fmt.Fprint(w, string(res))
+		return
 	}
 
-	res, _ := json.Marshal(s)
-	fmt.Fprint(w, string(res))
+	writeAreaResponse(w, r, ResponseOk{Message: "Ok", Data: hxAreas}, hxAreas)
 }
 
 // Get area by name (/areas/{name})
@@ -57,27 +78,22 @@ func getAreaByName(w http.ResponseWriter, r *http.Request) {
 	logResponse(r)
 	areaName := mux.Vars(r)["name"]
 
-	hxArea, err := db.GetDocument[models.HXArea](
-		"hx_areas",
-		bson.M{"name": areaName},
-	)
+	hxArea, exists, err := areaCache.GetByName(r.Context(), areaName)
+	if err == nil && !exists {
+		err = fmt.Errorf("the database returned nothing for the given query: %v", bson.M{"name": areaName})
+	}
 
-	var s interface{}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		s = ResponseError{
+		res, _ := json.Marshal(ResponseError{
 			Error: "Internal error",
 			Data:  err.Error(),
-		}
-	} else {
-		s = ResponseOk{
-			Message: "Ok",
-			Data:    hxArea[0],
-		}
+		})
+		fmt.Fprint(w, string(res))
+		return
 	}
 
-	res, _ := json.Marshal(s)
-	fmt.Fprint(w, string(res))
+	writeAreaResponse(w, r, ResponseOk{Message: "Ok", Data: hxArea}, []models.HXArea{hxArea})
 }
 
 // Gets the latest transcript for a given area
@@ -85,17 +101,7 @@ func getTranscriptsLatest(w http.ResponseWriter, r *http.Request) {
 	logResponse(r)
 
 	areaName := mux.Vars(r)["name"]
-	transcripts, err := db.Aggregate[transcriptAggregation](
-		"hx_areas",
-		getTranscriptAggregationPipeline(areaName, []bson.D{
-			{
-				{"$sort", bson.D{
-					{"related_transcripts.date", -1},
-				}},
-			},
-			{{"$limit", 1}},
-		}),
-	)
+	transcripts, err := listAreaTranscripts(r.Context(), areaName, 1)
 
 	response := handleTranscripts(transcripts, err, areaName, w)
 	res, _ := json.Marshal(response)
@@ -107,41 +113,37 @@ func getTranscripts(w http.ResponseWriter, r *http.Request) {
 	logResponse(r)
 	areaName := mux.Vars(r)["name"]
 
-	transcripts, err := db.Aggregate[transcriptAggregation](
-		"hx_areas",
-		getTranscriptAggregationPipeline(areaName, []bson.D{}),
-	)
+	transcripts, err := listAreaTranscripts(r.Context(), areaName, 0)
 
+	// v1 has always listed transcripts oldest first
+	slices.Reverse(transcripts)
 	response := handleTranscripts(transcripts, err, areaName, w)
 
 	res, _ := json.Marshal(response)
 	fmt.Fprint(w, string(res))
 }
 
-// Get a mongo.Pipeline for transcript lookups. If specified, inject will be placed inbetween $unwind and $project.
-func getTranscriptAggregationPipeline(areaName string, inject []bson.D) mongo.Pipeline {
-	match := bson.D{{"$match", bson.M{"name": areaName}}}
-	lookup := bson.D{{"$lookup", bson.D{
-		{"from", "transcripts"},
-		{"localField", "_id"},
-		{"foreignField", "hx_area_id"},
-		{"as", "related_transcripts"},
-	}}}
-	unwind := bson.D{{"$unwind", "$related_transcripts"}}
-	project := bson.D{{"$project", bson.M{
-		"transcript": "$related_transcripts.transcript",
-		"date":       "$related_transcripts.date",
-	}}}
-
-	p := mongo.Pipeline{match, lookup, unwind}
-	if len(inject) > 0 {
-		for _, in := range inject {
-			p = append(p, in)
-		}
+// Lists the transcripts of an area by its name, newest first. Unknown areas have no transcripts.
+func listAreaTranscripts(ctx context.Context, areaName string, limit int64) ([]transcriptAggregation, error) {
+	area, err := db.Areas.GetByName(ctx, areaName)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	transcripts, err := db.Transcripts.ListForArea(ctx, area.ID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]transcriptAggregation, 0, len(transcripts))
+	for _, t := range transcripts {
+		result = append(result, transcriptAggregation{Transcript: t.Transcript, Date: t.Date})
 	}
-	p = append(p, project)
 
-	return p
+	return result, nil
 }
 
 // Handles a transcript aggregation result
@@ -173,12 +175,7 @@ func handleTranscripts(t []transcriptAggregation, e error, a string, w http.Resp
 	} else {
 		var dataObject interface{}
 		if len(t) > 1 {
-			type MultipleTranscripts struct {
-				Amount      int                     `json:"amount"`
-				Transcripts []transcriptAggregation `json:"transcripts"`
-			}
-
-			dataObject = MultipleTranscripts{
+			dataObject = multipleTranscripts{
 				Amount:      len(t),
 				Transcripts: t,
 			}
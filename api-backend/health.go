@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/thisisnttheway/hx-monitor/configuration"
+	"github.com/thisisnttheway/hx-monitor/health"
+	"github.com/thisisnttheway/hx-monitor/metrics"
+)
+
+const (
+	defaultMetricsAddress string        = ":9091"
+	healthcheckTimeout    time.Duration = 10 * time.Second
+)
+
+// Serves /healthz and /readyz next to /metrics. Areas are read from the cache, so probes do not add load to the database.
+func setUpHealth(server *metrics.Server) {
+	checker := health.New()
+	checker.AddReadiness("database", health.Database)
+	checker.AddReadiness("areas", health.AreaFreshness(areaCache.GetAll, configuration.Current().Health.AreaStaleAfter))
+
+	server.HandleFunc("/healthz", checker.Liveness)
+	server.HandleFunc("/readyz", checker.Readiness)
+}
+
+// Handles "healthcheck", which probes /readyz of a running instance for container health checks
+func runHealthcheck() error {
+	url, err := health.LocalURL(getEnv("METRICS_LISTEN_ADDRESS", defaultMetricsAddress), "/readyz")
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthcheckTimeout)
+	defer cancel()
+	if err := health.Probe(ctx, url); err != nil {
+		return err
+	}
+
+	fmt.Println("ok")
+	return nil
+}
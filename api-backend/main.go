@@ -1,24 +1,75 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/thisisnttheway/hx-monitor/configuration"
 	"github.com/thisisnttheway/hx-monitor/db"
 	"github.com/thisisnttheway/hx-monitor/logger"
+	"github.com/thisisnttheway/hx-monitor/metrics"
 )
 
 const defaultPort string = "8080"
 
-func init() {
-	db.Connect()
+// Loads the configuration and connects to the database
+func setUpDatabase() {
+	// Shares the database settings, including CONFIG_FILE, with the monitor
+	cfg, err := configuration.Load(os.Getenv("CONFIG_FILE"))
+	if err == nil {
+		err = cfg.ValidateDatabase()
+	}
+	if err != nil {
+		logger.LogErrorFatal("MAIN", fmt.Sprintf("Invalid configuration: %v", err))
+	}
+	configuration.Use(cfg)
+	if err := logger.Setup(cfg.Logging); err != nil {
+		logger.LogErrorFatal("MAIN", err.Error())
+	}
+
+	if err := db.Connect(context.Background()); err != nil {
+		logger.LogErrorFatal("MAIN", err.Error())
+	}
+}
+
+// Applies a reloaded configuration, e.g. reconnects when rotated database credentials were picked up
+func applyConfig(previous configuration.Config, next configuration.Config) {
+	if previous.Logging != next.Logging {
+		if err := logger.Configure(next.Logging); err != nil {
+			slog.Error("MAIN", "action", "applyConfig", "message", "Keeping previous log levels", "error", err)
+		}
+	}
+
+	if previous.Mongo == next.Mongo {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := db.Reconnect(ctx); err != nil {
+		slog.Error("MAIN", "action", "applyConfig", "message", "Keeping previous database connection", "error", err)
+	}
 }
 
 func main() {
-	configuration.SetUpMongoConfig()
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		if err := runHealthcheck(); err != nil {
+			slog.Error("MAIN", "action", "healthcheck", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	setUpDatabase()
+	setUpAuthConfig()
+	setUpCors()
+	setUpRateLimiter()
+	setUpAreaCache()
+	router := newRouter()
 
 	listenPort, exists := os.LookupEnv("LISTEN_PORT")
 	if !exists {
@@ -26,8 +77,20 @@ func main() {
 		listenPort = defaultPort
 	}
 
+	go areaCache.WatchChanges(context.Background())
+	go rateLimiter.RunCleanup(context.Background())
+	metrics.RegisterAreas(areaCache.GetAll)
+	metricsServer := metrics.NewServer(getEnv("METRICS_LISTEN_ADDRESS", defaultMetricsAddress))
+	setUpHealth(metricsServer)
+	go func() {
+		if err := metricsServer.Serve(); err != nil {
+			slog.Error("MAIN", "action", "serveMetrics", "error", err)
+		}
+	}()
+	go configuration.Watch(context.Background(), os.Getenv("CONFIG_FILE"), configuration.Config.ValidateDatabase, applyConfig)
+
 	slog.Info("MAIN", "action", "startServer", "port", listenPort, "apiBase", apiBase)
-	err := http.ListenAndServe(":"+listenPort, muxRouter)
+	err := http.ListenAndServe(":"+listenPort, corsMiddleware(rateLimitMiddleware(router)))
 	if err != nil {
 		logger.LogErrorFatal("MAIN", fmt.Sprintf("Webserver was unable to start: %v", err))
 	}
@@ -1,18 +1,54 @@
 package main
 
-import "net/http"
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+)
 
-func init() {
-	muxRouter.Use(corsMiddleware)
+var corsAllowedOrigins []string
+
+// Set up allowed origins from env vars. No origin is allowed by default, "*" allows all of them.
+func setUpCors() {
+	for _, origin := range strings.Split(getEnv("CORS_ALLOWED_ORIGINS", ""), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			corsAllowedOrigins = append(corsAllowedOrigins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+
+	if slices.Contains(corsAllowedOrigins, "*") {
+		slog.Warn("CORS", "message", "All origins are allowed, consider listing them in CORS_ALLOWED_ORIGINS")
+	} else if len(corsAllowedOrigins) == 0 {
+		slog.Info("CORS", "message", "No origin is allowed, set CORS_ALLOWED_ORIGINS if the frontend is served from another origin")
+	}
+	slog.Info("CORS", "allowedOrigins", corsAllowedOrigins)
 }
 
+// Every route responds with JSON unless a handler says otherwise
+func jsonContentTypeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Wraps the whole router so that preflight requests are answered even though no route matches OPTIONS
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// ToDo: Remove All origins
-		allowOrigin := "*"
-		w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+		origin := r.Header.Get("Origin")
+		if slices.Contains(corsAllowedOrigins, "*") {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else if origin != "" && slices.Contains(corsAllowedOrigins, origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
 
 		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-API-Key")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
 
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/thisisnttheway/hx-monitor-api/openapi"
+	"github.com/thisisnttheway/hx-monitor/logger"
+	"github.com/thisisnttheway/hx-monitor/models"
+)
+
+const apiVersion string = "1.0.0"
+
+var (
+	openApiDocument     *openapi.Document
+	openApiDocumentJson []byte
+	openApiDocumentOnce sync.Once
+)
+
+// Schema of a ResponseOk envelope carrying the given data
+func okEnvelope(doc *openapi.Document, data interface{}) *openapi.Schema {
+	additionalProperties := false
+	return &openapi.Schema{
+		Type: "object",
+		Properties: map[string]*openapi.Schema{
+			"message": {Type: "string"},
+			"data":    doc.SchemaFor(data),
+		},
+		Required:             []string{"message", "data"},
+		AdditionalProperties: &additionalProperties,
+	}
+}
+
+// Schema of a v2 DataResponse envelope carrying the given data
+func dataEnvelope(doc *openapi.Document, data interface{}) *openapi.Schema {
+	additionalProperties := false
+	return &openapi.Schema{
+		Type: "object",
+		Properties: map[string]*openapi.Schema{
+			"data": doc.SchemaFor(data),
+			"meta": doc.SchemaFor(ResponseMeta{}),
+		},
+		Required:             []string{"data", "meta"},
+		AdditionalProperties: &additionalProperties,
+	}
+}
+
+func problemResponse(doc *openapi.Document, description string) *openapi.Response {
+	return &openapi.Response{
+		Description: description,
+		Content:     map[string]openapi.MediaType{"application/problem+json": {Schema: doc.SchemaFor(Problem{})}},
+	}
+}
+
+func jsonResponse(description string, schema *openapi.Schema) *openapi.Response {
+	return &openapi.Response{
+		Description: description,
+		Content:     map[string]openapi.MediaType{"application/json": {Schema: schema}},
+	}
+}
+
+func errorResponse(doc *openapi.Document, description string) *openapi.Response {
+	return jsonResponse(description, doc.SchemaFor(ResponseError{}))
+}
+
+func pathParameter(name string, description string) openapi.Parameter {
+	return openapi.Parameter{
+		Name:        name,
+		In:          "path",
+		Required:    true,
+		Description: description,
+		Schema:      &openapi.Schema{Type: "string"},
+	}
+}
+
+func jsonRequestBody(doc *openapi.Document, body interface{}) *openapi.RequestBody {
+	return &openapi.RequestBody{
+		Required: true,
+		Content:  map[string]openapi.MediaType{"application/json": {Schema: doc.SchemaFor(body)}},
+	}
+}
+
+// Adds responses every operation behind the given scope may return
+func withCommonResponses(doc *openapi.Document, op *openapi.Operation, scope string) *openapi.Operation {
+	op.Responses["429"] = errorResponse(doc, "Rate limit exceeded, see Retry-After")
+	op.Responses["401"] = errorResponse(doc, "Missing or invalid credentials")
+	op.Responses["403"] = errorResponse(doc, fmt.Sprintf("Credentials lack scope '%s'", scope))
+	op.Security = []map[string][]string{{"bearer": {scope}}, {"apiKey": {scope}}, {}}
+	if scope == ScopeAdmin {
+		// Admin operations are never public
+		op.Security = op.Security[:2]
+	}
+
+	return op
+}
+
+// Builds the OpenAPI document describing all routes
+func buildOpenApiDocument() *openapi.Document {
+	doc := openapi.NewDocument(openapi.Info{
+		Title:       "HX Monitor API",
+		Version:     apiVersion,
+		Description: "Activation states of swiss HX airspaces",
+	})
+
+	doc.Components.SecuritySchemes["bearer"] = &openapi.SecurityScheme{
+		Type:        "http",
+		Scheme:      "bearer",
+		Description: "Static admin token, API key or OIDC JWT",
+	}
+	doc.Components.SecuritySchemes["apiKey"] = &openapi.SecurityScheme{
+		Type: "apiKey",
+		In:   "header",
+		Name: "X-API-Key",
+	}
+
+	areaName := pathParameter("name", "Name of the area")
+	numberName := pathParameter("name", "Name of the number")
+	subAreaName := pathParameter("subName", "Name of the sub area")
+
+	// Public
+	doc.Path(apiBase + "areas").Get = withCommonResponses(doc, &openapi.Operation{
+		OperationID: "getAreas",
+		Summary:     "Get all areas",
+		Tags:        []string{"areas"},
+		Responses: map[string]*openapi.Response{
+			"200": jsonResponse("All areas", okEnvelope(doc, []models.HXArea{})),
+			"304": {Description: "Not modified, see ETag"},
+			"500": errorResponse(doc, "Internal error"),
+		},
+	}, ScopeReadStatus)
+
+	doc.Path(apiBase + "areas/{name}").Get = withCommonResponses(doc, &openapi.Operation{
+		OperationID: "getAreaByName",
+		Summary:     "Get an area by name",
+		Tags:        []string{"areas"},
+		Parameters:  []openapi.Parameter{areaName},
+		Responses: map[string]*openapi.Response{
+			"200": jsonResponse("The area", okEnvelope(doc, models.HXArea{})),
+			"304": {Description: "Not modified, see ETag"},
+			"500": errorResponse(doc, "Internal error, also returned for unknown areas"),
+		},
+	}, ScopeReadStatus)
+
+	doc.Path(apiBase + "transcripts/{name}/latest").Get = withCommonResponses(doc, &openapi.Operation{
+		OperationID: "getTranscriptsLatest",
+		Summary:     "Get the latest transcript of an area",
+		Tags:        []string{"transcripts"},
+		Parameters:  []openapi.Parameter{areaName},
+		Responses: map[string]*openapi.Response{
+			"200": jsonResponse("The latest transcript", okEnvelope(doc, transcriptAggregation{})),
+			"404": errorResponse(doc, "No transcripts"),
+			"500": errorResponse(doc, "Internal error"),
+		},
+	}, ScopeReadTranscripts)
+
+	doc.Path(apiBase + "transcripts/{name}").Get = withCommonResponses(doc, &openapi.Operation{
+		OperationID: "getTranscripts",
+		Summary:     "Get all transcripts of an area",
+		Tags:        []string{"transcripts"},
+		Parameters:  []openapi.Parameter{areaName},
+		Responses: map[string]*openapi.Response{
+			"200": jsonResponse("A single transcript object if there is only one, otherwise a list", &openapi.Schema{
+				OneOf: []*openapi.Schema{
+					okEnvelope(doc, transcriptAggregation{}),
+					okEnvelope(doc, multipleTranscripts{}),
+				},
+			}),
+			"404": errorResponse(doc, "No transcripts"),
+			"500": errorResponse(doc, "Internal error"),
+		},
+	}, ScopeReadTranscripts)
+
+	doc.Path(apiBase + "openapi.json").Get = &openapi.Operation{
+		OperationID: "getOpenApiDocument",
+		Summary:     "This document",
+		Tags:        []string{"meta"},
+		Responses: map[string]*openapi.Response{
+			"200": jsonResponse("OpenAPI document", &openapi.Schema{Type: "object"}),
+		},
+	}
+
+	// v2, errors are RFC 7807 problems
+	v2Op := func(id string, summary string, tag string, params []openapi.Parameter, ok *openapi.Response, scope string, extra map[string]string) *openapi.Operation {
+		op := &openapi.Operation{
+			OperationID: id,
+			Summary:     summary,
+			Tags:        []string{tag},
+			Parameters:  params,
+			Responses: map[string]*openapi.Response{
+				"200": ok,
+				"304": {Description: "Not modified, see ETag"},
+				"401": problemResponse(doc, "Missing or invalid credentials"),
+				"403": problemResponse(doc, fmt.Sprintf("Credentials lack scope '%s'", scope)),
+				"429": problemResponse(doc, "Rate limit exceeded, see Retry-After"),
+				"500": problemResponse(doc, "Internal error"),
+				"503": problemResponse(doc, "The database is unreachable, see Retry-After"),
+			},
+			Security: []map[string][]string{{"bearer": {scope}}, {"apiKey": {scope}}, {}},
+		}
+		for status, description := range extra {
+			op.Responses[status] = problemResponse(doc, description)
+		}
+
+		return op
+	}
+
+	unknownArea := map[string]string{"404": "Unknown area"}
+	doc.Path(apiV2Base + "areas").Get = v2Op("getAreasV2", "Get all areas", "areas", nil,
+		jsonResponse("All areas", dataEnvelope(doc, []AreaV2{})), ScopeReadStatus, nil)
+	doc.Path(apiV2Base + "areas/{name}").Get = v2Op("getAreaByNameV2", "Get an area by name", "areas", []openapi.Parameter{areaName},
+		jsonResponse("The area", dataEnvelope(doc, AreaV2{})), ScopeReadStatus, unknownArea)
+	doc.Path(apiV2Base + "areas/{name}/transcripts").Get = v2Op("getAreaTranscriptsV2", "Get the transcripts of an area, newest first", "transcripts",
+		[]openapi.Parameter{areaName, {Name: "limit", In: "query", Schema: &openapi.Schema{Type: "integer"}}},
+		jsonResponse("Transcripts", dataEnvelope(doc, []TranscriptV2{})), ScopeReadTranscripts,
+		map[string]string{"400": "Invalid limit", "404": "Unknown area"})
+	doc.Path(apiV2Base + "areas/{name}/transcripts/latest").Get = v2Op("getAreaTranscriptLatestV2", "Get the latest transcript of an area", "transcripts",
+		[]openapi.Parameter{areaName}, jsonResponse("The latest transcript", dataEnvelope(doc, TranscriptV2{})), ScopeReadTranscripts,
+		map[string]string{"404": "Unknown area or no transcripts"})
+	doc.Path(apiV2Base + "openapi.json").Get = &openapi.Operation{
+		OperationID: "getOpenApiDocumentV2",
+		Summary:     "This document",
+		Tags:        []string{"meta"},
+		Responses: map[string]*openapi.Response{
+			"200": jsonResponse("OpenAPI document", &openapi.Schema{Type: "object"}),
+		},
+	}
+
+	// Admin
+	adminOp := func(id string, summary string, params []openapi.Parameter, body interface{}, ok *openapi.Response, extra map[string]string) *openapi.Operation {
+		op := &openapi.Operation{
+			OperationID: id,
+			Summary:     summary,
+			Tags:        []string{"admin"},
+			Parameters:  params,
+			Responses: map[string]*openapi.Response{
+				"500": errorResponse(doc, "Internal error"),
+			},
+		}
+		if body != nil {
+			op.RequestBody = jsonRequestBody(doc, body)
+			op.Responses["400"] = errorResponse(doc, "Invalid request")
+		}
+		if len(params) > 0 {
+			op.Responses["404"] = errorResponse(doc, "Not found")
+		}
+		for status, description := range extra {
+			op.Responses[status] = errorResponse(doc, description)
+		}
+		if strings.HasPrefix(id, "adminCreate") {
+			op.Responses["201"] = ok
+		} else {
+			op.Responses["200"] = ok
+		}
+
+		return withCommonResponses(doc, op, ScopeAdmin)
+	}
+
+	conflict := map[string]string{"409": "Conflict"}
+	numberOk := jsonResponse("The number", okEnvelope(doc, models.Number{}))
+	areaOk := jsonResponse("The area", okEnvelope(doc, models.HXArea{}))
+
+	doc.Path(adminBase + "numbers").Get = adminOp("adminGetNumbers", "Get all numbers", nil, nil,
+		jsonResponse("All numbers", okEnvelope(doc, []models.Number{})), nil)
+	doc.Path(adminBase + "numbers").Post = adminOp("adminCreateNumber", "Create a number", nil, numberRequest{}, numberOk, conflict)
+	doc.Path(adminBase + "numbers/{name}").Get = adminOp("adminGetNumber", "Get a number", []openapi.Parameter{numberName}, nil, numberOk, nil)
+	doc.Path(adminBase + "numbers/{name}").Patch = adminOp("adminUpdateNumber", "Update a number", []openapi.Parameter{numberName}, numberRequest{}, numberOk, nil)
+	doc.Path(adminBase + "numbers/{name}").Delete = adminOp("adminDeleteNumber", "Delete a number", []openapi.Parameter{numberName}, nil, numberOk, conflict)
+
+	doc.Path(adminBase + "areas").Get = adminOp("adminGetAreas", "Get all areas", nil, nil,
+		jsonResponse("All areas", okEnvelope(doc, []models.HXArea{})), nil)
+	doc.Path(adminBase + "areas").Post = adminOp("adminCreateArea", "Create an area", nil, areaRequest{}, areaOk, conflict)
+	doc.Path(adminBase + "areas/{name}").Get = adminOp("adminGetArea", "Get an area", []openapi.Parameter{areaName}, nil, areaOk, nil)
+	doc.Path(adminBase + "areas/{name}").Patch = adminOp("adminUpdateArea", "Update an area", []openapi.Parameter{areaName}, areaRequest{}, areaOk, nil)
+	doc.Path(adminBase + "areas/{name}").Delete = adminOp("adminDeleteArea", "Delete an area", []openapi.Parameter{areaName}, nil, areaOk, nil)
+	doc.Path(adminBase + "areas/{name}/recheck").Post = adminOp("adminRecheckArea", "Check an area immediately", []openapi.Parameter{areaName}, nil, areaOk, nil)
+	doc.Path(adminBase + "areas/{name}/reset-errors").Post = adminOp("adminResetAreaErrors", "Reset the errors of an area", []openapi.Parameter{areaName}, nil, areaOk, nil)
+	doc.Path(adminBase + "areas/{name}/pause").Post = adminOp("adminPauseArea", "Pause monitoring of an area", []openapi.Parameter{areaName}, nil, areaOk, nil)
+	doc.Path(adminBase + "areas/{name}/resume").Post = adminOp("adminResumeArea", "Resume monitoring of an area", []openapi.Parameter{areaName}, nil, areaOk, nil)
+
+	createSubArea := adminOp("adminCreateSubArea", "Add a sub area", []openapi.Parameter{areaName}, subAreaRequest{}, areaOk, conflict)
+	// Responds with the updated area, not a new resource
+	createSubArea.Responses["200"] = createSubArea.Responses["201"]
+	delete(createSubArea.Responses, "201")
+	doc.Path(adminBase + "areas/{name}/sub-areas").Post = createSubArea
+	doc.Path(adminBase + "areas/{name}/sub-areas/{subName}").Patch = adminOp("adminUpdateSubArea", "Update a sub area", []openapi.Parameter{areaName, subAreaName}, subAreaRequest{}, areaOk, conflict)
+	doc.Path(adminBase + "areas/{name}/sub-areas/{subName}").Delete = adminOp("adminDeleteSubArea", "Delete a sub area", []openapi.Parameter{areaName, subAreaName}, nil, areaOk, nil)
+
+	doc.Path(adminBase + "api-keys").Get = adminOp("adminGetApiKeys", "Get all API keys", nil, nil,
+		jsonResponse("All API keys", okEnvelope(doc, []models.APIKey{})), nil)
+	doc.Path(adminBase + "api-keys").Post = adminOp("adminCreateApiKey", "Create an API key", nil, apiKeyRequest{},
+		jsonResponse("The API key, including the plain key", okEnvelope(doc, apiKeyCreated{})), nil)
+	doc.Path(adminBase + "api-keys/{id}").Delete = adminOp("adminRevokeApiKey", "Revoke an API key",
+		[]openapi.Parameter{pathParameter("id", "ID of the API key")}, nil,
+		jsonResponse("The revoked API key", okEnvelope(doc, models.APIKey{})), nil)
+
+	doc.Path(adminBase + "audit").Get = adminOp("getAuditLog", "Get the audit log", nil, nil,
+		jsonResponse("Audit log entries, newest first", okEnvelope(doc, []models.AuditLogEntry{})), nil)
+	doc.Path(adminBase + "audit").Get.Parameters = []openapi.Parameter{
+		{Name: "target", In: "query", Schema: &openapi.Schema{Type: "string"}},
+		{Name: "actor", In: "query", Schema: &openapi.Schema{Type: "string"}},
+		{Name: "limit", In: "query", Schema: &openapi.Schema{Type: "integer"}},
+	}
+	doc.Path(adminBase + "audit").Get.Responses["400"] = errorResponse(doc, "Invalid query")
+
+	levelsOk := jsonResponse("The default level and the levels of components", doc.SchemaFor(logger.LevelsResponse{}))
+	doc.Path(adminBase + "loglevel").Get = adminOp("adminGetLogLevels", "Get the log levels", nil, nil, levelsOk, nil)
+	doc.Path(adminBase + "loglevel").Put = adminOp("adminSetLogLevel", "Set a log level until the next restart or configuration reload", nil, nil, levelsOk, nil)
+	doc.Path(adminBase + "loglevel").Put.Parameters = []openapi.Parameter{
+		{Name: "component", In: "query", Schema: &openapi.Schema{Type: "string"}},
+		{Name: "level", In: "query", Schema: &openapi.Schema{Type: "string", Enum: []interface{}{"debug", "info", "warn", "error"}}},
+	}
+	doc.Path(adminBase + "loglevel").Put.Responses["400"] = &openapi.Response{Description: "Invalid level, or neither component nor level given"}
+
+	return doc
+}
+
+// Serves the OpenAPI document (/openapi.json)
+func getOpenApiDocument(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	openApiDocumentOnce.Do(func() {
+		openApiDocument = buildOpenApiDocument()
+		openApiDocumentJson, _ = json.MarshalIndent(openApiDocument, "", "  ")
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openApiDocumentJson)
+}
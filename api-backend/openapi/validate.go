@@ -0,0 +1,132 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Validates a decoded JSON value against a schema of the document.
+// Only the subset of OpenAPI generated by this package is supported.
+func (d *Document) Validate(s *Schema, value interface{}) error {
+	return d.validate(s, value, "$")
+}
+
+// Validates a raw JSON body against a schema of the document
+func (d *Document) ValidateJSON(s *Schema, body []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	return d.Validate(s, value)
+}
+
+func (d *Document) validate(s *Schema, value interface{}, path string) error {
+	s = d.Resolve(s)
+	if s == nil {
+		return fmt.Errorf("%s: unresolvable schema", path)
+	}
+
+	if value == nil {
+		if s.Nullable || s.Type == "" && len(s.OneOf) == 0 {
+			return nil
+		}
+		return fmt.Errorf("%s: must not be null", path)
+	}
+
+	if len(s.OneOf) > 0 {
+		matches := 0
+		for _, candidate := range s.OneOf {
+			if d.validate(candidate, value, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s: must match exactly one schema of oneOf, matched %d", path, matches)
+		}
+		return nil
+	}
+
+	if len(s.Enum) > 0 && !slices.Contains(s.Enum, value) {
+		return fmt.Errorf("%s: %v is not one of %v", path, value, s.Enum)
+	}
+
+	switch s.Type {
+	case "":
+		return nil
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: must be a boolean", path)
+		}
+	case "integer", "number":
+		n, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("%s: must be a number", path)
+		}
+		if s.Type == "integer" && n != math.Trunc(n) {
+			return fmt.Errorf("%s: must be an integer", path)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: must be a string", path)
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				return fmt.Errorf("%s: must be an RFC3339 date-time: %v", path, err)
+			}
+		}
+		if s.Pattern != "" && !regexp.MustCompile(s.Pattern).MatchString(str) {
+			return fmt.Errorf("%s: '%s' does not match pattern %s", path, str, s.Pattern)
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: must be an array", path)
+		}
+		for i, item := range items {
+			if err := d.validate(s.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: must be an object", path)
+		}
+		for _, required := range s.Required {
+			if _, exists := obj[required]; !exists {
+				return fmt.Errorf("%s: missing required property '%s'", path, required)
+			}
+		}
+
+		// Sorted for deterministic error messages
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			propertySchema, exists := s.Properties[k]
+			if !exists {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s: undocumented property '%s'", path, k)
+				}
+				continue
+			}
+			if err := d.validate(propertySchema, obj[k], path+"."+k); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%s: unsupported schema type '%s'", path, s.Type)
+	}
+
+	return nil
+}
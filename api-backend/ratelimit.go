@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token bucket of a single client
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// Per-IP token bucket rate limiter
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+
+	// Tokens added per second and maximum amount of tokens
+	rate  float64
+	burst float64
+}
+
+var (
+	rateLimiter *RateLimiter
+
+	// Reverse proxies whose X-Forwarded-For is trusted
+	trustedProxies []netip.Prefix
+
+	rateLimiterIdleTimeout time.Duration = 10 * time.Minute
+)
+
+// Set up rate limiting from env vars
+func setUpRateLimiter() {
+	rate, err := strconv.ParseFloat(getEnv("RATE_LIMIT_RPS", "5"), 64)
+	if err != nil {
+		slog.Error("RATELIMIT", "message", "Was unable to parse env var 'RATE_LIMIT_RPS'", "error", err)
+		rate = 5
+	}
+
+	burst, err := strconv.Atoi(getEnv("RATE_LIMIT_BURST", "20"))
+	if err != nil {
+		slog.Error("RATELIMIT", "message", "Was unable to parse env var 'RATE_LIMIT_BURST'", "error", err)
+		burst = 20
+	}
+
+	trustedProxies = nil
+	for _, proxy := range strings.Split(getEnv("TRUSTED_PROXIES", ""), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy == "" {
+			continue
+		}
+
+		prefix, err := parsePrefix(proxy)
+		if err != nil {
+			slog.Error("RATELIMIT", "message", "Was unable to parse entry of env var 'TRUSTED_PROXIES'", "entry", proxy, "error", err)
+			continue
+		}
+		trustedProxies = append(trustedProxies, prefix)
+	}
+
+	rateLimiter = NewRateLimiter(rate, burst)
+
+	slog.Info("RATELIMIT", "rps", rate, "burst", burst, "trustedProxies", trustedProxies)
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		rate:    rate,
+		burst:   float64(burst),
+	}
+}
+
+// Takes a token for the given key. If none is available, returns how long to wait for the next one.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	bucket, exists := l.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: l.burst, lastSeen: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*l.rate)
+	bucket.lastSeen = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// Removes buckets of clients that have not been seen for a while, as these are full again anyway
+func (l *RateLimiter) Cleanup() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, bucket := range l.buckets {
+		if time.Since(bucket.lastSeen) > rateLimiterIdleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Periodically cleans up idle buckets until ctx is done
+func (l *RateLimiter) RunCleanup(ctx context.Context) {
+	ticker := time.NewTicker(rateLimiterIdleTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.Cleanup()
+		}
+	}
+}
+
+// Parses an IP address or a CIDR range
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap()
+	return slices.ContainsFunc(trustedProxies, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+// Returns the IP address a request should be rate limited by.
+// X-Forwarded-For is only used if the request comes from a trusted proxy. As clients can send the header themselves,
+// the address is the rightmost hop that is not a trusted proxy, i.e. the one the outermost proxy saw.
+func clientIP(r *http.Request) string {
+	peer := remoteIP(r)
+	if !isTrustedProxy(peer) {
+		return peer
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if _, err := netip.ParseAddr(hop); err != nil {
+			// Garbage can only come from the client, the hops after it are trusted
+			break
+		}
+		if !isTrustedProxy(hop) {
+			return hop
+		}
+		peer = hop
+	}
+
+	return peer
+}
+
+// Rejects requests of clients that have exhausted their tokens with 429
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		allowed, wait := rateLimiter.Allow(ip)
+		if !allowed {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			slog.Warn("RATELIMIT", "message", "Rate limit exceeded", "remoteIp", ip, "path", r.URL.Path, "retryAfter", retryAfter)
+
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			writeError(w, r, http.StatusTooManyRequests, problemTooManyRequests, "Too many requests", fmt.Sprintf("Retry in %d second(s)", retryAfter))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/thisisnttheway/hx-monitor/logger"
 )
 
 type ResponseOk struct {
@@ -21,16 +22,83 @@ type transcriptAggregation struct {
 	Date       time.Time `bson:"date" json:"date"`
 }
 
+type multipleTranscripts struct {
+	Amount      int                     `json:"amount"`
+	Transcripts []transcriptAggregation `json:"transcripts"`
+}
+
 const apiBase string = "/api/v1/"
+const adminBase string = "/api/admin/v1/"
+
+// Registers all routes
+func newRouter() *mux.Router {
+	muxRouter := mux.NewRouter()
+	muxRouter.Use(jsonContentTypeMiddleware)
 
-var muxRouter *mux.Router = mux.NewRouter()
+	muxRouter.HandleFunc(apiBase+"openapi.json", getOpenApiDocument).Methods("GET")
 
-func init() {
 	// HX areas
-	muxRouter.HandleFunc(apiBase+"areas/{name}", getAreaByName).Methods("GET")
-	muxRouter.HandleFunc(apiBase+"areas", getAreas).Methods("GET")
+	areasRouter := muxRouter.PathPrefix(apiBase + "areas").Subrouter()
+	areasRouter.Use(requireScope(ScopeReadStatus))
+
+	areasRouter.HandleFunc("/{name}", getAreaByName).Methods("GET")
+	areasRouter.HandleFunc("", getAreas).Methods("GET")
 
 	// Transcripts
-	muxRouter.HandleFunc(apiBase+"transcripts/{name:[^/]+}/latest", getTranscriptsLatest).Methods("GET")
-	muxRouter.HandleFunc(apiBase+"transcripts/{name:[^/]+}", getTranscripts).Methods("GET")
+	transcriptsRouter := muxRouter.PathPrefix(apiBase + "transcripts").Subrouter()
+	transcriptsRouter.Use(requireScope(ScopeReadTranscripts))
+
+	transcriptsRouter.HandleFunc("/{name:[^/]+}/latest", getTranscriptsLatest).Methods("GET")
+	transcriptsRouter.HandleFunc("/{name:[^/]+}", getTranscripts).Methods("GET")
+
+	// v2
+	v2Router := muxRouter.PathPrefix(apiV2Base).Subrouter()
+	v2Router.HandleFunc("/openapi.json", getOpenApiDocument).Methods("GET")
+
+	// Must be registered before the areas router, as its prefix would match too
+	v2TranscriptsRouter := v2Router.PathPrefix("/areas/{name}/transcripts").Subrouter()
+	v2TranscriptsRouter.Use(requireScope(ScopeReadTranscripts))
+	v2TranscriptsRouter.HandleFunc("", getAreaTranscriptsV2).Methods("GET")
+	v2TranscriptsRouter.HandleFunc("/latest", getAreaTranscriptLatestV2).Methods("GET")
+
+	v2AreasRouter := v2Router.PathPrefix("/areas").Subrouter()
+	v2AreasRouter.Use(requireScope(ScopeReadStatus))
+	v2AreasRouter.HandleFunc("", getAreasV2).Methods("GET")
+	v2AreasRouter.HandleFunc("/{name}", getAreaByNameV2).Methods("GET")
+
+	v2Router.PathPrefix("/").HandlerFunc(notFoundV2)
+
+	// Admin
+	adminRouter := muxRouter.PathPrefix(adminBase).Subrouter()
+	adminRouter.Use(requireScope(ScopeAdmin))
+
+	adminRouter.HandleFunc("/numbers", adminGetNumbers).Methods("GET")
+	adminRouter.HandleFunc("/numbers", adminCreateNumber).Methods("POST")
+	adminRouter.HandleFunc("/numbers/{name}", adminGetNumber).Methods("GET")
+	adminRouter.HandleFunc("/numbers/{name}", adminUpdateNumber).Methods("PATCH")
+	adminRouter.HandleFunc("/numbers/{name}", adminDeleteNumber).Methods("DELETE")
+
+	adminRouter.HandleFunc("/areas", adminGetAreas).Methods("GET")
+	adminRouter.HandleFunc("/areas", adminCreateArea).Methods("POST")
+	adminRouter.HandleFunc("/areas/{name}", adminGetArea).Methods("GET")
+	adminRouter.HandleFunc("/areas/{name}", adminUpdateArea).Methods("PATCH")
+	adminRouter.HandleFunc("/areas/{name}", adminDeleteArea).Methods("DELETE")
+	adminRouter.HandleFunc("/areas/{name}/recheck", adminRecheckArea).Methods("POST")
+	adminRouter.HandleFunc("/areas/{name}/reset-errors", adminResetAreaErrors).Methods("POST")
+	adminRouter.HandleFunc("/areas/{name}/pause", adminPauseArea).Methods("POST")
+	adminRouter.HandleFunc("/areas/{name}/resume", adminResumeArea).Methods("POST")
+
+	adminRouter.HandleFunc("/areas/{name}/sub-areas", adminCreateSubArea).Methods("POST")
+	adminRouter.HandleFunc("/areas/{name}/sub-areas/{subName}", adminUpdateSubArea).Methods("PATCH")
+	adminRouter.HandleFunc("/areas/{name}/sub-areas/{subName}", adminDeleteSubArea).Methods("DELETE")
+
+	adminRouter.HandleFunc("/api-keys", adminGetApiKeys).Methods("GET")
+	adminRouter.HandleFunc("/api-keys", adminCreateApiKey).Methods("POST")
+	adminRouter.HandleFunc("/api-keys/{id}", adminRevokeApiKey).Methods("DELETE")
+
+	adminRouter.HandleFunc("/audit", getAuditLog).Methods("GET")
+
+	adminRouter.HandleFunc("/loglevel", logger.LevelHandler).Methods("GET", "PUT")
+
+	return muxRouter
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/thisisnttheway/hx-monitor/db"
+	"github.com/thisisnttheway/hx-monitor/models"
+)
+
+const apiV2Base string = "/api/v2/"
+
+// Base URI of problem types, see RFC 7807
+const problemTypeBase string = "https://github.com/ThisIsntTheWay/hx-monitor/blob/main/api-backend/README.md#"
+
+// RFC 7807 problem details
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// Envelope of every successful v2 response
+type DataResponse[T any] struct {
+	Data T            `json:"data"`
+	Meta ResponseMeta `json:"meta"`
+}
+
+type ResponseMeta struct {
+	Count int `json:"count"`
+}
+
+// v2 representation of an area. Decoupled from models.HXArea so that the API stays stable when the DB schema changes.
+type AreaV2 struct {
+	Name                 string      `json:"name"`
+	SubAreas             []SubAreaV2 `json:"sub_areas"`
+	NextAction           time.Time   `json:"next_action"`
+	LastAction           time.Time   `json:"last_action"`
+	LastActionSuccess    bool        `json:"last_action_success"`
+	LastError            string      `json:"last_error"`
+	NumErrors            int         `json:"num_errors"`
+	LastFailure          time.Time   `json:"last_failure"`
+	RetryState           string      `json:"retry_state"`
+	FlightOperatingHours []time.Time `json:"flight_operating_hours"`
+	Paused               bool        `json:"paused"`
+}
+
+type SubAreaV2 struct {
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+	Active   bool   `json:"active"`
+}
+
+type TranscriptV2 struct {
+	Transcript string    `json:"transcript"`
+	Date       time.Time `json:"date"`
+	CallSID    string    `json:"call_sid"`
+}
+
+const (
+	problemNotFound           string = "not-found"
+	problemBadRequest         string = "bad-request"
+	problemUnauthorized       string = "unauthorized"
+	problemForbidden          string = "forbidden"
+	problemTooManyRequests    string = "too-many-requests"
+	problemServiceUnavailable string = "service-unavailable"
+	problemInternal           string = "internal-error"
+)
+
+// Writes an error in the format of the API version the request was made against
+func writeError(w http.ResponseWriter, r *http.Request, status int, problemType string, title string, detail string) {
+	if !strings.HasPrefix(r.URL.Path, apiV2Base) {
+		writeResponse(w, status, ResponseError{Error: title, Data: detail})
+		return
+	}
+
+	res, _ := json.Marshal(Problem{
+		Type:     problemTypeBase + problemType,
+		Title:    title,
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	})
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	w.Write(res)
+}
+
+// Writes 503 if the DB is unreachable, 500 otherwise
+func writeDbError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, db.ErrUnavailable) || errors.Is(err, db.ErrNotConnected) {
+		w.Header().Set("Retry-After", "30")
+		writeError(w, r, http.StatusServiceUnavailable, problemServiceUnavailable, "Service unavailable", "The database is unreachable")
+		return
+	}
+
+	writeError(w, r, http.StatusInternalServerError, problemInternal, "Internal error", err.Error())
+}
+
+// Writes a successful v2 response, or 304 if the client already has it
+func writeData[T any](w http.ResponseWriter, r *http.Request, data T, count int) {
+	res, _ := json.Marshal(DataResponse[T]{
+		Data: data,
+		Meta: ResponseMeta{Count: count},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if checkETag(w, r, res) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Write(res)
+}
+
+func toAreaV2(area models.HXArea) AreaV2 {
+	result := AreaV2{
+		Name:                 area.Name,
+		SubAreas:             make([]SubAreaV2, 0, len(area.SubAreas)),
+		NextAction:           area.NextAction,
+		LastAction:           area.LastAction,
+		LastActionSuccess:    area.LastActionSuccess,
+		LastError:            area.LastError,
+		NumErrors:            int(area.NumErrors),
+		LastFailure:          area.LastFailure,
+		RetryState:           area.RetryState,
+		FlightOperatingHours: make([]time.Time, 0, len(area.FlightOperatingHours)),
+		Paused:               area.Paused,
+	}
+
+	for _, subArea := range area.SubAreas {
+		result.SubAreas = append(result.SubAreas, SubAreaV2{
+			Name:     subArea.Name,
+			FullName: subArea.FullName,
+			Active:   subArea.Active,
+		})
+	}
+	result.FlightOperatingHours = append(result.FlightOperatingHours, area.FlightOperatingHours...)
+
+	return result
+}
+
+// Looks up an area by the {name} route variable, writing a problem if that fails
+func lookupAreaV2(w http.ResponseWriter, r *http.Request) (models.HXArea, bool) {
+	name := mux.Vars(r)["name"]
+	area, exists, err := areaCache.GetByName(r.Context(), name)
+	if err != nil {
+		writeDbError(w, r, err)
+		return area, false
+	}
+	if !exists {
+		writeError(w, r, http.StatusNotFound, problemNotFound, "Not found", fmt.Sprintf("Area '%s' does not exist", name))
+		return area, false
+	}
+
+	return area, true
+}
+
+// Get all areas (/areas)
+func getAreasV2(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	areas, err := areaCache.GetAll(r.Context())
+	if err != nil {
+		writeDbError(w, r, err)
+		return
+	}
+
+	result := make([]AreaV2, 0, len(areas))
+	for _, area := range areas {
+		result = append(result, toAreaV2(area))
+	}
+
+	setAreaCacheControl(w, r, areas)
+	writeData(w, r, result, len(result))
+}
+
+// Get an area by name (/areas/{name})
+func getAreaByNameV2(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	area, ok := lookupAreaV2(w, r)
+	if !ok {
+		return
+	}
+
+	setAreaCacheControl(w, r, []models.HXArea{area})
+	writeData(w, r, toAreaV2(area), 1)
+}
+
+// Get transcripts of an area, newest first (/areas/{name}/transcripts)
+func getAreaTranscriptsV2(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	limit, err := parseLimit(r, 20)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, problemBadRequest, "Bad request", err.Error())
+		return
+	}
+
+	area, ok := lookupAreaV2(w, r)
+	if !ok {
+		return
+	}
+
+	transcripts, err := db.Transcripts.ListForArea(r.Context(), area.ID, limit)
+	if err != nil {
+		writeDbError(w, r, err)
+		return
+	}
+
+	result := make([]TranscriptV2, 0, len(transcripts))
+	for _, t := range transcripts {
+		result = append(result, TranscriptV2{Transcript: t.Transcript, Date: t.Date, CallSID: t.CallSID})
+	}
+
+	writeData(w, r, result, len(result))
+}
+
+// Get the latest transcript of an area (/areas/{name}/transcripts/latest)
+func getAreaTranscriptLatestV2(w http.ResponseWriter, r *http.Request) {
+	logResponse(r)
+
+	area, ok := lookupAreaV2(w, r)
+	if !ok {
+		return
+	}
+
+	transcripts, err := db.Transcripts.ListForArea(r.Context(), area.ID, 1)
+	if err != nil {
+		writeDbError(w, r, err)
+		return
+	}
+	if len(transcripts) == 0 {
+		writeError(w, r, http.StatusNotFound, problemNotFound, "Not found", fmt.Sprintf("Area '%s' has no transcripts", area.Name))
+		return
+	}
+
+	t := transcripts[0]
+	writeData(w, r, TranscriptV2{Transcript: t.Transcript, Date: t.Date, CallSID: t.CallSID}, 1)
+}
+
+// Fallback for unknown v2 routes, so that these return a problem as well
+func notFoundV2(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, problemNotFound, "Not found", fmt.Sprintf("No route for %s %s", r.Method, r.URL.Path))
+}
@@ -0,0 +1,275 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	c "github.com/thisisnttheway/hx-monitor/configuration"
+	"github.com/thisisnttheway/hx-monitor/metrics"
+	"github.com/thisisnttheway/hx-monitor/models"
+)
+
+type Kind string
+
+const (
+	// No success within StaleFactor times the expected interval of the area
+	KindStale Kind = "stale"
+
+	// At least FailureThreshold consecutive failures
+	KindFailing Kind = "failing"
+
+	// The area is no longer called until its next_action moves
+	KindRetriesExhausted Kind = "retries-exhausted"
+
+	// The same transcript was parsed differently than before
+	KindParserDisagreement Kind = "parser-disagreement"
+)
+
+type Severity string
+
+const (
+	SeverityWarning  Severity = "warning"
+	SeverityCritical Severity = "critical"
+)
+
+type Alert struct {
+	Kind     Kind      `json:"kind"`
+	Area     string    `json:"area"`
+	Severity Severity  `json:"severity"`
+	Summary  string    `json:"summary"`
+	Since    time.Time `json:"since"`
+
+	// Sent once an alert is no longer active
+	Resolved bool `json:"resolved"`
+}
+
+func (a Alert) key() string {
+	return string(a.Kind) + "/" + a.Area
+}
+
+func (a Alert) String() string {
+	if a.Resolved {
+		return fmt.Sprintf("[resolved] %s: %s", a.Area, a.Kind)
+	}
+
+	return fmt.Sprintf("[%s] %s: %s", a.Severity, a.Area, a.Summary)
+}
+
+type activeAlert struct {
+	Alert
+	notifiedAt time.Time
+}
+
+// Evaluates the areas periodically and notifies the channels about alerts that become active or are resolved.
+// Active alerts are only repeated after the repeat interval, they are kept in memory and are sent again after a restart.
+type Manager struct {
+	config    c.AlertingConfiguration
+	listAreas func(ctx context.Context) ([]models.HXArea, error)
+	channels  []Channel
+	mu        sync.Mutex
+	active    map[string]*activeAlert
+	intervals map[string]time.Duration
+	lastSeen  map[string]time.Time
+	disagreed map[string]bool
+}
+
+func NewManager(config c.AlertingConfiguration, listAreas func(ctx context.Context) ([]models.HXArea, error), channels ...Channel) *Manager {
+	return &Manager{
+		config:    config,
+		listAreas: listAreas,
+		channels:  channels,
+		active:    make(map[string]*activeAlert),
+		intervals: make(map[string]time.Duration),
+		lastSeen:  make(map[string]time.Time),
+		disagreed: make(map[string]bool),
+	}
+}
+
+// Evaluates every evaluation interval until ctx is done
+func (m *Manager) Run(ctx context.Context) {
+	slog.Info("ALERT", "action", "run", "interval", m.config.EvaluationInterval, "channels", len(m.channels))
+	ticker := time.NewTicker(m.config.EvaluationInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.Evaluate(ctx); err != nil {
+			slog.Error("ALERT", "action", "evaluate", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Records whether the latest parse of an area contradicted the previous parse of the same transcript
+func (m *Manager) ParseOutcome(ctx context.Context, area string, disagreement bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.disagreed[area] = disagreement
+}
+
+// Returns the active alerts
+func (m *Manager) Active() []Alert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]Alert, 0, len(m.active))
+	for _, alert := range m.active {
+		result = append(result, alert.Alert)
+	}
+
+	return result
+}
+
+// Handler for /alerts, lists the active alerts
+func (m *Manager) Handler(w http.ResponseWriter, r *http.Request) {
+	alerts := m.Active()
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].key() < alerts[j].key()
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alerts)
+}
+
+func (m *Manager) Evaluate(ctx context.Context) error {
+	areas, err := m.listAreas(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	firing := make(map[string]Alert)
+	m.mu.Lock()
+	for _, area := range areas {
+		for _, alert := range m.check(area, now) {
+			firing[alert.key()] = alert
+		}
+	}
+
+	var notifications []Alert
+	for key, alert := range firing {
+		active, ok := m.active[key]
+		switch {
+		case !ok:
+			alert.Since = now
+			m.active[key] = &activeAlert{Alert: alert, notifiedAt: now}
+			notifications = append(notifications, alert)
+		case m.config.RepeatInterval > 0 && now.Sub(active.notifiedAt) >= m.config.RepeatInterval:
+			alert.Since = active.Since
+			active.Alert, active.notifiedAt = alert, now
+			notifications = append(notifications, alert)
+		}
+	}
+	for key, active := range m.active {
+		if _, ok := firing[key]; !ok {
+			delete(m.active, key)
+			resolved := active.Alert
+			resolved.Resolved = true
+			notifications = append(notifications, resolved)
+		}
+	}
+
+	activeByKind := make(map[Kind]int)
+	for _, active := range m.active {
+		activeByKind[active.Kind]++
+	}
+	m.mu.Unlock()
+
+	for _, kind := range []Kind{KindStale, KindFailing, KindRetriesExhausted, KindParserDisagreement} {
+		metrics.AlertsActive.WithLabelValues(string(kind)).Set(float64(activeByKind[kind]))
+	}
+
+	for _, alert := range notifications {
+		m.notify(ctx, alert)
+	}
+
+	return nil
+}
+
+// Returns the alerts of an area. Paused areas are never alerted.
+func (m *Manager) check(area models.HXArea, now time.Time) []Alert {
+	if area.Paused {
+		return nil
+	}
+
+	var result []Alert
+	if !area.LastSuccess.IsZero() {
+		interval := m.expectedInterval(area)
+		staleAfter := time.Duration(m.config.StaleFactor * float64(interval))
+		if since := now.Sub(area.LastSuccess); since > staleAfter {
+			result = append(result, Alert{
+				Kind:     KindStale,
+				Area:     area.Name,
+				Severity: SeverityCritical,
+				Summary:  fmt.Sprintf("No success for %s, expected every %s", since.Round(time.Minute), interval.Round(time.Minute)),
+			})
+		}
+	}
+
+	if int(area.NumErrors) >= m.config.FailureThreshold {
+		result = append(result, Alert{
+			Kind:     KindFailing,
+			Area:     area.Name,
+			Severity: SeverityWarning,
+			Summary:  fmt.Sprintf("%d consecutive failures, last error: %s", area.NumErrors, area.LastError),
+		})
+	}
+
+	if area.RetryState == models.RetryCoolOff {
+		result = append(result, Alert{
+			Kind:     KindRetriesExhausted,
+			Area:     area.Name,
+			Severity: SeverityCritical,
+			Summary:  fmt.Sprintf("Cooling off after %d failures, not called again before %s", area.NumErrors, area.NextAction.Format(time.RFC3339)),
+		})
+	}
+
+	if m.disagreed[area.Name] {
+		result = append(result, Alert{
+			Kind:     KindParserDisagreement,
+			Area:     area.Name,
+			Severity: SeverityWarning,
+			Summary:  "The latest transcript was parsed differently than the same transcript before",
+		})
+	}
+
+	return result
+}
+
+// Returns the interval the area announced on its latest success, i.e. from then until its next update.
+// It is captured before next_action is delayed by retries, ExpectedInterval is used until it is known.
+func (m *Manager) expectedInterval(area models.HXArea) time.Duration {
+	if !area.LastSuccess.Equal(m.lastSeen[area.Name]) {
+		m.lastSeen[area.Name] = area.LastSuccess
+		if announced := area.NextAction.Sub(area.LastSuccess); announced > 0 && area.LastActionSuccess {
+			m.intervals[area.Name] = announced
+		} else {
+			delete(m.intervals, area.Name)
+		}
+	}
+
+	if interval, ok := m.intervals[area.Name]; ok {
+		return interval
+	}
+
+	return m.config.ExpectedInterval
+}
+
+func (m *Manager) notify(ctx context.Context, alert Alert) {
+	for _, channel := range m.channels {
+		if err := channel.Notify(ctx, alert); err != nil {
+			slog.Error("ALERT", "action", "notify", "channel", channel.Name(), "alert", alert.key(), "error", err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const webhookTimeout time.Duration = 10 * time.Second
+
+// Delivers alerts to operators
+type Channel interface {
+	Name() string
+	Notify(ctx context.Context, alert Alert) error
+}
+
+// Logs alerts, so that they are visible without any channel configured
+type LogChannel struct{}
+
+func (LogChannel) Name() string {
+	return "log"
+}
+
+func (LogChannel) Notify(ctx context.Context, alert Alert) error {
+	if alert.Resolved {
+		slog.InfoContext(ctx, "ALERT", "kind", alert.Kind, "areaName", alert.Area, "resolved", true, "since", alert.Since)
+	} else {
+		slog.WarnContext(ctx, "ALERT", "kind", alert.Kind, "areaName", alert.Area, "severity", alert.Severity, "summary", alert.Summary, "since", alert.Since)
+	}
+
+	return nil
+}
+
+// Posts alerts as JSON. The text field is understood by Slack and Mattermost incoming webhooks.
+type WebhookChannel struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookChannel(url string) *WebhookChannel {
+	return &WebhookChannel{url: url, client: &http.Client{Timeout: webhookTimeout}}
+}
+
+func (w *WebhookChannel) Name() string {
+	return "webhook"
+}
+
+type webhookPayload struct {
+	Text  string `json:"text"`
+	Alert Alert  `json:"alert"`
+}
+
+func (w *WebhookChannel) Notify(ctx context.Context, alert Alert) error {
+	body, err := json.Marshal(webhookPayload{Text: "HX Monitor " + alert.String(), Alert: alert})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		// Errors of the client contain the URL, which usually contains a token
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,316 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/thisisnttheway/hx-monitor/alerting"
+	"github.com/thisisnttheway/hx-monitor/callback"
+	"github.com/thisisnttheway/hx-monitor/caller"
+	"github.com/thisisnttheway/hx-monitor/configuration"
+	"github.com/thisisnttheway/hx-monitor/db"
+	"github.com/thisisnttheway/hx-monitor/health"
+	"github.com/thisisnttheway/hx-monitor/logger"
+	"github.com/thisisnttheway/hx-monitor/metrics"
+	"github.com/thisisnttheway/hx-monitor/migrations"
+	"github.com/thisisnttheway/hx-monitor/models"
+	"github.com/thisisnttheway/hx-monitor/monitor"
+	"github.com/thisisnttheway/hx-monitor/tracing"
+	"github.com/thisisnttheway/hx-monitor/transcript"
+)
+
+const (
+	serviceName string = "hx-monitor"
+
+	pollInterval      time.Duration = 30 * time.Second
+	callbackUrlWait   time.Duration = 30 * time.Second
+	reconnectDeadline time.Duration = 30 * time.Second
+	shutdownDeadline  time.Duration = 10 * time.Second
+
+	// An iteration may place several calls, each taking a few seconds
+	schedulerStallAfter time.Duration = 10 * time.Minute
+)
+
+// The monitor and its dependencies. Nothing is connected or started before Start.
+type App struct {
+	ConfigPath string
+
+	Parser   *transcript.Parser
+	Caller   *caller.Caller
+	Callback *callback.Server
+	Monitor  *monitor.Monitor
+	Metrics  *metrics.Server
+	Levels   *http.Server
+	Health   *health.Checker
+	Alerts   *alerting.Manager
+
+	// Start of the latest iteration of Run, in Unix nanoseconds
+	lastTick atomic.Int64
+
+	// Flushes pending spans, set by Start
+	shutdownTracing func(ctx context.Context) error
+
+	// Processes the areas on the first iteration, regardless of their next action
+	ForceCall bool
+}
+
+// Wires up the components from a validated configuration, which must already be in use
+func New(cfg configuration.Config, configPath string) *App {
+	a := &App{ConfigPath: configPath}
+	a.Parser = transcript.NewParser(cfg.AI)
+	a.Callback = callback.NewServer(cfg.Callback, cfg.Twilio.UsePartialTranscriptionResults, a.Parser)
+	a.Caller = caller.New(cfg.Twilio, a.Callback.URL)
+	a.Monitor = monitor.New(trackingTelephony{caller: a.Caller, callback: a.Callback}, cfg.Monitor.Workers)
+	a.Callback.SetCallObserver(a.Monitor)
+	a.Metrics = metrics.NewServer(cfg.Metrics.ListenAddress)
+	a.Health = health.New()
+	a.Levels = logger.NewLevelServer(cfg.Logging.ControlListenAddress)
+	a.tick()
+
+	listAreas := func(ctx context.Context) ([]models.HXArea, error) {
+		return db.Areas.List(ctx)
+	}
+	a.Health.AddLiveness("scheduler", health.Heartbeat(a.LastTick, schedulerStallAfter))
+	a.Health.AddReadiness("database", health.Database)
+	a.Health.AddReadiness("callback", a.Callback.Ready)
+	a.Health.AddReadiness("llm", a.Parser.Ready)
+	a.Health.AddReadiness("areas", health.AreaFreshness(listAreas, cfg.Health.AreaStaleAfter))
+	a.Metrics.HandleFunc("/healthz", a.Health.Liveness)
+	a.Metrics.HandleFunc("/readyz", a.Health.Readiness)
+	metrics.RegisterAreas(listAreas)
+
+	channels := []alerting.Channel{alerting.LogChannel{}}
+	for _, webhookUrl := range configuration.SplitList(cfg.Alerting.WebhookUrls) {
+		channels = append(channels, alerting.NewWebhookChannel(webhookUrl))
+	}
+	a.Alerts = alerting.NewManager(cfg.Alerting, listAreas, channels...)
+	a.Callback.SetParseObserver(a.Alerts)
+	a.Metrics.HandleFunc("/alerts", a.Alerts.Handler)
+
+	return a
+}
+
+// Connects to the database, then starts the callback server and waits until calls can be placed
+func (a *App) Start(ctx context.Context) error {
+	shutdownTracing, err := tracing.Setup(ctx, configuration.Current().Tracing, serviceName)
+	if err != nil {
+		return err
+	}
+	a.shutdownTracing = shutdownTracing
+
+	if err := db.Connect(ctx); err != nil {
+		return err
+	}
+	warnAboutPendingMigrations(ctx)
+
+	go func() {
+		if err := a.Metrics.Serve(); err != nil {
+			slog.Error("APP", "action", "serveMetrics", "error", err)
+		}
+	}()
+
+	if a.Levels.Addr != "" {
+		go func() {
+			slog.Info("APP", "action", "serveLogLevels", "listenAddress", a.Levels.Addr)
+			if err := a.Levels.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("APP", "action", "serveLogLevels", "error", err)
+			}
+		}()
+	}
+
+	// Callbacks must still be received after ctx is done, until Shutdown
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- a.Callback.Serve(context.WithoutCancel(ctx))
+	}()
+
+	// Calls placed before the callback URL is known would lose their callbacks
+	waitCtx, cancel := context.WithTimeout(ctx, callbackUrlWait)
+	defer cancel()
+	if _, err := a.Callback.URL(waitCtx); err != nil {
+		return fmt.Errorf("callback server did not start: %w", err)
+	}
+
+	go func() {
+		if err := <-serveErr; err != nil {
+			slog.Error("APP", "action", "serveCallbacks", "error", err)
+		}
+	}()
+
+	go a.Alerts.Run(ctx)
+	go a.Callback.RunWatchdog(ctx)
+	go configuration.Watch(ctx, a.ConfigPath, configuration.Config.Validate, a.applyConfig)
+
+	numbers, err := caller.GetNumbers(ctx)
+	if err != nil {
+		return err
+	}
+	for _, v := range numbers {
+		slog.Info("APP",
+			"action", "indexNumbers",
+			"number", v.Number,
+			"name", v.Name,
+		)
+	}
+
+	return nil
+}
+
+// Processes the areas whenever one is due, until ctx is done. Calls placed by then may still be ongoing.
+func (a *App) Run(ctx context.Context) error {
+	for {
+		a.tick()
+		nextActionableTime := getNearestNextActionTime(ctx)
+		if a.ForceCall || time.Now().After(nextActionableTime) {
+			a.ForceCall = false
+			slog.Info("APP",
+				"action", "monitorHxAreas",
+			)
+
+			if err := a.Monitor.MonitorHxAreas(ctx); err != nil {
+				slog.Error("APP", "action", "monitorHxAreas", "error", err)
+			}
+		} else {
+			slog.Info("APP", "action", "awaitNextAction",
+				"eta", time.Until(nextActionableTime),
+				"nextActionTime", nextActionableTime,
+			)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// Returns when Run last started an iteration
+func (a *App) LastTick() time.Time {
+	return time.Unix(0, a.lastTick.Load())
+}
+
+func (a *App) tick() {
+	a.lastTick.Store(time.Now().UnixNano())
+}
+
+// Waits for ongoing checks, then for the callbacks of ongoing calls, bounded by callback.drain_timeout,
+// then stops the callback server and disconnects from the database
+func (a *App) Shutdown() error {
+	a.Monitor.Wait()
+
+	drainTimeout := configuration.GetCallbackConfig().DrainTimeout
+	slog.Info("APP", "action", "shutdown", "inFlightCalls", len(a.Callback.InFlight()), "drainTimeout", drainTimeout)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := a.Callback.Drain(drainCtx); err != nil {
+		slog.Warn("APP", "action", "drain", "message", "Shutting down with calls in flight, their results are lost")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownDeadline)
+	defer cancel()
+
+	errs := []error{a.Callback.Shutdown(ctx), a.Metrics.Shutdown(ctx), a.Levels.Shutdown(ctx), db.Disconnect(ctx)}
+	if a.shutdownTracing != nil {
+		errs = append(errs, a.shutdownTracing(ctx))
+	}
+	slog.Info("APP", "action", "shutdown", "success", true)
+	return errors.Join(errs...)
+}
+
+// Applies a reloaded configuration to the components that were set up with the previous one
+func (a *App) applyConfig(previous configuration.Config, next configuration.Config) {
+	if previous.Logging != next.Logging {
+		if err := logger.Configure(next.Logging); err != nil {
+			slog.Error("APP", "action", "applyConfig", "message", "Keeping previous log levels", "error", err)
+		}
+		if previous.Logging.Format != next.Logging.Format || previous.Logging.File != next.Logging.File || previous.Logging.ControlListenAddress != next.Logging.ControlListenAddress {
+			slog.Warn("APP", "action", "applyConfig", "message", "Log format, file and control address only take effect after a restart")
+		}
+	}
+
+	if previous.AI != next.AI {
+		a.Parser.Configure(next.AI)
+	}
+
+	if previous.Twilio != next.Twilio {
+		a.Caller.Configure(next.Twilio)
+		a.Callback.SetPartialTranscriptions(next.Twilio.UsePartialTranscriptionResults)
+	}
+
+	if previous.Mongo != next.Mongo {
+		ctx, cancel := context.WithTimeout(context.Background(), reconnectDeadline)
+		defer cancel()
+		if err := db.Reconnect(ctx); err != nil {
+			slog.Error("APP", "action", "applyConfig", "message", "Keeping previous database connection", "error", err)
+		}
+	}
+
+	if previous.Callback != next.Callback || previous.Alerting != next.Alerting || previous.Monitor != next.Monitor {
+		slog.Warn("APP", "action", "applyConfig", "message", "Callback, alerting and monitor settings only take effect after a restart")
+	}
+}
+
+// Lets the callback server know about placed calls, so that Shutdown can wait for them
+type trackingTelephony struct {
+	caller   *caller.Caller
+	callback *callback.Server
+}
+
+func (t trackingTelephony) Call(ctx context.Context, number models.Number) (caller.CallResponse, error) {
+	call, err := t.caller.Call(ctx, number)
+	if err == nil {
+		t.callback.Track(call.SID, call.Transcribing, call.TimeLimit)
+	}
+
+	return call, err
+}
+
+// Returns the nearest NextAction time of hx_areas. Default: time.Now()
+func getNearestNextActionTime(ctx context.Context) time.Time {
+	result := time.Now()
+
+	nextAction, err := db.Areas.NearestNextAction(ctx)
+	if err == nil {
+		result = nextAction
+	} else {
+		slog.Warn("APP",
+			"action", "getNearestNextActionTime",
+			"message", "Using default value instead of DB",
+			"returnValue", result,
+			"errorDb", err,
+		)
+	}
+
+	return result
+}
+
+// Logs a warning if the DB schema lags behind, as the monitor does not migrate on its own
+func warnAboutPendingMigrations(ctx context.Context) {
+	status, err := migrations.Status(ctx)
+	if err != nil {
+		slog.Warn("APP", "action", "checkMigrations", "error", err)
+		return
+	}
+
+	var pending []int
+	for _, m := range status {
+		if !m.Applied {
+			pending = append(pending, m.Version)
+		}
+	}
+
+	if len(pending) > 0 {
+		slog.Warn("APP",
+			"action", "checkMigrations",
+			"message", "Database has pending migrations, run 'migrate' to apply them",
+			"pending", pending,
+		)
+	}
+}
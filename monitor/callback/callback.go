@@ -3,32 +3,118 @@ package callback
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
-	"os"
 	"slices"
 	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/thisisnttheway/hx-monitor/caller"
 	c "github.com/thisisnttheway/hx-monitor/configuration"
 	"github.com/thisisnttheway/hx-monitor/db"
 	"github.com/thisisnttheway/hx-monitor/logger"
+	"github.com/thisisnttheway/hx-monitor/metrics"
 	"github.com/thisisnttheway/hx-monitor/models"
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	"github.com/thisisnttheway/hx-monitor/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.ngrok.com/ngrok"
-	"golang.ngrok.com/ngrok/config"
+	ngrokConfig "golang.ngrok.com/ngrok/config"
 )
 
-var (
-	_TranscriptionCallbacks []TranscriptionCallback
-	statusCallbacks         []StatusCallback
+var badCallStates = []string{"busy", "no-answer", "canceled", "failed"}
 
-	// To prevent mapCallSidToNumber() from failing, at the very least 'initiated' can't be ignored
-	ignoreCallStates = []string{"queued", "ringing", "in-progress"}
-	badCallStates    = []string{"busy", "no-answer", "canceled", "failed"}
-)
+// Turns final transcripts into airspace states
+type TranscriptParser interface {
+	ParseAirspaceTranscriptMeiringen(ctx context.Context, transcript string) (models.AirspaceMeiringenStatus, error)
+}
+
+// Told about the outcome of successful parses, e.g. to alert on disagreement
+type ParseObserver interface {
+	// disagreement is set if the transcript is the same as the previous one of the area, but was parsed differently
+	ParseOutcome(ctx context.Context, area string, disagreement bool)
+}
+
+// Told when a tracked call is done or the watchdog gave up on it, e.g. to release its number
+type CallObserver interface {
+	CallEnded(callSid string)
+}
+
+// Receives status and transcription callbacks of Twilio
+type Server struct {
+	config                c.CallbackConfiguration
+	parser                TranscriptParser
+	observer              ParseObserver
+	callObserver          CallObserver
+	partialTranscriptions atomic.Bool
+	httpServer            *http.Server
+
+	// Transcription events of ongoing calls
+	mu                     sync.Mutex
+	transcriptionCallbacks []TranscriptionCallback
+
+	// { "<callSid>": <state> }
+	callsMu sync.Mutex
+	calls   map[string]*callState
+
+	// Closed once url or err is set
+	ready chan struct{}
+	url   string
+	err   error
+}
+
+func NewServer(config c.CallbackConfiguration, partialTranscriptions bool, parser TranscriptParser) *Server {
+	s := &Server{
+		config: config,
+		parser: parser,
+		calls:  make(map[string]*callState),
+		ready:  make(chan struct{}),
+	}
+	s.partialTranscriptions.Store(partialTranscriptions)
+
+	return s
+}
+
+// Must be called before Serve
+func (s *Server) SetParseObserver(observer ParseObserver) {
+	s.observer = observer
+}
+
+// Must be called before Serve and Track
+func (s *Server) SetCallObserver(observer CallObserver) {
+	s.callObserver = observer
+}
+
+// Must match whether Twilio is asked for partial transcription results
+func (s *Server) SetPartialTranscriptions(value bool) {
+	s.partialTranscriptions.Store(value)
+}
+
+// Fails unless the server is listening and its public base URL is known
+func (s *Server) Ready(ctx context.Context) error {
+	select {
+	case <-s.ready:
+		return s.err
+	default:
+		return errors.New("callback URL is not known yet")
+	}
+}
+
+// Returns the public base URL of the server, waiting until it is known
+func (s *Server) URL(ctx context.Context) (string, error) {
+	select {
+	case <-s.ready:
+		return s.url, s.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
 
 type StatusCallback struct {
 	CallSID        string
@@ -38,7 +124,7 @@ type StatusCallback struct {
 	CallStatus     string
 	SequenceNumber int8
 	CallbackSource string
-	Duration       int8      // only when status = completed
+	Duration       int       // only when status = completed
 	Timestamp      time.Time // RFC1123
 }
 
@@ -69,25 +155,8 @@ type RecordingCallback struct {
 	RecordingUrl    string `json:"RecordingUrl"`
 }
 
-func init() {
-	v, exists := os.LookupEnv("TWILIO_PARTIAL_TRANSCRIPTIONS")
-	if exists {
-		var result bool
-		v, err := strconv.ParseBool(v)
-		if err != nil {
-			slog.Error("CALLBACK", "message", "Was unable to parse env var 'TWILIO_PARTIAL_TRANSCRIPTIONS'", "error", err)
-		} else {
-			result = v
-		}
-
-		c.SetPartialTranscriptionResultBool(result)
-	}
-
-	slog.Info("CALLBACK", "event", "init", "TWILIO_PARTIAL_TRANSCRIPTIONS", c.UsesPartialTranscriptionResults())
-}
-
 // Handler for /call
-func handleCallsCallback(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleCallsCallback(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
@@ -115,13 +184,6 @@ func handleCallsCallback(w http.ResponseWriter, r *http.Request) {
 		CallbackSource: r.FormValue("CallbackSource"),
 	}
 
-	// DB object
-	insertObj := models.Call{
-		ID:     primitive.NewObjectID(),
-		SID:    statusCallback.CallSID,
-		Status: statusCallback.CallStatus,
-	}
-
 	// Fallback timestamp
 	var timeToUse time.Time = time.Now()
 	t, err := time.Parse(time.RFC1123, r.FormValue("Timestamp"))
@@ -131,71 +193,84 @@ func handleCallsCallback(w http.ResponseWriter, r *http.Request) {
 		slog.Info("CALLBACK", "action", "parseFormTimestamp", "parsedTimestamp", t)
 		timeToUse = t
 	}
-
-	insertObj.Time = timeToUse
+	statusCallback.Timestamp = timeToUse
+
+	ctx, span := tracing.Tracer().Start(tracing.FromCallback(r), "callback.status",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			tracing.CallSid.String(statusCallback.CallSID),
+			tracing.CallStatus.String(statusCallback.CallStatus),
+		),
+	)
+	defer span.End()
+	ctx = logger.With(ctx, "callSid", statusCallback.CallSID)
 
 	if r.FormValue("SequenceNumber") != "" {
 		sn, err := strconv.ParseInt(r.FormValue("SequenceNumber"), 10, 8)
 		if err != nil {
-			slog.Error("CALLBACK", "action", "convertSequenceNumber", "source", r.FormValue("SequenceNumber"), "error", err)
+			slog.ErrorContext(ctx, "CALLBACK", "action", "convertSequenceNumber", "source", r.FormValue("SequenceNumber"), "error", err)
 		} else {
 			statusCallback.SequenceNumber = int8(sn)
 		}
 	}
 
 	if statusCallback.CallStatus == "completed" {
-		convertedDuration, err := strconv.ParseInt(r.FormValue("Duration"), 10, 8)
+		convertedDuration, err := strconv.Atoi(r.FormValue("Duration"))
 		if err != nil {
-			slog.Error("CALLBACK", "action", "convertCallDuration", "source", r.FormValue("Duration"), "error", err)
+			slog.ErrorContext(ctx, "CALLBACK", "action", "convertCallDuration", "source", r.FormValue("Duration"), "error", err)
 			convertedDuration = 0
 		}
-		statusCallback.Duration = int8(convertedDuration)
-	} else if slices.Contains(badCallStates, statusCallback.CallStatus) {
-		slog.Error("CALLBACK", "callSid", statusCallback.CallSID, "status", statusCallback.CallStatus, "action", "requeue")
+		statusCallback.Duration = convertedDuration
+	}
 
-		// Update area accordingly
-		const action = "setBadHxStatus"
-		n, err := mapCallSidToNumber(statusCallback.CallSID)
-		if err != nil {
-			slog.Error("CALLBACK", "action", action, "error", err)
-		}
+	slog.InfoContext(ctx, "CALLBACK", "event", "receivedEvent", "statusCallback", statusCallback)
 
-		h, err := mapNumberNameToHxArea(n.Name)
-		if err != nil {
-			slog.Error("CALLBACK", "action", action, "error", err)
-		}
+	event := models.CallEvent{
+		Status:         statusCallback.CallStatus,
+		Time:           statusCallback.Timestamp,
+		SequenceNumber: int(statusCallback.SequenceNumber),
+	}
+	err = db.Calls.AddEvent(ctx, statusCallback.CallSID, event, statusCallback.Duration)
+	if err != nil {
+		slog.ErrorContext(ctx, "CALLBACK", "message", "Could not record given statusCallback in DB", "error", err)
+	}
 
-		err = setBadHxStatus(h.Name, err.Error())
-		if err != nil {
-			slog.Error("CALLBACK", "action", action, "error", err)
-		} else {
-			slog.Info("CALLBACK", "action", action, "success", true)
+	defer s.markStatus(statusCallback.CallSID, statusCallback.CallStatus)
+	if slices.Contains(models.FinishedCallStates, statusCallback.CallStatus) {
+		metrics.Calls.WithLabelValues(statusCallback.CallStatus).Inc()
+		if statusCallback.CallStatus == "completed" {
+			metrics.CallDuration.Observe(float64(statusCallback.Duration))
 		}
 	}
 
-	slog.Info("CALLBACK", "event", "receivedEvent", "statusCallback", statusCallback)
-
-	statusCallbacks = append(statusCallbacks, statusCallback)
+	if slices.Contains(badCallStates, statusCallback.CallStatus) {
+		slog.ErrorContext(ctx, "CALLBACK", "status", statusCallback.CallStatus, "action", "requeue")
 
-	var numbers []models.Number
-	numbers, dbErr := searchDbForNumber(statusCallback.To)
-	if dbErr != nil {
-		slog.Error("CALLBACK", "message", "Could not obtain number for given 'TO'", "error", dbErr, "numberTo", statusCallback.To)
-	} else {
-		insertObj.NumberID = numbers[0].ID
-	}
+		// Update area accordingly
+		const action = "setBadHxStatus"
+		_, h, err := mapCallSidToArea(ctx, statusCallback.CallSID)
+		if err != nil && statusCallback.To != "" {
+			slog.WarnContext(ctx, "CALLBACK", "action", "mapCallSidToArea", "error", err, "fallback", "to")
+			_, h, err = mapCalledNumberToArea(ctx, statusCallback.To)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "CALLBACK", "action", action, "error", err)
+		}
 
-	doDbInsert := !slices.Contains(ignoreCallStates, statusCallback.CallStatus)
-	if doDbInsert {
-		err := db.InsertDocument("calls", insertObj)
+		metrics.CallFailures.WithLabelValues(string(caller.FailureCallFailed)).Inc()
+		reason := caller.NewCallError(caller.FailureCallFailed, fmt.Errorf("call ended with status '%s'", statusCallback.CallStatus))
+		err = setBadHxStatus(ctx, h.Name, reason.Error())
 		if err != nil {
-			slog.Error("CALLBACK", "message", "Could not insert given statusCallback into DB", "error", err)
+			tracing.Fail(span, err)
+			slog.ErrorContext(ctx, "CALLBACK", "action", action, "error", err)
+		} else {
+			slog.InfoContext(ctx, "CALLBACK", "action", action, "success", true)
 		}
 	}
 }
 
 // Handler for /transcription
-func handleTransciptionsCallback(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleTransciptionsCallback(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		http.Error(w, "Error parsing form", http.StatusBadRequest)
@@ -225,11 +300,21 @@ func handleTransciptionsCallback(w http.ResponseWriter, r *http.Request) {
 	transcription.Final = r.FormValue("Final") == "true"
 	transcription.SequenceId = int(r.FormValue("SequenceId")[0])
 
+	ctx, span := tracing.Tracer().Start(tracing.FromCallback(r), "callback.transcription",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			tracing.CallSid.String(transcription.CallSid),
+			attribute.String("twilio.transcription.event", transcription.TranscriptionEvent),
+		),
+	)
+	defer span.End()
+	ctx = logger.With(ctx, "callSid", transcription.CallSid)
+
 	if transcription.TranscriptionEvent == "transcription-content" {
 		var transcriptData TranscriptionData
 		err := json.Unmarshal([]byte(r.FormValue("TranscriptionData")), &transcriptData)
 		if err != nil {
-			slog.Error("CALLBACK", "message", "Failed json.Unmarshal on interim transcription request", "error", err)
+			slog.ErrorContext(ctx, "CALLBACK", "message", "Failed json.Unmarshal on interim transcription request", "error", err)
 		} else {
 			/*
 				If we are expecting partial results, then...
@@ -240,7 +325,7 @@ func handleTransciptionsCallback(w http.ResponseWriter, r *http.Request) {
 				Very often, Twilio will return one completely transcribed sentence, but then never provide another complete transcription.
 				Instead of a complete sentence, a "transcription-stop" event gets sent.
 			*/
-			if c.UsesPartialTranscriptionResults() {
+			if s.partialTranscriptions.Load() {
 				isInterim := transcriptData.Confidence == 0
 				transcription.IsInterim = isInterim
 			}
@@ -249,12 +334,14 @@ func handleTransciptionsCallback(w http.ResponseWriter, r *http.Request) {
 		transcription.TranscriptionData = transcriptData
 	}
 
-	_TranscriptionCallbacks = append(_TranscriptionCallbacks, transcription)
+	s.mu.Lock()
+	s.transcriptionCallbacks = append(s.transcriptionCallbacks, transcription)
+	s.mu.Unlock()
+	metrics.TranscriptionFragments.WithLabelValues(transcription.TranscriptionEvent).Inc()
 
 	var logFields []interface{}
 	logFields = append(logFields, "event", transcription.TranscriptionEvent)
 	logFields = append(logFields, "transcriptionSid", transcription.TranscriptionSid)
-	logFields = append(logFields, "callSid", transcription.CallSid)
 	logFields = append(logFields, "sequenceId", transcription.SequenceId)
 
 	// Handle event types
@@ -270,34 +357,87 @@ func handleTransciptionsCallback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if isFinalTranscript {
-		if c.UsesPartialTranscriptionResults() {
-			_TranscriptionCallbacks = sanitizePartialTranscriptions(_TranscriptionCallbacks)
-		}
-
-		finalTranscript := handleTranscriptionStopped(transcription)
+		defer s.markTranscribed(transcription.CallSid)
+		finalTranscript := s.handleTranscriptionStopped(transcription)
 		logFields = append(logFields, "finalTranscript", finalTranscript)
 
-		err := UpdateHxAreaInDatabase(
+		err := s.updateHxAreaInDatabase(
+			ctx,
 			finalTranscript,
 			transcription.CallSid,
 			transcription.Timestamp,
 		)
 		if err != nil {
-			slog.Error("CALLBACK", "event", "updateHxAreaInDatabase", "error", err)
+			tracing.Fail(span, err)
+			slog.ErrorContext(ctx, "CALLBACK", "event", "updateHxAreaInDatabase", "error", err)
 		}
 	}
 
-	slog.Info("CALLBACK", logFields...)
+	slog.InfoContext(ctx, "CALLBACK", logFields...)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Event received"))
+}
+
+// Handler for /recording, recordings are kept on Twilio and only logged here
+func (s *Server) handleRecordingsCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Check if request has been sent from Tilio
+	twilioSignature := r.Header["X-Twilio-Signature"]
+	if twilioSignature == nil {
+		http.Error(w, "Denied callback", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	recording := RecordingCallback{
+		CallSid:         r.FormValue("CallSid"),
+		RecordingSid:    r.FormValue("RecordingSid"),
+		RecordingStatus: r.FormValue("RecordingStatus"),
+		RecordingUrl:    r.FormValue("RecordingUrl"),
+	}
+
+	ctx, span := tracing.Tracer().Start(tracing.FromCallback(r), "callback.recording",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			tracing.CallSid.String(recording.CallSid),
+			attribute.String("twilio.recording.status", recording.RecordingStatus),
+		),
+	)
+	defer span.End()
+	ctx = logger.With(ctx, "callSid", recording.CallSid)
+
+	slog.InfoContext(ctx, "CALLBACK",
+		"event", "receivedRecording",
+		"recordingSid", recording.RecordingSid,
+		"status", recording.RecordingStatus,
+		"url", recording.RecordingUrl,
+	)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Event received"))
 }
 
 // Assemble a completed transcription by its individual parts and return it
-func handleTranscriptionStopped(finalTranscription TranscriptionCallback) string {
+func (s *Server) handleTranscriptionStopped(finalTranscription TranscriptionCallback) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.partialTranscriptions.Load() {
+		s.transcriptionCallbacks = sanitizePartialTranscriptions(s.transcriptionCallbacks)
+	}
+
 	// Filter array for all items whose "callSid" matches the final transcription's callSid and sort
 	var transcriptionContents []TranscriptionCallback
-	for _, request := range _TranscriptionCallbacks {
+	for _, request := range s.transcriptionCallbacks {
 		if request.CallSid == finalTranscription.CallSid {
 			if request.TranscriptionEvent == "transcription-content" {
 				transcriptionContents = append(transcriptionContents, request)
@@ -317,54 +457,71 @@ func handleTranscriptionStopped(finalTranscription TranscriptionCallback) string
 
 	// Delete all requests with the same callSid and reassemble array
 	var remainingRequests []TranscriptionCallback
-	for _, request := range _TranscriptionCallbacks {
+	for _, request := range s.transcriptionCallbacks {
 		if request.CallSid != finalTranscription.CallSid {
 			remainingRequests = append(remainingRequests, request)
 		}
 	}
-	_TranscriptionCallbacks = remainingRequests
+	s.transcriptionCallbacks = remainingRequests
 
 	return fullTranscription
 }
 
-// Start callback webserver
-func Serve() {
-	http.HandleFunc(c.UrlConfigs.Calls, handleCallsCallback)
-	http.HandleFunc(c.UrlConfigs.Transcriptions, handleTransciptionsCallback)
-
-	// ngrok automatically uses the env var so no need to pass the actual value anywhere
-	v, exists := os.LookupEnv("NGROK_AUTHTOKEN")
-	exists = exists && v != ""
-
-	slog.Info("CALLBACK", "action", "startWebserver", "useNgrok", exists)
-	if exists {
-		listener, err := ngrok.Listen(
-			context.Background(),
-			config.HTTPEndpoint(),
-			ngrok.WithAuthtokenFromEnv(),
+// Serves the callbacks until the listener fails, either through ngrok or on the configured address
+func (s *Server) Serve(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(c.UrlConfigs.Calls, s.handleCallsCallback)
+	mux.HandleFunc(c.UrlConfigs.Transcriptions, s.handleTransciptionsCallback)
+	mux.HandleFunc(c.UrlConfigs.Recordings, s.handleRecordingsCallback)
+
+	useNgrok := s.config.Url == ""
+	slog.Info("CALLBACK", "action", "startWebserver", "useNgrok", useNgrok)
+
+	var listener net.Listener
+	var err error
+	if useNgrok {
+		listener, err = ngrok.Listen(
+			ctx,
+			ngrokConfig.HTTPEndpoint(),
+			ngrok.WithAuthtoken(s.config.NgrokAuthToken),
 		)
 		if err != nil {
-			logger.LogErrorFatal("CALLBACK", fmt.Sprintf("Error with ngrok: %v", err.Error()))
-		}
-
-		// Set ngrok tunnel URL as CallbackUrl
-		c.SetCallbackUrl(listener.URL())
-		slog.Info("CALLBACK", "callbackUrl", c.CallbackUrl)
-		if err := http.Serve(listener, nil); err != nil {
-			logger.LogErrorFatal("CALLBACK", err.Error())
+			err = fmt.Errorf("error with ngrok: %w", err)
 		}
 	} else {
-		customCallbackUrl, exists := os.LookupEnv("TWILIO_API_CALLBACK_URL")
-		if !exists {
-			logger.LogErrorFatal("CALLBACK", "Must set TWILIO_API_CALLBACK_URL or use ngrok")
-		} else {
-			c.SetCallbackUrl(customCallbackUrl)
-			slog.Info("CALLBACK", "callbackUrlSource", "envVar", "value", c.CallbackUrl)
-		}
+		listener, err = net.Listen("tcp", s.config.ListenAddress)
+	}
+	if err != nil {
+		s.err = err
+		close(s.ready)
+		return err
+	}
 
-		slog.Info("CALLBACK", "callbackUrl", c.CallbackUrl)
-		if err := http.ListenAndServe(":8080", nil); err != nil {
-			logger.LogErrorFatal("CALLBACK", err.Error())
-		}
+	s.url = s.config.Url
+	if tunnel, ok := listener.(ngrok.Tunnel); ok {
+		s.url = tunnel.URL()
+	}
+	s.httpServer = &http.Server{Handler: mux}
+	close(s.ready)
+
+	slog.Info("CALLBACK", "callbackUrl", s.url, "listenAddress", listener.Addr())
+	if err := s.httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
 	}
+
+	return nil
+}
+
+// Stops accepting callbacks and waits for the handlers that are still running
+func (s *Server) Shutdown(ctx context.Context) error {
+	select {
+	case <-s.ready:
+	default:
+		return nil
+	}
+	if s.err != nil {
+		return nil
+	}
+
+	return s.httpServer.Shutdown(ctx)
 }
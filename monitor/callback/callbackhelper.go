@@ -7,57 +7,66 @@ import (
 	"sort"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/thisisnttheway/hx-monitor/db"
+	"github.com/thisisnttheway/hx-monitor/logger"
+	"github.com/thisisnttheway/hx-monitor/metrics"
 	"github.com/thisisnttheway/hx-monitor/models"
-	"github.com/thisisnttheway/hx-monitor/transcript"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/thisisnttheway/hx-monitor/phone"
+	"github.com/thisisnttheway/hx-monitor/retry"
+	"github.com/thisisnttheway/hx-monitor/tracing"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// Searches the DB for a number
-func searchDbForNumber(numberTo string) ([]models.Number, error) {
-	var result []models.Number
-	result, err := db.GetDocument[models.Number]("numbers", bson.M{"number": numberTo})
+// Maps a call SID to the number that was called and the hx_area the call was placed for
+func mapCallSidToArea(ctx context.Context, callSid string) (models.Number, models.HXArea, error) {
+	call, err := db.Calls.GetBySID(ctx, callSid)
 	if err != nil {
-		return result, err
+		return models.Number{}, models.HXArea{}, err
 	}
 
-	return result, nil
-}
+	number, err := db.Numbers.GetByID(ctx, call.NumberID)
+	if err != nil {
+		return models.Number{}, models.HXArea{}, err
+	}
+
+	// Calls recorded before they were linked to areas
+	if call.HXAreaID.IsZero() {
+		area, err := mapNumberNameToHxArea(ctx, number.Name)
+		return number, area, err
+	}
 
-// Maps a call SID to a number
-func mapCallSidToNumber(callSid string) (models.Number, error) {
-	var numbers []models.Number
-	var calls []models.Call
-	var err error
+	area, err := db.Areas.GetByID(ctx, call.HXAreaID)
+	return number, area, err
+}
 
-	calls, err = db.GetDocument[models.Call]("calls", bson.M{"sid": callSid})
+// Maps the number a call was placed to, as reported by Twilio, to the number and its hx_area.
+// Used when a call SID is not linked to a number, e.g. when a callback arrives before the call was recorded.
+func mapCalledNumberToArea(ctx context.Context, calledNumber string) (models.Number, models.HXArea, error) {
+	normalized, err := phone.Normalize(calledNumber)
 	if err != nil {
-		return models.Number{}, err
+		return models.Number{}, models.HXArea{}, err
 	}
 
-	numbers, err = db.GetDocument[models.Number](
-		"numbers",
-		bson.M{"_id": calls[0].NumberID},
-	)
+	number, err := db.Numbers.GetByNumber(ctx, normalized)
 	if err != nil {
-		return models.Number{}, err
+		return models.Number{}, models.HXArea{}, err
 	}
 
-	return numbers[0], nil
+	area, err := mapNumberNameToHxArea(ctx, number.Name)
+	return number, area, err
 }
 
 // Maps a number_name to an hx_area
-func mapNumberNameToHxArea(numberName string) (models.HXArea, error) {
-	var result []models.HXArea
-	result, err := db.GetDocument[models.HXArea](
-		"hx_areas",
-		bson.M{"number_name": numberName},
-	)
+func mapNumberNameToHxArea(ctx context.Context, numberName string) (models.HXArea, error) {
+	result, err := db.Areas.ListByNumberName(ctx, numberName)
 	if err != nil {
 		return models.HXArea{}, err
 	}
+	if len(result) == 0 {
+		return models.HXArea{}, fmt.Errorf("%w: no hx_area uses number '%s'", db.ErrNotFound, numberName)
+	}
 
 	if len(result) > 1 {
 		slog.Warn(
@@ -71,15 +80,15 @@ func mapNumberNameToHxArea(numberName string) (models.HXArea, error) {
 	return result[0], nil
 }
 
-// Sets an HX area to be bad, i.e. all sub areas being false and last action success being false
-func setBadHxStatus(referenceArea string, errorReason string) error {
-	referenceAreaObj, err := db.GetDocument[models.HXArea]("hx_areas", bson.M{"name": referenceArea})
+// Sets an HX area to be bad, i.e. all sub areas being false and last action success being false, and schedules a retry
+func setBadHxStatus(ctx context.Context, referenceArea string, errorReason string) error {
+	referenceAreaObj, err := db.Areas.GetByName(ctx, referenceArea)
 	if err != nil {
 		return err
 	}
 
 	var subAreas []models.HXSubArea
-	for _, area := range referenceAreaObj[0].SubAreas {
+	for _, area := range referenceAreaObj.SubAreas {
 		subAreas = append(subAreas, models.HXSubArea{
 			FullName: area.FullName,
 			Name:     area.Name,
@@ -87,17 +96,13 @@ func setBadHxStatus(referenceArea string, errorReason string) error {
 		})
 	}
 
-	referenceAreaObj[0].SubAreas = subAreas
-	referenceAreaObj[0].LastActionSuccess = false
-	referenceAreaObj[0].LastError = errorReason
+	retry.Fail(&referenceAreaObj, errorReason, time.Now())
+	logRetry(ctx, referenceAreaObj)
 
-	err = db.UpdateDocument(
-		"hx_areas",
-		bson.D{{"_id", referenceAreaObj[0].ID}},
-		bson.D{{"$set", referenceAreaObj[0]}},
-	)
-
-	return err
+	if err := db.Areas.SetSubAreas(ctx, referenceAreaObj.ID, subAreas); err != nil {
+		return err
+	}
+	return db.Areas.SetFailure(ctx, referenceAreaObj)
 }
 
 // Creates HX sub areas for Meiringen
@@ -169,22 +174,70 @@ func sanitizePartialTranscriptions(s []TranscriptionCallback) []TranscriptionCal
 	return result
 }
 
+// Returns the text of the newest transcript of an area, empty if there is none
+func latestTranscript(ctx context.Context, area models.HXArea) (string, error) {
+	if area.ID.IsZero() {
+		return "", nil
+	}
+
+	transcripts, err := db.Transcripts.ListForArea(ctx, area.ID, 1)
+	if err != nil || len(transcripts) == 0 {
+		return "", err
+	}
+
+	return transcripts[0].Transcript, nil
+}
+
+// Ignores case, punctuation and whitespace, which vary between transcriptions of the same announcement
+func normalizeTranscript(transcript string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(transcript), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// Compares the states of sub areas by name, regardless of their order
+func sameSubAreas(a []models.HXSubArea, b []models.HXSubArea) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	active := make(map[string]bool, len(a))
+	for _, subArea := range a {
+		active[subArea.Name] = subArea.Active
+	}
+	for _, subArea := range b {
+		if state, ok := active[subArea.Name]; !ok || state != subArea.Active {
+			return false
+		}
+	}
+
+	return true
+}
+
 // Updates an HX area in DB based on parsed transcript data
 // Important: Only equipped to handle meiringen at this moment
-func UpdateHxAreaInDatabase(finalTranscript string, callSid string, timestamp time.Time) error {
-	ctx := context.TODO()
+func (s *Server) updateHxAreaInDatabase(ctx context.Context, finalTranscript string, callSid string, timestamp time.Time) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "callback.updateArea")
+	defer func() {
+		tracing.Fail(span, err)
+		span.End()
+	}()
 
 	// 1. Get CallSid -> Get Number -> Get HXArea
 	// 2. Get HXAreas -> Update them
 	// 2. Update hx_areas and hx_sub_areas in DB
-	number, err := mapCallSidToNumber(callSid)
+	number, area, err := mapCallSidToArea(ctx, callSid)
 	if err != nil {
-		slog.Error("CALLBACK", "action", "mapCallSidToNumber", "callSid", callSid, "error", err)
+		slog.ErrorContext(ctx, "CALLBACK", "action", "mapCallSidToArea", "error", err)
 	}
+	span.SetAttributes(tracing.Area.String(area.Name))
+	ctx = logger.With(ctx, "areaName", area.Name)
+	previous := area
 
-	area, err := mapNumberNameToHxArea(number.Name)
+	// Must be read before the current transcript is inserted
+	previousTranscript, err := latestTranscript(ctx, area)
 	if err != nil {
-		slog.Error("CALLBACK", "action", "mapNumberNameToHxArea", "numberName", number.Name, "error", err)
+		slog.WarnContext(ctx, "CALLBACK", "action", "getPreviousTranscript", "error", err)
 	}
 
 	// Update DB
@@ -196,31 +249,63 @@ func UpdateHxAreaInDatabase(finalTranscript string, callSid string, timestamp ti
 		HXAreaID:   area.ID,
 		CallSID:    callSid,
 	}
-	err = db.InsertDocument("transcripts", transcriptDbObj)
+	err = db.Transcripts.Insert(ctx, transcriptDbObj)
 	if err != nil {
-		slog.Error("CALLBACK", "action", "insertTranscriptIntoDatabase", "error", err)
+		slog.ErrorContext(ctx, "CALLBACK", "action", "insertTranscriptIntoDatabase", "error", err)
+		transcriptDbObj.ID = primitive.NilObjectID
 	}
 
 	success, lastError := true, ""
 
 	// ToDo, once other parsers are set up: Determine what parser to use based on phone number
-	airspaceStatus, err := transcript.ParseAirspaceTranscriptMeiringen(finalTranscript, ctx)
-	slog.Debug("CALLBACK", "event", "generatedAirspaceStatus", "airspaceStatus", airspaceStatus)
+	airspaceStatus, err := s.parser.ParseAirspaceTranscriptMeiringen(ctx, finalTranscript)
+	slog.DebugContext(ctx, "CALLBACK", "event", "generatedAirspaceStatus", "airspaceStatus", airspaceStatus)
 	if err != nil {
 		success, lastError = false, err.Error()
+		span.AddEvent("parseFailed")
 	}
+	metrics.Parses.WithLabelValues(metrics.Result(err)).Inc()
 	area.SubAreas = createHxSubAreasMeiringen(airspaceStatus, area.Name)
 	area.NextAction = airspaceStatus.NextUpdate
 	area.FlightOperatingHours = airspaceStatus.OperatingHours
 
-	area.LastActionSuccess = success
-	area.LastError = lastError
+	if !success {
+		retry.Fail(&area, lastError, time.Now())
+		logRetry(ctx, area)
+	} else {
+		area.LastActionSuccess = true
+		area.LastError = ""
+		area.LastSuccess = timestamp
+		retry.Succeed(&area)
+
+		disagreement := previous.LastActionSuccess && previousTranscript != "" &&
+			normalizeTranscript(previousTranscript) == normalizeTranscript(finalTranscript) &&
+			!sameSubAreas(previous.SubAreas, area.SubAreas)
+		if disagreement {
+			slog.WarnContext(ctx, "CALLBACK", "action", "compareParses", "message", "Same transcript as before was parsed differently",
+				"previousSubAreas", previous.SubAreas,
+				"subAreas", area.SubAreas,
+			)
+		}
+		if s.observer != nil && area.Name != "" {
+			s.observer.ParseOutcome(ctx, area.Name, disagreement)
+		}
+	}
 
-	err = db.UpdateDocument(
-		"hx_areas",
-		bson.D{{"_id", area.ID}},
-		bson.D{{"$set", area}},
-	)
+	err = db.Calls.SetParseOutcome(ctx, callSid, transcriptDbObj.ID, success, lastError)
+	if err != nil {
+		slog.ErrorContext(ctx, "CALLBACK", "action", "setParseOutcome", "error", err)
+	}
+
+	return db.Areas.SetParseResult(ctx, area)
+}
 
-	return err
+func logRetry(ctx context.Context, area models.HXArea) {
+	slog.WarnContext(ctx, "CALLBACK",
+		"action", "scheduleRetry",
+		"fails", area.NumErrors,
+		"retryState", area.RetryState,
+		"nextAction", area.NextAction,
+		"lastError", area.LastError,
+	)
 }
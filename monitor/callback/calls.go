@@ -0,0 +1,220 @@
+package callback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/thisisnttheway/hx-monitor/caller"
+	"github.com/thisisnttheway/hx-monitor/logger"
+	"github.com/thisisnttheway/hx-monitor/metrics"
+	"github.com/thisisnttheway/hx-monitor/models"
+	"github.com/thisisnttheway/hx-monitor/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	drainPollInterval    time.Duration = 500 * time.Millisecond
+	watchdogPollInterval time.Duration = 5 * time.Second
+
+	// Callbacks may arrive before the call is tracked, i.e. before its placement has been recorded
+	untrackedCallRetention time.Duration = 10 * time.Minute
+)
+
+// What is known about a call placed by this process
+type callState struct {
+	tracked          bool
+	expectTranscript bool
+	initiated        bool
+	finished         bool
+	transcribed      bool
+	placedAt         time.Time
+	finishedAt       time.Time
+	timeLimit        time.Duration
+	updatedAt        time.Time
+}
+
+func (s *callState) done() bool {
+	return s.finished && (s.transcribed || !s.expectTranscript)
+}
+
+// Registers a placed call, Drain waits for its final status and, if expected, its transcript to be processed.
+// The watchdog fails its area if they do not arrive in time, see RunWatchdog.
+func (s *Server) Track(callSid string, expectTranscript bool, timeLimit time.Duration) {
+	s.updateCall(callSid, func(call *callState) {
+		call.tracked = true
+		call.expectTranscript = expectTranscript
+		call.placedAt = time.Now()
+		call.timeLimit = timeLimit
+	})
+}
+
+// Records that Twilio reported a status of a call
+func (s *Server) markStatus(callSid string, status string) {
+	s.updateCall(callSid, func(call *callState) {
+		call.initiated = true
+		if !slices.Contains(models.FinishedCallStates, status) || call.finished {
+			return
+		}
+
+		call.finished = true
+		call.finishedAt = time.Now()
+
+		// Calls that were not answered are never transcribed
+		if status != "completed" {
+			call.transcribed = true
+		}
+	})
+}
+
+func (s *Server) markTranscribed(callSid string) {
+	s.updateCall(callSid, func(call *callState) {
+		call.transcribed = true
+	})
+}
+
+func (s *Server) updateCall(callSid string, update func(call *callState)) {
+	if s.applyUpdate(callSid, update) {
+		s.callEnded(callSid)
+	}
+}
+
+// Returns whether the call is done
+func (s *Server) applyUpdate(callSid string, update func(call *callState)) bool {
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+
+	call, ok := s.calls[callSid]
+	if !ok {
+		call = &callState{}
+		s.calls[callSid] = call
+	}
+	update(call)
+	call.updatedAt = time.Now()
+
+	done := call.tracked && call.done()
+	if done {
+		delete(s.calls, callSid)
+	}
+
+	for sid, other := range s.calls {
+		if !other.tracked && time.Since(other.updatedAt) > untrackedCallRetention {
+			delete(s.calls, sid)
+		}
+	}
+
+	return done
+}
+
+func (s *Server) callEnded(callSid string) {
+	if s.callObserver != nil {
+		s.callObserver.CallEnded(callSid)
+	}
+}
+
+// Returns the SIDs of tracked calls that are not done yet
+func (s *Server) InFlight() []string {
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+
+	var result []string
+	for sid, call := range s.calls {
+		if call.tracked {
+			result = append(result, sid)
+		}
+	}
+
+	return result
+}
+
+// Periodically fails the areas of tracked calls whose callbacks did not arrive in time, until ctx is done
+func (s *Server) RunWatchdog(ctx context.Context) {
+	ticker := time.NewTicker(watchdogPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for callSid, reason := range s.expireCalls(time.Now()) {
+			s.failExpiredCall(context.WithoutCancel(ctx), callSid, reason)
+			s.callEnded(callSid)
+		}
+	}
+}
+
+// Stops tracking calls that are overdue, returning why they expired
+func (s *Server) expireCalls(now time.Time) map[string]string {
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+
+	expired := make(map[string]string)
+	for sid, call := range s.calls {
+		if !call.tracked {
+			continue
+		}
+
+		var reason string
+		switch {
+		case !call.initiated && now.Sub(call.placedAt) > s.config.InitiatedTimeout:
+			reason = fmt.Sprintf("no status was reported within %s of placing the call", s.config.InitiatedTimeout)
+		case !call.finished && now.Sub(call.placedAt) > call.timeLimit+s.config.CompletionGrace:
+			reason = fmt.Sprintf("the call did not complete within %s", call.timeLimit+s.config.CompletionGrace)
+		case call.finished && call.expectTranscript && !call.transcribed && now.Sub(call.finishedAt) > s.config.TranscriptTimeout:
+			reason = fmt.Sprintf("the transcript did not arrive within %s of the call completing", s.config.TranscriptTimeout)
+		default:
+			continue
+		}
+
+		expired[sid] = reason
+		delete(s.calls, sid)
+	}
+
+	return expired
+}
+
+// Marks the area of an expired call as failed, which schedules a retry
+func (s *Server) failExpiredCall(ctx context.Context, callSid string, reason string) {
+	ctx, span := tracing.Tracer().Start(ctx, "callback.expire", trace.WithAttributes(tracing.CallSid.String(callSid)))
+	defer span.End()
+	ctx = logger.With(ctx, "callSid", callSid)
+
+	metrics.CallFailures.WithLabelValues(string(caller.FailureTimeout)).Inc()
+	slog.WarnContext(ctx, "CALLBACK", "action", "expireCall", "reason", reason)
+
+	_, area, err := mapCallSidToArea(ctx, callSid)
+	if err == nil {
+		span.SetAttributes(tracing.Area.String(area.Name))
+		err = setBadHxStatus(ctx, area.Name, caller.NewCallError(caller.FailureTimeout, errors.New(reason)).Error())
+	}
+	if err != nil {
+		tracing.Fail(span, err)
+		slog.ErrorContext(ctx, "CALLBACK", "action", "expireCall", "error", err)
+	}
+}
+
+// Waits until all tracked calls are done or ctx is done
+func (s *Server) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		inFlight := s.InFlight()
+		if len(inFlight) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			slog.Warn("CALLBACK", "action", "drain", "message", "Gave up waiting for calls", "callSids", inFlight)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -1,19 +1,21 @@
 package caller
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"math"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	c "github.com/thisisnttheway/hx-monitor/configuration"
 	"github.com/thisisnttheway/hx-monitor/db"
-	"github.com/thisisnttheway/hx-monitor/logger"
 	"github.com/thisisnttheway/hx-monitor/models"
+	"github.com/thisisnttheway/hx-monitor/phone"
+	"github.com/thisisnttheway/hx-monitor/tracing"
 	"github.com/twilio/twilio-go"
 	twilioApi "github.com/twilio/twilio-go/rest/api/v2010"
-	"go.mongodb.org/mongo-driver/bson"
 )
 
 const twilioTimeFormat string = "Mon, 02 Jan 2006 15:04:05 -0700"
@@ -26,24 +28,65 @@ type CallResponse struct {
 	EndTime     time.Time
 	Price       float32
 	PriceUnit   string
+
+	// A live transcription was requested, its callbacks are to be expected
+	Transcribing bool
+
+	// Twilio ends the call after this long
+	TimeLimit time.Duration
+}
+
+// Places calls through the Twilio API
+type Caller struct {
+	mu     sync.RWMutex
+	config c.TwilioConfiguration
+	client *twilio.RestClient
+
+	// Blocks until the public base URL of the callback server is known
+	callbackUrl func(ctx context.Context) (string, error)
+}
+
+func New(config c.TwilioConfiguration, callbackUrl func(ctx context.Context) (string, error)) *Caller {
+	caller := &Caller{callbackUrl: callbackUrl}
+	caller.Configure(config)
+
+	return caller
+}
+
+// Replaces the configuration and the Twilio API client built from it
+func (caller *Caller) Configure(config c.TwilioConfiguration) {
+	client := createTwilioClient(config.AuthConfig)
+
+	caller.mu.Lock()
+	defer caller.mu.Unlock()
+
+	caller.config = config
+	caller.client = client
+}
+
+func (caller *Caller) current() (c.TwilioConfiguration, *twilio.RestClient) {
+	caller.mu.RLock()
+	defer caller.mu.RUnlock()
+
+	return caller.config, caller.client
 }
 
 // Construct Twilio API client
-func createTwilioClient() *twilio.RestClient {
+func createTwilioClient(auth c.TwilioAuth) *twilio.RestClient {
 	var twilioClientParams twilio.ClientParams
 
-	usesAuthToken := c.GetTwilioConfig().AuthConfig.AuthToken != ""
+	usesAuthToken := auth.AuthToken != ""
 	slog.Info("CALLER", "action", "createClient", "usingAuthToken", usesAuthToken)
 	if usesAuthToken {
 		twilioClientParams = twilio.ClientParams{
-			Username: c.GetTwilioConfig().AuthConfig.AccountSid,
-			Password: c.GetTwilioConfig().AuthConfig.AuthToken,
+			Username: auth.AccountSid,
+			Password: auth.AuthToken,
 		}
 	} else {
 		twilioClientParams = twilio.ClientParams{
-			Username:   c.GetTwilioConfig().AuthConfig.ApiKey,
-			Password:   c.GetTwilioConfig().AuthConfig.ApiSecret,
-			AccountSid: c.GetTwilioConfig().AuthConfig.AccountSid,
+			Username:   auth.ApiKey,
+			Password:   auth.ApiSecret,
+			AccountSid: auth.AccountSid,
 		}
 	}
 
@@ -55,77 +98,72 @@ func createTwilioClient() *twilio.RestClient {
 }
 
 // Get numbers in database
-func GetNumbers() []models.Number {
-	results, err := db.GetDocument[models.Number]("numbers", bson.D{})
-	if len(results) == 0 || err != nil {
-		logger.LogErrorFatal("CALLER", "No numbers found")
+func GetNumbers(ctx context.Context) ([]models.Number, error) {
+	results, err := db.Numbers.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get numbers: %w", err)
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no numbers found: %w", db.ErrNotFound)
 	}
 
 	slog.Info("CALLER", "action", "getNumbers", "amount", len(results))
-	return results
+	return results, nil
 }
 
-// Call a number and optionally start a live transcription
-func Call(number string, startTranscription bool, startRecording bool) (CallResponse, error) {
-	for {
-		if !c.IsCallbackurlSet() {
-			slog.Warn("CALLER", "message", "Waiting for CallbackUrlDefined", "CallBackUrlDefined", c.IsCallbackurlSet())
-			time.Sleep(time.Second * 1)
-		} else {
-			break
-		}
+// Call a number and start a live transcription or recording, as configured.
+// Errors are of type *CallError, see Classify.
+func (caller *Caller) Call(ctx context.Context, number models.Number) (CallResponse, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "caller.call")
+	defer span.End()
+
+	call, err := caller.call(ctx, number)
+	if err == nil {
+		span.SetAttributes(tracing.CallSid.String(call.SID), tracing.CallStatus.String(call.Status))
 	}
+	tracing.Fail(span, err)
 
-	client := createTwilioClient()
+	return call, err
+}
 
-	var targetNumber string = number
-	if !strings.HasPrefix(number, "+41") {
-		targetNumber = fmt.Sprintf("+41%s", number)
+func (caller *Caller) call(ctx context.Context, number models.Number) (CallResponse, error) {
+	callbackUrl, err := caller.callbackUrl(ctx)
+	if err != nil {
+		return CallResponse{}, NewCallError(FailureOther, fmt.Errorf("callback URL is unknown: %w", err))
 	}
 
-	params := &twilioApi.CreateCallParams{}
-	params.SetTo(targetNumber)
-	params.SetFrom(c.GetTwilioConfig().CallFrom)
-	params.SetTimeLimit(c.GetTwilioConfig().CallLength + 5) // Ensures transcripts can complete
-	params.SetStatusCallback(c.GetCallbackUrl() + c.UrlConfigs.Calls)
-	params.SetStatusCallbackEvent([]string{"initiated", "answered", "completed"})
+	config, client := caller.current()
 
-	if startTranscription && startRecording {
-		slog.Warn("CALLER", "message", "Both live transcription and call recording are enabled")
+	targetNumber, err := phone.Normalize(number.Number)
+	if err != nil {
+		return CallResponse{}, NewCallError(FailureInvalidNumber, err)
 	}
-
-	var additionalMl string
-	if startTranscription {
-		// Apparently you could use twilio-go/twiml/twiml.go instead of assembling a string but idk how
-		transcriptionHints := "$DAY, CTR, TMA, active, inactive"
-
-		additionalParams := fmt.Sprintf("partialResults='%v' track='inbound_track'", c.UsesPartialTranscriptionResults())
-		additionalMl = fmt.Sprintf(
-			"<Start><Transcription hints='%s' statusCallbackUrl='%s' %s/></Start>",
-			transcriptionHints, c.GetCallbackUrl()+c.UrlConfigs.Transcriptions,
-			additionalParams,
-		)
+	if err := number.Script.Validate(); err != nil {
+		return CallResponse{}, NewCallError(FailureOther, fmt.Errorf("invalid call script: %w", err))
 	}
 
-	if startRecording {
-		additionalMl = fmt.Sprintf(
-			"<Record maxLength='%d' playBeep='%v' recordingStatusCallback='%s'/>",
-			c.GetTwilioConfig().CallLength, false, c.GetCallbackUrl()+c.UrlConfigs.Recordings,
-		)
-	}
+	params := &twilioApi.CreateCallParams{}
+	params.SetTo(targetNumber)
+	params.SetFrom(config.CallFrom)
+	timeLimit := config.CallLength + 5 + int(math.Ceil(number.Script.Length().Seconds())) // Ensures the script and transcripts can complete
+	params.SetTimeLimit(timeLimit)
+	params.SetStatusCallback(tracing.CallbackURL(ctx, callbackUrl+c.UrlConfigs.Calls))
+	params.SetStatusCallbackEvent([]string{"initiated", "answered", "completed"})
 
-	slog.Info("CALLER", "action", "addAdditionalMl", "value", additionalMl)
-	twiMl := fmt.Sprintf(
-		"<Response>%s<Pause length='%d'/></Response>",
-		additionalMl,
-		c.GetTwilioConfig().CallLength,
+	twiMl, err := BuildTwiml(config, number.Script,
+		tracing.CallbackURL(ctx, callbackUrl+c.UrlConfigs.Transcriptions),
+		tracing.CallbackURL(ctx, callbackUrl+c.UrlConfigs.Recordings),
 	)
+	if err != nil {
+		return CallResponse{}, NewCallError(FailureOther, fmt.Errorf("could not build TwiML: %w", err))
+	}
+	slog.InfoContext(ctx, "CALLER", "action", "buildTwiml", "value", twiMl)
 	params.SetTwiml(twiMl)
 
 	resp, err := client.Api.CreateCall(params)
 	if err != nil {
-		slog.Error("CALLER", "error", fmt.Sprintf("Error calling %s: %v", targetNumber, err.Error()))
-		return CallResponse{}, err
+		slog.ErrorContext(ctx, "CALLER", "error", fmt.Sprintf("Error calling %s: %v", targetNumber, err.Error()))
+		return CallResponse{}, classifyTwilioError(err)
 	} else {
 		var err error
 		var parsedCreatedTime time.Time
@@ -133,7 +171,7 @@ func Call(number string, startTranscription bool, startRecording bool) (CallResp
 			timeString := *resp.DateCreated
 			parsedCreatedTime, err = time.Parse(twilioTimeFormat, timeString)
 			if err != nil {
-				slog.Error("CALLER", "message", "Failed parsing reported DateCreated", "source", timeString, "error", err.Error())
+				slog.ErrorContext(ctx, "CALLER", "message", "Failed parsing reported DateCreated", "source", timeString, "error", err.Error())
 				parsedCreatedTime = time.Now()
 			}
 		}
@@ -142,7 +180,7 @@ func Call(number string, startTranscription bool, startRecording bool) (CallResp
 		if resp.Price != nil {
 			price, err = strconv.ParseFloat(*resp.Price, 32)
 			if err != nil {
-				slog.Error("CALLER", "message", "Failed converting reported price", "source", *resp.Price, "error", err.Error())
+				slog.ErrorContext(ctx, "CALLER", "message", "Failed converting reported price", "source", *resp.Price, "error", err.Error())
 				price = 0
 			}
 		}
@@ -169,7 +207,7 @@ func Call(number string, startTranscription bool, startRecording bool) (CallResp
 			if t, err := time.Parse(twilioTimeFormat, timeEndedString); err == nil {
 				parsedEndedTime = t
 			} else {
-				slog.Error("CALLER", "message", "Failed parsing reported DateEnded", "source", timeEndedString, "error", err.Error())
+				slog.ErrorContext(ctx, "CALLER", "message", "Failed parsing reported DateEnded", "source", timeEndedString, "error", err.Error())
 				parsedEndedTime = time.Now()
 			}
 		} else {
@@ -177,33 +215,26 @@ func Call(number string, startTranscription bool, startRecording bool) (CallResp
 		}
 
 		returnObj := CallResponse{
-			Status:      status,
-			SID:         sid,
-			Direction:   direction,
-			DateCreated: parsedCreatedTime,
-			Price:       float32(price),
-			PriceUnit:   priceUnit,
-			EndTime:     parsedEndedTime,
-		}
-
-		// Check the API for immediate errors
-		time.Sleep(time.Second * 5)
-		callDetails, err := client.Api.FetchCall(*resp.Sid, nil)
-		if err != nil {
-			slog.Error("CALLER", "message", "Failed fetching call", "sid", *resp.Sid)
-			return CallResponse{}, err
-		} else if callDetails.Status != nil && *callDetails.Status == "failed" {
-			return CallResponse{}, fmt.Errorf("Call failed with status '%s'", *callDetails.Status)
+			Status:       status,
+			SID:          sid,
+			Direction:    direction,
+			DateCreated:  parsedCreatedTime,
+			Price:        float32(price),
+			PriceUnit:    priceUnit,
+			EndTime:      parsedEndedTime,
+			Transcribing: config.Transcribe,
+			TimeLimit:    time.Duration(timeLimit) * time.Second,
 		}
 
-		slog.Info("CALLER", "action", "fetch", "sid", sid, "response", returnObj)
+		// Failures after the call was placed are reported by its status callbacks
+		slog.InfoContext(ctx, "CALLER", "action", "create", "sid", sid, "response", returnObj)
 		return returnObj, nil
 	}
 }
 
 // Deletes a recording
-func DeleteRecording(sid string) error {
-	client := createTwilioClient()
+func (caller *Caller) DeleteRecording(sid string) error {
+	_, client := caller.current()
 	params := &twilioApi.DeleteRecordingParams{}
 
 	return client.Api.DeleteRecording(sid, params)
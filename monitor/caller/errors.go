@@ -0,0 +1,94 @@
+package caller
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/twilio/twilio-go/client"
+)
+
+// Why a call could not be placed or failed right away
+type FailureKind string
+
+const (
+	// Twilio could not be reached, e.g. due to a DNS or connection error
+	FailureNetwork FailureKind = "network"
+
+	// Twilio rejected the request for a reason other than the number
+	FailureAPI FailureKind = "twilio-api"
+
+	// The call was placed but failed
+	FailureCallFailed FailureKind = "call-failed"
+
+	// The callbacks of a placed call did not arrive in time
+	FailureTimeout FailureKind = "timeout"
+
+	// The number can not be called, retrying will not help
+	FailureInvalidNumber FailureKind = "invalid-number"
+
+	FailureOther FailureKind = "other"
+)
+
+// Twilio error codes caused by the called number, see https://www.twilio.com/docs/api/errors
+var invalidNumberCodes = []int{
+	13223, // Dial: Invalid phone number format
+	13224, // Dial: Invalid phone number
+	21211, // Invalid 'To' phone number
+	21214, // 'To' phone number cannot be reached
+	21215, // Geo permission configuration is not permitting call
+	21216, // Account not allowed to call phone number
+	21217, // Phone number does not appear to be valid
+}
+
+// Error of a call that could not be placed or failed right away
+type CallError struct {
+	Kind FailureKind
+	Err  error
+}
+
+func (e *CallError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+}
+
+func (e *CallError) Unwrap() error {
+	return e.Err
+}
+
+// Whether retrying the call can succeed
+func (e *CallError) Permanent() bool {
+	return e.Kind == FailureInvalidNumber
+}
+
+func NewCallError(kind FailureKind, err error) *CallError {
+	return &CallError{Kind: kind, Err: err}
+}
+
+// Returns the kind of failure of an error returned by Call
+func Classify(err error) FailureKind {
+	var callErr *CallError
+	if errors.As(err, &callErr) {
+		return callErr.Kind
+	}
+
+	var restErr *client.TwilioRestError
+	if errors.As(err, &restErr) {
+		if slices.Contains(invalidNumberCodes, restErr.Code) {
+			return FailureInvalidNumber
+		}
+		return FailureAPI
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return FailureNetwork
+	}
+
+	return FailureOther
+}
+
+// Wraps an error returned by the Twilio API into a CallError
+func classifyTwilioError(err error) *CallError {
+	return NewCallError(Classify(err), err)
+}
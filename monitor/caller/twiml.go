@@ -0,0 +1,55 @@
+package caller
+
+import (
+	"fmt"
+
+	c "github.com/thisisnttheway/hx-monitor/configuration"
+	"github.com/thisisnttheway/hx-monitor/models"
+	"github.com/thisisnttheway/hx-monitor/twiml"
+)
+
+// Words Twilio's speech recognition should expect in announcements
+const transcriptionHints string = "$DAY, CTR, TMA, active, inactive"
+
+// Builds the instructions for a call: runs the script of the number, then transcribes and/or records the announcement for CallLength seconds
+func BuildTwiml(config c.TwilioConfiguration, script models.CallScript, transcriptionCallback string, recordingCallback string) (string, error) {
+	response := twiml.NewResponse()
+
+	// The menu is not transcribed, so that it is not mistaken for the announcement
+	for _, step := range script {
+		switch step.Action {
+		case models.CallStepWait:
+			response.Append(twiml.Pause{Length: step.Seconds})
+		case models.CallStepDigits, models.CallStepLanguage:
+			if step.Digits != "" {
+				response.Append(twiml.Play{Digits: step.Digits})
+			}
+		default:
+			return "", fmt.Errorf("unknown call script action '%s'", step.Action)
+		}
+	}
+
+	if config.Transcribe {
+		response.Append(twiml.Start{Transcription: &twiml.Transcription{
+			StatusCallbackUrl: transcriptionCallback,
+			Track:             "inbound_track",
+			LanguageCode:      script.Language(),
+			Hints:             transcriptionHints,
+			PartialResults:    config.UsePartialTranscriptionResults,
+		}})
+	}
+
+	// Recording keeps the call open just like a pause, while the transcription runs alongside
+	if config.Record {
+		response.Append(twiml.Record{
+			MaxLength:               config.CallLength,
+			Timeout:                 config.CallLength,
+			PlayBeep:                false,
+			RecordingStatusCallback: recordingCallback,
+		})
+	} else {
+		response.Append(twiml.Pause{Length: config.CallLength})
+	}
+
+	return response.Render()
+}
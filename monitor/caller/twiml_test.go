@@ -0,0 +1,83 @@
+package caller
+
+import (
+	"encoding/xml"
+	"testing"
+
+	c "github.com/thisisnttheway/hx-monitor/configuration"
+	"github.com/thisisnttheway/hx-monitor/models"
+)
+
+const (
+	transcriptionCallback string = "https://hx.example.com/transcription?traceparent=00-abc&x=1"
+	recordingCallback     string = "https://hx.example.com/recording"
+
+	transcription string = `<Start><Transcription statusCallbackUrl="https://hx.example.com/transcription?traceparent=00-abc&amp;x=1" track="inbound_track" hints="$DAY, CTR, TMA, active, inactive" partialResults="false"></Transcription></Start>`
+	record        string = `<Record maxLength="40" timeout="40" playBeep="false" recordingStatusCallback="https://hx.example.com/recording"></Record>`
+)
+
+func TestBuildTwiml(t *testing.T) {
+	cases := []struct {
+		name     string
+		config   c.TwilioConfiguration
+		script   models.CallScript
+		expected string
+	}{
+		{
+			name:     "transcription",
+			config:   c.TwilioConfiguration{CallLength: 40, Transcribe: true},
+			expected: `<Response>` + transcription + `<Pause length="40"></Pause></Response>`,
+		},
+		{
+			name:     "partialTranscription",
+			config:   c.TwilioConfiguration{CallLength: 40, Transcribe: true, UsePartialTranscriptionResults: true},
+			expected: `<Response><Start><Transcription statusCallbackUrl="https://hx.example.com/transcription?traceparent=00-abc&amp;x=1" track="inbound_track" hints="$DAY, CTR, TMA, active, inactive" partialResults="true"></Transcription></Start><Pause length="40"></Pause></Response>`,
+		},
+		{
+			name:     "recording",
+			config:   c.TwilioConfiguration{CallLength: 40, Record: true},
+			expected: `<Response>` + record + `</Response>`,
+		},
+		{
+			name:     "transcriptionAndRecording",
+			config:   c.TwilioConfiguration{CallLength: 40, Transcribe: true, Record: true},
+			expected: `<Response>` + transcription + record + `</Response>`,
+		},
+		{
+			name:   "script",
+			config: c.TwilioConfiguration{CallLength: 40, Transcribe: true},
+			script: models.CallScript{
+				{Action: models.CallStepWait, Seconds: 3},
+				{Action: models.CallStepLanguage, Digits: "2", Language: "en-US"},
+				{Action: models.CallStepWait, Seconds: 2},
+				{Action: models.CallStepDigits, Digits: "w1#"},
+			},
+			expected: `<Response><Pause length="3"></Pause><Play digits="2"></Play><Pause length="2"></Pause><Play digits="w1#"></Play><Start><Transcription statusCallbackUrl="https://hx.example.com/transcription?traceparent=00-abc&amp;x=1" track="inbound_track" languageCode="en-US" hints="$DAY, CTR, TMA, active, inactive" partialResults="false"></Transcription></Start><Pause length="40"></Pause></Response>`,
+		},
+		{
+			name:     "languageWithoutDigits",
+			config:   c.TwilioConfiguration{CallLength: 40},
+			script:   models.CallScript{{Action: models.CallStepLanguage, Language: "fr-CH"}},
+			expected: `<Response><Pause length="40"></Pause></Response>`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := BuildTwiml(tc.config, tc.script, transcriptionCallback, recordingCallback)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := xml.Header + tc.expected; actual != expected {
+				t.Errorf("\nexpected: %s\nactual:   %s", expected, actual)
+			}
+		})
+	}
+}
+
+func TestBuildTwimlRejectsUnknownActions(t *testing.T) {
+	script := models.CallScript{{Action: "dance"}}
+	if _, err := BuildTwiml(c.TwilioConfiguration{CallLength: 40, Transcribe: true}, script, transcriptionCallback, recordingCallback); err == nil {
+		t.Error("expected an error for an unknown action")
+	}
+}
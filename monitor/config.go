@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/thisisnttheway/hx-monitor/configuration"
+	"github.com/thisisnttheway/hx-monitor/logger"
+)
+
+// Loads and validates the configuration and makes it available to all packages.
+// Commands that only access the database do not need the rest to be valid.
+func loadConfig(databaseOnly bool) error {
+	cfg, err := configuration.Load(*configPath)
+	if err == nil {
+		if databaseOnly {
+			err = cfg.ValidateDatabase()
+		} else {
+			err = cfg.Validate()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	configuration.Use(cfg)
+	return logger.Setup(cfg.Logging)
+}
+
+// Handles "config check"
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return errors.New("unknown config command, must be 'check'")
+	}
+
+	cfg, loadErr := configuration.Load(*configPath)
+	fmt.Print(cfg)
+
+	err := errors.Join(loadErr, cfg.Validate())
+	if err != nil {
+		fmt.Println("\nConfiguration is invalid:")
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Printf("  - %s\n", line)
+		}
+		return errors.New("invalid configuration")
+	}
+
+	fmt.Println("\nConfiguration is valid")
+	return nil
+}
+
+// Handles "secrets keygen" and "secrets encrypt <file>"
+func runSecrets(args []string) error {
+	if len(args) == 0 {
+		return errors.New("unknown secrets command, must be 'keygen' or 'encrypt <file>'")
+	}
+
+	switch args[0] {
+	case "keygen":
+		key, err := configuration.GenerateSecretsKey()
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+	case "encrypt":
+		if len(args) != 2 {
+			return errors.New("usage: secrets encrypt <file>")
+		}
+
+		cfg, err := configuration.Load(*configPath)
+		if err != nil {
+			return err
+		}
+		if cfg.Secrets.Key == "" {
+			return errors.New("secrets.key (SECRETS_KEY) is required, create one with 'secrets keygen'")
+		}
+
+		plaintext, err := os.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		encrypted, err := configuration.EncryptSecrets(cfg.Secrets.Key, plaintext)
+		if err != nil {
+			return err
+		}
+		fmt.Println(encrypted)
+	default:
+		return fmt.Errorf("unknown secrets command '%s', must be 'keygen' or 'encrypt <file>'", args[0])
+	}
+
+	return nil
+}
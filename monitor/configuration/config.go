@@ -0,0 +1,516 @@
+package configuration
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const redacted string = "<redacted>"
+
+// All settings of the monitor. api-backend only uses the database settings.
+// Fields are set from defaults, a YAML or TOML file, secret providers and env vars, in ascending precedence.
+type Config struct {
+	Database DatabaseConfiguration `yaml:"database" toml:"database"`
+	Mongo    MongoConfiguration    `yaml:"mongo" toml:"mongo"`
+	Twilio   TwilioConfiguration   `yaml:"twilio" toml:"twilio"`
+	Callback CallbackConfiguration `yaml:"callback" toml:"callback"`
+	AI       AIConfiguration       `yaml:"ai" toml:"ai"`
+	Metrics  MetricsConfiguration  `yaml:"metrics" toml:"metrics"`
+	Health   HealthConfiguration   `yaml:"health" toml:"health"`
+	Tracing  TracingConfiguration  `yaml:"tracing" toml:"tracing"`
+	Logging  LoggingConfiguration  `yaml:"logging" toml:"logging"`
+	Alerting AlertingConfiguration `yaml:"alerting" toml:"alerting"`
+	Retry    RetryConfiguration    `yaml:"retry" toml:"retry"`
+	Monitor  MonitorConfiguration  `yaml:"monitor" toml:"monitor"`
+	Secrets  SecretsConfiguration  `yaml:"secrets" toml:"secrets"`
+}
+
+func Defaults() Config {
+	return Config{
+		Database: DatabaseConfiguration{
+			Driver:     DriverMongo,
+			SqlitePath: "hx.db",
+		},
+		Mongo: MongoConfiguration{
+			AuthDatabase: "admin",
+			Database:     "hx",
+		},
+		Twilio: TwilioConfiguration{
+			CallLength: 38,
+			Transcribe: true,
+		},
+		Callback: CallbackConfiguration{
+			ListenAddress:     ":8080",
+			DrainTimeout:      90 * time.Second,
+			InitiatedTimeout:  30 * time.Second,
+			CompletionGrace:   90 * time.Second,
+			TranscriptTimeout: 2 * time.Minute,
+		},
+		AI: AIConfiguration{
+			Model: "gemini-flash-lite-latest",
+		},
+		Metrics: MetricsConfiguration{
+			ListenAddress: ":9090",
+		},
+		Health: HealthConfiguration{
+			AreaStaleAfter: time.Hour,
+		},
+		Tracing: TracingConfiguration{
+			SampleRatio: 1,
+		},
+		Alerting: AlertingConfiguration{
+			EvaluationInterval: time.Minute,
+			RepeatInterval:     6 * time.Hour,
+			StaleFactor:        3,
+			ExpectedInterval:   time.Hour,
+			FailureThreshold:   2,
+		},
+		Monitor: MonitorConfiguration{
+			Workers: 4,
+		},
+		Retry: RetryConfiguration{
+			InitialDelay: 5 * time.Minute,
+			MaxDelay:     time.Hour,
+			Multiplier:   2,
+			Jitter:       0.2,
+			MaxAttempts:  3,
+			CoolOff:      2 * time.Hour,
+			ResetAfter:   24 * time.Hour,
+		},
+		Logging: LoggingConfiguration{
+			Format:         LogFormatText,
+			Level:          "info",
+			FileMaxSizeMB:  100,
+			FileMaxBackups: 5,
+			FileMaxAge:     30 * 24 * time.Hour,
+
+			ControlListenAddress: "127.0.0.1:9190",
+		},
+	}
+}
+
+// Loads the configuration from the given file (optional), the configured secret providers and env vars.
+// The file format is determined by its extension (.yaml, .yml or .toml). The result is not validated.
+func Load(path string) (Config, error) {
+	// Secret providers are configured by the file and env vars only
+	cfg, err := load(path, nil)
+	if err != nil {
+		return cfg, err
+	}
+
+	secrets, err := fetchSecrets(cfg.Secrets)
+	if err != nil {
+		return cfg, err
+	}
+	if len(secrets) == 0 {
+		return cfg, nil
+	}
+
+	return load(path, secrets)
+}
+
+func load(path string, secrets map[string]string) (Config, error) {
+	cfg := Defaults()
+	if path != "" {
+		if err := loadFile(path, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	applySecrets(reflect.ValueOf(&cfg).Elem(), secrets)
+	return cfg, errors.Join(applyEnv(reflect.ValueOf(&cfg).Elem(), "")...)
+}
+
+func loadFile(path string, cfg *Config) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("invalid config file '%s': %w", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(content), cfg)
+		if err != nil {
+			return fmt.Errorf("invalid config file '%s': %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("invalid config file '%s': unknown keys %v", path, undecoded)
+		}
+	default:
+		return fmt.Errorf("unsupported config file '%s', must be .yaml, .yml or .toml", path)
+	}
+
+	slog.Info("CONFIG", "action", "loadFile", "path", path)
+	return nil
+}
+
+// Overrides fields tagged with `env` by the first of the named env vars that is set and not empty
+func applyEnv(v reflect.Value, prefix string) []error {
+	var errs []error
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		key := prefix + field.Tag.Get("yaml")
+
+		if field.Type.Kind() == reflect.Struct {
+			errs = append(errs, applyEnv(v.Field(i), key+".")...)
+			continue
+		}
+
+		names := splitTag(field.Tag.Get("env"))
+		deprecated := splitTag(field.Tag.Get("envDeprecated"))
+		name, value, found, err := lookupEnv(append(names, deprecated...), field.Tag.Get("secret") == "true")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s (%s): %w", key, name, err))
+			continue
+		}
+		if !found {
+			continue
+		}
+		if slices.Contains(deprecated, name) {
+			slog.Warn("CONFIG", "message", "Env var is deprecated", "envVar", name, "replacement", names[0])
+		}
+
+		if err := setField(v.Field(i), value); err != nil {
+			errs = append(errs, fmt.Errorf("%s (%s): %w", key, name, err))
+		}
+	}
+
+	return errs
+}
+
+func splitTag(tag string) []string {
+	if tag == "" {
+		return nil
+	}
+
+	return strings.Split(tag, ",")
+}
+
+// Returns the first of the named env vars that is set and not empty.
+// Secrets may also be read from the file named by <NAME>_FILE, e.g. a Docker or Kubernetes secret.
+func lookupEnv(names []string, isSecret bool) (name string, value string, found bool, err error) {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return name, value, true, nil
+		}
+
+		if !isSecret {
+			continue
+		}
+		if path := os.Getenv(name + "_FILE"); path != "" {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return name + "_FILE", "", false, err
+			}
+
+			return name + "_FILE", strings.TrimSpace(string(content)), true, nil
+		}
+	}
+
+	return "", "", false, nil
+}
+
+// Sets fields tagged as `secret` to the value stored under the name of one of their env vars
+func applySecrets(v reflect.Value, secrets map[string]string) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			applySecrets(v.Field(i), secrets)
+			continue
+		}
+		if field.Tag.Get("secret") != "true" {
+			continue
+		}
+
+		for _, name := range append(splitTag(field.Tag.Get("env")), splitTag(field.Tag.Get("envDeprecated"))...) {
+			if value, ok := secrets[name]; ok && value != "" {
+				v.Field(i).SetString(value)
+				break
+			}
+		}
+	}
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a number", value)
+		}
+		field.SetInt(int64(i))
+	case reflect.Int64:
+		if field.Type() != reflect.TypeOf(time.Duration(0)) {
+			return fmt.Errorf("unsupported type %s", field.Type())
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a duration", value)
+		}
+		field.SetInt(int64(d))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a number", value)
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("'%s' is not a boolean", value)
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Kind())
+	}
+
+	return nil
+}
+
+// ---------------------------------------------
+// VALIDATION
+
+// Validates everything the monitor needs, reporting all problems at once
+func (cfg Config) Validate() error {
+	var errs []error
+	errs = append(errs, cfg.validateDatabase()...)
+	errs = append(errs, cfg.validateLogging()...)
+
+	// Twilio
+	auth := cfg.Twilio.AuthConfig
+	errs = appendIfEmpty(errs, auth.AccountSid, "twilio.auth.account_sid (TWILIO_ACCOUNT_SID)")
+	if auth.AuthToken == "" && (auth.ApiKey == "" || auth.ApiSecret == "") {
+		errs = append(errs, errors.New("twilio.auth: either auth_token (TWILIO_AUTH_TOKEN) or api_key and api_secret (TWILIO_API_KEY, TWILIO_API_SECRET) are required"))
+	}
+	errs = appendIfEmpty(errs, cfg.Twilio.CallFrom, "twilio.call_from (TWILIO_CALL_FROM)")
+	if cfg.Twilio.CallLength <= 0 {
+		errs = append(errs, fmt.Errorf("twilio.call_length (TWILIO_CALL_LENGTH) must be positive, is %d", cfg.Twilio.CallLength))
+	}
+
+	// Callback
+	if cfg.Callback.Url == "" && cfg.Callback.NgrokAuthToken == "" {
+		errs = append(errs, errors.New("callback: either url (TWILIO_CALLBACK_URL) or ngrok_authtoken (NGROK_AUTHTOKEN) is required"))
+	}
+	if cfg.Callback.Url != "" {
+		u, err := url.Parse(cfg.Callback.Url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("callback.url (TWILIO_CALLBACK_URL) must be an absolute http(s) URL, is '%s'", cfg.Callback.Url))
+		}
+	}
+	errs = appendIfEmpty(errs, cfg.Callback.ListenAddress, "callback.listen_address (CALLBACK_LISTEN_ADDRESS)")
+	if cfg.Callback.DrainTimeout < 0 {
+		errs = append(errs, fmt.Errorf("callback.drain_timeout (CALLBACK_DRAIN_TIMEOUT) must not be negative, is %s", cfg.Callback.DrainTimeout))
+	}
+	if cfg.Callback.InitiatedTimeout <= 0 || cfg.Callback.CompletionGrace <= 0 || cfg.Callback.TranscriptTimeout <= 0 {
+		errs = append(errs, errors.New("callback: initiated_timeout (CALLBACK_INITIATED_TIMEOUT), completion_grace (CALLBACK_COMPLETION_GRACE) and transcript_timeout (CALLBACK_TRANSCRIPT_TIMEOUT) must be positive"))
+	}
+
+	if cfg.Health.AreaStaleAfter <= 0 {
+		errs = append(errs, fmt.Errorf("health.area_stale_after (HEALTH_AREA_STALE_AFTER) must be positive, is %s", cfg.Health.AreaStaleAfter))
+	}
+
+	// Tracing
+	if !slices.Contains([]string{"", TracingExporterOTLP, TracingExporterStdout}, cfg.Tracing.Exporter) {
+		errs = append(errs, fmt.Errorf("tracing.exporter (TRACING_EXPORTER) must be empty, '%s' or '%s', is '%s'", TracingExporterOTLP, TracingExporterStdout, cfg.Tracing.Exporter))
+	}
+	if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("tracing.sample_ratio (TRACING_SAMPLE_RATIO) must be between 0 and 1, is %g", cfg.Tracing.SampleRatio))
+	}
+
+	// Alerting
+	if cfg.Alerting.EvaluationInterval <= 0 || cfg.Alerting.ExpectedInterval <= 0 {
+		errs = append(errs, errors.New("alerting: evaluation_interval (ALERT_EVALUATION_INTERVAL) and expected_interval (ALERT_EXPECTED_INTERVAL) must be positive"))
+	}
+	if cfg.Alerting.RepeatInterval < 0 {
+		errs = append(errs, fmt.Errorf("alerting.repeat_interval (ALERT_REPEAT_INTERVAL) must not be negative, is %s", cfg.Alerting.RepeatInterval))
+	}
+	if cfg.Alerting.StaleFactor < 1 {
+		errs = append(errs, fmt.Errorf("alerting.stale_factor (ALERT_STALE_FACTOR) must be at least 1, is %g", cfg.Alerting.StaleFactor))
+	}
+	if cfg.Alerting.FailureThreshold < 1 {
+		errs = append(errs, fmt.Errorf("alerting.failure_threshold (ALERT_FAILURE_THRESHOLD) must be positive, is %d", cfg.Alerting.FailureThreshold))
+	}
+	for _, webhookUrl := range SplitList(cfg.Alerting.WebhookUrls) {
+		u, err := url.Parse(webhookUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			// The URL is not printed, as it usually contains a token
+			errs = append(errs, errors.New("alerting.webhook_urls (ALERT_WEBHOOK_URLS) must be absolute http(s) URLs"))
+			break
+		}
+	}
+
+	if cfg.Monitor.Workers < 1 {
+		errs = append(errs, fmt.Errorf("monitor.workers (MONITOR_WORKERS) must be positive, is %d", cfg.Monitor.Workers))
+	}
+
+	// Retry
+	if cfg.Retry.InitialDelay <= 0 || cfg.Retry.MaxDelay < cfg.Retry.InitialDelay {
+		errs = append(errs, errors.New("retry: initial_delay (RETRY_INITIAL_DELAY) must be positive and not exceed max_delay (RETRY_MAX_DELAY)"))
+	}
+	if cfg.Retry.Multiplier < 1 {
+		errs = append(errs, fmt.Errorf("retry.multiplier (RETRY_MULTIPLIER) must be at least 1, is %g", cfg.Retry.Multiplier))
+	}
+	if cfg.Retry.Jitter < 0 || cfg.Retry.Jitter >= 1 {
+		errs = append(errs, fmt.Errorf("retry.jitter (RETRY_JITTER) must be at least 0 and below 1, is %g", cfg.Retry.Jitter))
+	}
+	if cfg.Retry.MaxAttempts < 1 || cfg.Retry.MaxAttempts > math.MaxInt8 {
+		errs = append(errs, fmt.Errorf("retry.max_attempts (RETRY_MAX_ATTEMPTS) must be between 1 and %d, is %d", math.MaxInt8, cfg.Retry.MaxAttempts))
+	}
+	if cfg.Retry.CoolOff <= 0 || cfg.Retry.ResetAfter <= 0 {
+		errs = append(errs, errors.New("retry: cool_off (RETRY_COOL_OFF) and reset_after (RETRY_RESET_AFTER) must be positive"))
+	}
+
+	// AI
+	errs = appendIfEmpty(errs, cfg.AI.Model, "ai.model (GOOGLE_AI_MODEL)")
+	if cfg.AI.UseVertexAI {
+		if cfg.AI.ApiKey == "" && (cfg.AI.Project == "" || cfg.AI.Location == "") {
+			errs = append(errs, errors.New("ai: Vertex AI requires either api_key (GOOGLE_API_KEY) or project and location (GOOGLE_CLOUD_PROJECT, GOOGLE_CLOUD_LOCATION)"))
+		}
+	} else {
+		errs = appendIfEmpty(errs, cfg.AI.ApiKey, "ai.api_key (GOOGLE_API_KEY or GEMINI_API_KEY)")
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validates only what is needed to access the database, e.g. for migrations
+func (cfg Config) ValidateDatabase() error {
+	return errors.Join(append(cfg.validateDatabase(), cfg.validateLogging()...)...)
+}
+
+func (cfg Config) validateLogging() []error {
+	var errs []error
+	if !slices.Contains([]string{LogFormatText, LogFormatJSON}, cfg.Logging.Format) {
+		errs = append(errs, fmt.Errorf("logging.format (LOG_FORMAT) must be '%s' or '%s', is '%s'", LogFormatText, LogFormatJSON, cfg.Logging.Format))
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Logging.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("logging.level (LOG_LEVEL) is invalid: %w", err))
+	}
+	if _, err := ParseLogLevels(cfg.Logging.Levels); err != nil {
+		errs = append(errs, fmt.Errorf("logging.levels (LOG_LEVELS) is invalid: %w", err))
+	}
+
+	if cfg.Logging.File != "" && (cfg.Logging.FileMaxSizeMB <= 0 || cfg.Logging.FileMaxBackups < 0 || cfg.Logging.FileMaxAge < 0) {
+		errs = append(errs, errors.New("logging: file_max_size_mb (LOG_FILE_MAX_SIZE_MB) must be positive, file_max_backups and file_max_age must not be negative"))
+	}
+
+	return errs
+}
+
+// Splits a comma separated list, dropping empty entries
+func SplitList(value string) []string {
+	var result []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
+
+// Parses per component levels, e.g. "DB=warn,CALLBACK=debug". Components are case insensitive.
+func ParseLogLevels(value string) (map[string]slog.Level, error) {
+	result := make(map[string]slog.Level)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		component, levelName, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(component) == "" {
+			return nil, fmt.Errorf("'%s' is not of the form <component>=<level>", entry)
+		}
+
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(strings.TrimSpace(levelName))); err != nil {
+			return nil, err
+		}
+		result[strings.ToUpper(strings.TrimSpace(component))] = level
+	}
+
+	return result, nil
+}
+
+func (cfg Config) validateDatabase() []error {
+	var errs []error
+	switch cfg.Database.Driver {
+	case DriverMongo:
+		errs = appendIfEmpty(errs, cfg.Mongo.Host, "mongo.host (MONGO_HOST)")
+		errs = appendIfEmpty(errs, cfg.Mongo.Port, "mongo.port (MONGO_PORT)")
+		errs = appendIfEmpty(errs, cfg.Mongo.Username, "mongo.user (MONGO_USER)")
+		errs = appendIfEmpty(errs, cfg.Mongo.Password, "mongo.password (MONGO_PASSWORD)")
+		errs = appendIfEmpty(errs, cfg.Mongo.Database, "mongo.database (MONGODB_DATABASE)")
+	case DriverSqlite:
+		errs = appendIfEmpty(errs, cfg.Database.SqlitePath, "database.sqlite_path (SQLITE_PATH)")
+	default:
+		errs = append(errs, fmt.Errorf("database.driver (DB_DRIVER) must be '%s' or '%s', is '%s'", DriverMongo, DriverSqlite, cfg.Database.Driver))
+	}
+
+	return errs
+}
+
+func appendIfEmpty(errs []error, value string, name string) []error {
+	if value == "" {
+		return append(errs, fmt.Errorf("%s is required", name))
+	}
+
+	return errs
+}
+
+// ---------------------------------------------
+// OUTPUT
+
+// Returns a copy with all fields tagged as `secret` replaced, unless they are empty
+func (cfg Config) Redacted() Config {
+	result := cfg
+	redact(reflect.ValueOf(&result).Elem())
+	return result
+}
+
+func redact(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			redact(v.Field(i))
+		} else if field.Tag.Get("secret") == "true" && v.Field(i).String() != "" {
+			v.Field(i).SetString(redacted)
+		}
+	}
+}
+
+// Renders the configuration as YAML, with secrets redacted
+func (cfg Config) String() string {
+	o, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		return err.Error()
+	}
+
+	return string(o)
+}
@@ -2,14 +2,33 @@ package configuration
 
 import (
 	"fmt"
-	"log/slog"
 	"net/url"
-	"os"
-	"strconv"
+	"sync"
+	"time"
+)
 
-	"github.com/thisisnttheway/hx-monitor/logger"
+// Configuration in use, set up by Use()
+var (
+	current   Config
+	currentMu sync.RWMutex
 )
 
+// Makes a loaded configuration available to all packages
+func Use(cfg Config) {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+
+	current = cfg
+}
+
+// Returns the configuration in use
+func Current() Config {
+	currentMu.RLock()
+	defer currentMu.RUnlock()
+
+	return current
+}
+
 // --------------------------
 // CALLBACK
 type UrlConfig struct {
@@ -18,153 +37,252 @@ type UrlConfig struct {
 	Recordings     string
 }
 
-var (
-	CallbackUrl string
-	UrlConfigs  UrlConfig = UrlConfig{
-		Calls:          "/calls",
-		Transcriptions: "/transcription",
-		Recordings:     "/recording",
-	}
-)
+// Paths of the callback server
+var UrlConfigs UrlConfig = UrlConfig{
+	Calls:          "/calls",
+	Transcriptions: "/transcription",
+	Recordings:     "/recording",
+}
+
+type CallbackConfiguration struct {
+	// Publicly accessible base URL of the callback server. If unset, ngrok is used instead.
+	Url            string `yaml:"url" toml:"url" env:"TWILIO_CALLBACK_URL" envDeprecated:"TWILIO_API_CALLBACK_URL"`
+	NgrokAuthToken string `yaml:"ngrok_authtoken" toml:"ngrok_authtoken" env:"NGROK_AUTHTOKEN" secret:"true"`
+	ListenAddress  string `yaml:"listen_address" toml:"listen_address" env:"CALLBACK_LISTEN_ADDRESS"`
+
+	// How long to wait on shutdown for the callbacks of ongoing calls
+	DrainTimeout time.Duration `yaml:"drain_timeout" toml:"drain_timeout" env:"CALLBACK_DRAIN_TIMEOUT"`
 
-func SetCallbackUrl(value string) {
-	CallbackUrl = value
+	// A call is failed if Twilio reports no status within InitiatedTimeout of placing it, if it does not complete
+	// within its time limit plus CompletionGrace, or if its transcript is missing TranscriptTimeout after it completed
+	InitiatedTimeout  time.Duration `yaml:"initiated_timeout" toml:"initiated_timeout" env:"CALLBACK_INITIATED_TIMEOUT"`
+	CompletionGrace   time.Duration `yaml:"completion_grace" toml:"completion_grace" env:"CALLBACK_COMPLETION_GRACE"`
+	TranscriptTimeout time.Duration `yaml:"transcript_timeout" toml:"transcript_timeout" env:"CALLBACK_TRANSCRIPT_TIMEOUT"`
 }
 
-func GetCallbackUrl() string {
-	return CallbackUrl
+func GetCallbackConfig() CallbackConfiguration {
+	return Current().Callback
 }
 
-func IsCallbackurlSet() bool {
-	return CallbackUrl != ""
+func UsesNgrok() bool {
+	return Current().Callback.Url == ""
 }
 
 // --------------------------
 // TWILIO
 type TwilioConfiguration struct {
-	UsePartialTranscriptionResults bool
-	CallLength                     int
-	CallFrom                       string
-	AuthConfig                     TwilioAuth
+	AuthConfig                     TwilioAuth `yaml:"auth" toml:"auth"`
+	CallFrom                       string     `yaml:"call_from" toml:"call_from" env:"TWILIO_CALL_FROM"`
+	CallLength                     int        `yaml:"call_length" toml:"call_length" env:"TWILIO_CALL_LENGTH"`
+	Transcribe                     bool       `yaml:"transcribe" toml:"transcribe" env:"USE_TWILIO_TRANSCRIPTION"`
+	Record                         bool       `yaml:"record" toml:"record" env:"TWILIO_RECORD_CALLS"`
+	UsePartialTranscriptionResults bool       `yaml:"partial_transcriptions" toml:"partial_transcriptions" env:"TWILIO_PARTIAL_TRANSCRIPTIONS"`
 }
 
 type TwilioAuth struct {
-	AccountSid string
-	AuthToken  string
-	ApiKey     string
-	ApiSecret  string
+	AccountSid string `yaml:"account_sid" toml:"account_sid" env:"TWILIO_ACCOUNT_SID"`
+	AuthToken  string `yaml:"auth_token" toml:"auth_token" env:"TWILIO_AUTH_TOKEN" secret:"true"`
+	ApiKey     string `yaml:"api_key" toml:"api_key" env:"TWILIO_API_KEY"`
+	ApiSecret  string `yaml:"api_secret" toml:"api_secret" env:"TWILIO_API_SECRET" secret:"true"`
 }
 
-var twilioConfig TwilioConfiguration
-
 func UsesPartialTranscriptionResults() bool {
-	return twilioConfig.UsePartialTranscriptionResults
-}
-
-func SetPartialTranscriptionResultBool(value bool) {
-	twilioConfig.UsePartialTranscriptionResults = value
+	return Current().Twilio.UsePartialTranscriptionResults
 }
 
 func GetTwilioConfig() TwilioConfiguration {
-	return twilioConfig
+	return Current().Twilio
 }
 
-func SetUpTwilioConfig() {
-	accountSid := os.Getenv("TWILIO_ACCOUNT_SID")
-	if accountSid == "" {
-		logger.LogErrorFatal("CONFIG", "Environment variable TWILIO_ACCOUNT_SID is unset")
-	}
-
-	twilioConfig.AuthConfig.AccountSid = accountSid
-	twilioConfig.AuthConfig.AuthToken = os.Getenv("TWILIO_AUTH_TOKEN")
-	twilioConfig.AuthConfig.ApiKey = os.Getenv("TWILIO_API_KEY")
-	twilioConfig.AuthConfig.ApiSecret = os.Getenv("TWILIO_API_SECRET")
+// --------------------------
+// AI
+type AIConfiguration struct {
+	Model       string `yaml:"model" toml:"model" env:"GOOGLE_AI_MODEL"`
+	UseVertexAI bool   `yaml:"use_vertex_ai" toml:"use_vertex_ai" env:"GOOGLE_GENAI_USE_VERTEXAI"`
+	ApiKey      string `yaml:"api_key" toml:"api_key" env:"GOOGLE_API_KEY,GEMINI_API_KEY" secret:"true"`
+	Project     string `yaml:"project" toml:"project" env:"GOOGLE_CLOUD_PROJECT"`
+	Location    string `yaml:"location" toml:"location" env:"GOOGLE_CLOUD_LOCATION"`
+}
 
-	if twilioConfig.AuthConfig.ApiKey == "" || twilioConfig.AuthConfig.ApiSecret == "" {
-		logger.LogErrorFatal("CONFIG", "Twilio API credentials are (partly) missing in environment variables")
-	}
+func GetAIConfig() AIConfiguration {
+	return Current().AI
+}
 
-	var defaultCallLength int = 38
-	var callLength int
-	s, exists := os.LookupEnv("TWILIO_CALL_LENGTH")
-	if exists {
-		c, err := strconv.Atoi(s)
-		if err != nil {
-			slog.Error("CONFIG", "message", "Failed converting TWILIO_CALL_LENGTH to int", "error", err)
-			callLength = defaultCallLength
-		} else {
-			callLength = c
-		}
-	} else {
-		callLength = defaultCallLength
-	}
+// --------------------------
+// DATABASE
+const (
+	DriverMongo  string = "mongodb"
+	DriverSqlite string = "sqlite"
+)
 
-	slog.Info("CONFIG", "callLength", callLength, "envVarIsSet", exists, "usingDefaultValue", callLength == defaultCallLength)
-	twilioConfig.CallLength = callLength
+type DatabaseConfiguration struct {
+	Driver     string `yaml:"driver" toml:"driver" env:"DB_DRIVER"`
+	SqlitePath string `yaml:"sqlite_path" toml:"sqlite_path" env:"SQLITE_PATH"`
+}
 
-	value := os.Getenv("TWILIO_CALL_FROM")
-	if value == "" {
-		logger.LogErrorFatal("CALLER", "TWILIO_CALL_FROM not set")
-	}
-	twilioConfig.CallFrom = value
+func GetDatabaseConfig() DatabaseConfiguration {
+	return Current().Database
 }
 
-// --------------------------
-// DATABASE
 type MongoConfiguration struct {
-	AuthDatabase string
-	Database     string
-	Username     string
-	Password     string
-	Host         string
-	Port         string
-	Uri          string
+	AuthDatabase string `yaml:"auth_database" toml:"auth_database" env:"MONGODB_AUTH_DATABASE"`
+	Database     string `yaml:"database" toml:"database" env:"MONGODB_DATABASE"`
+	Username     string `yaml:"user" toml:"user" env:"MONGO_USER"`
+	Password     string `yaml:"password" toml:"password" env:"MONGO_PASSWORD" secret:"true"`
+	Host         string `yaml:"host" toml:"host" env:"MONGO_HOST"`
+	Port         string `yaml:"port" toml:"port" env:"MONGO_PORT"`
 }
 
-var mongoConfig MongoConfiguration
-
 func GetMongoConfig() MongoConfiguration {
-	return mongoConfig
+	return Current().Mongo
 }
 
-// Set up MongoDB configuration
-func SetUpMongoConfig() {
-	mongoConfig.AuthDatabase = getEnv("MONGODB_AUTH_DATABASE", "admin")
-	mongoConfig.Database = getEnv("MONGODB_DATABASE", "hx")
-	mongoConfig.Username = getEnv("MONGO_USER", "")
-	mongoConfig.Password = getEnv("MONGO_PASSWORD", "")
-	mongoConfig.Host = getEnv("MONGO_HOST", "")
-	mongoConfig.Port = getEnv("MONGO_PORT", "")
-
-	if mongoConfig.Host == "" || mongoConfig.Port == "" {
-		logger.LogErrorFatal("DB", "MongoDB connection details are missing in environment variables")
-	}
-	if mongoConfig.Username == "" || mongoConfig.Password == "" {
-		logger.LogErrorFatal("DB", "MongoDB connection credentials are missing in environment variables")
-	}
-
+// Connection string including the credentials
+func (m MongoConfiguration) Uri() string {
 	var authDatabase string
-	if mongoConfig.AuthDatabase != "" {
-		authDatabase = fmt.Sprintf("/?authSource=%s", mongoConfig.AuthDatabase)
+	if m.AuthDatabase != "" {
+		authDatabase = fmt.Sprintf("/?authSource=%s", m.AuthDatabase)
 	}
 
-	escapedCredentials := url.UserPassword(mongoConfig.Username, mongoConfig.Password).String()
-	mongoConfig.Uri = fmt.Sprintf(
+	escapedCredentials := url.UserPassword(m.Username, m.Password).String()
+	return fmt.Sprintf(
 		"mongodb://%s@%s:%s%s",
 		escapedCredentials,
-		mongoConfig.Host,
-		mongoConfig.Port,
+		m.Host,
+		m.Port,
 		authDatabase,
 	)
 }
 
-// =================================
-// Get environment variable with a default value
-func getEnv(key string, defaultValue string) string {
-	val, ok := os.LookupEnv(key)
-	if ok {
-		return val
-	} else {
-		return defaultValue
-	}
+// --------------------------
+// METRICS
+type MetricsConfiguration struct {
+	// Address of the /metrics, /healthz and /readyz endpoints, disabled if empty
+	ListenAddress string `yaml:"listen_address" toml:"listen_address" env:"METRICS_LISTEN_ADDRESS"`
+}
+
+// --------------------------
+// HEALTH
+type HealthConfiguration struct {
+	// The monitor is not ready while an area is overdue by more than this
+	AreaStaleAfter time.Duration `yaml:"area_stale_after" toml:"area_stale_after" env:"HEALTH_AREA_STALE_AFTER"`
+}
+
+// --------------------------
+// ALERTING
+type AlertingConfiguration struct {
+	// Comma separated URLs that alerts are posted to as JSON, e.g. Slack incoming webhooks
+	WebhookUrls string `yaml:"webhook_urls" toml:"webhook_urls" env:"ALERT_WEBHOOK_URLS" secret:"true"`
+
+	EvaluationInterval time.Duration `yaml:"evaluation_interval" toml:"evaluation_interval" env:"ALERT_EVALUATION_INTERVAL"`
+
+	// Alerts that are still active are sent again after this, never if 0
+	RepeatInterval time.Duration `yaml:"repeat_interval" toml:"repeat_interval" env:"ALERT_REPEAT_INTERVAL"`
+
+	// An area is stale without a success within this many times its expected interval
+	StaleFactor float64 `yaml:"stale_factor" toml:"stale_factor" env:"ALERT_STALE_FACTOR"`
+
+	// Expected interval of areas that did not announce their next update
+	ExpectedInterval time.Duration `yaml:"expected_interval" toml:"expected_interval" env:"ALERT_EXPECTED_INTERVAL"`
+
+	// Consecutive failures of an area that are alerted
+	FailureThreshold int `yaml:"failure_threshold" toml:"failure_threshold" env:"ALERT_FAILURE_THRESHOLD"`
+}
+
+// --------------------------
+// MONITOR
+type MonitorConfiguration struct {
+	// Areas that are checked at once. Areas with the same number are never called at once.
+	Workers int `yaml:"workers" toml:"workers" env:"MONITOR_WORKERS"`
+}
+
+// --------------------------
+// RETRY
+type RetryConfiguration struct {
+	// Delay after the first failure of an area, multiplied by Multiplier after every further failure
+	InitialDelay time.Duration `yaml:"initial_delay" toml:"initial_delay" env:"RETRY_INITIAL_DELAY"`
+	MaxDelay     time.Duration `yaml:"max_delay" toml:"max_delay" env:"RETRY_MAX_DELAY"`
+	Multiplier   float64       `yaml:"multiplier" toml:"multiplier" env:"RETRY_MULTIPLIER"`
+
+	// Delays are randomly varied by up to this fraction, e.g. 0.2 for ±20%
+	Jitter float64 `yaml:"jitter" toml:"jitter" env:"RETRY_JITTER"`
+
+	// Consecutive failures after which an area is only called again after CoolOff
+	MaxAttempts int           `yaml:"max_attempts" toml:"max_attempts" env:"RETRY_MAX_ATTEMPTS"`
+	CoolOff     time.Duration `yaml:"cool_off" toml:"cool_off" env:"RETRY_COOL_OFF"`
+
+	// Failures are forgotten if an area has not failed for this long
+	ResetAfter time.Duration `yaml:"reset_after" toml:"reset_after" env:"RETRY_RESET_AFTER"`
+}
+
+func GetRetryConfig() RetryConfiguration {
+	return Current().Retry
+}
+
+// --------------------------
+// LOGGING
+const (
+	LogFormatText string = "text"
+	LogFormatJSON string = "json"
+)
+
+type LoggingConfiguration struct {
+	// "text" or "json"
+	Format string `yaml:"format" toml:"format" env:"LOG_FORMAT"`
+
+	// debug, info, warn or error
+	Level string `yaml:"level" toml:"level" env:"LOG_LEVEL"`
+
+	// Levels of individual components, e.g. "DB=warn,CALLBACK=debug"
+	Levels string `yaml:"levels" toml:"levels" env:"LOG_LEVELS"`
+
+	// Logs are written to this file as well, if set
+	File           string        `yaml:"file" toml:"file" env:"LOG_FILE"`
+	FileMaxSizeMB  int           `yaml:"file_max_size_mb" toml:"file_max_size_mb" env:"LOG_FILE_MAX_SIZE_MB"`
+	FileMaxBackups int           `yaml:"file_max_backups" toml:"file_max_backups" env:"LOG_FILE_MAX_BACKUPS"`
+	FileMaxAge     time.Duration `yaml:"file_max_age" toml:"file_max_age" env:"LOG_FILE_MAX_AGE"`
+
+	// Address of the monitor's /loglevel endpoint, disabled if empty. It is not authenticated, so keep it on localhost.
+	ControlListenAddress string `yaml:"control_listen_address" toml:"control_listen_address" env:"LOG_CONTROL_LISTEN_ADDRESS"`
+}
+
+// --------------------------
+// TRACING
+const (
+	TracingExporterOTLP   string = "otlp"
+	TracingExporterStdout string = "stdout"
+)
+
+type TracingConfiguration struct {
+	// "otlp", "stdout" or empty to disable tracing
+	Exporter string `yaml:"exporter" toml:"exporter" env:"TRACING_EXPORTER"`
+
+	// host:port of an OTLP/HTTP collector. If empty, OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4318 is used.
+	Endpoint string `yaml:"endpoint" toml:"endpoint" env:"TRACING_OTLP_ENDPOINT"`
+
+	// Sends spans over HTTP instead of HTTPS, e.g. to a local collector
+	Insecure bool `yaml:"insecure" toml:"insecure" env:"TRACING_OTLP_INSECURE"`
+
+	// Fraction of area checks that are traced, between 0 and 1
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio" env:"TRACING_SAMPLE_RATIO"`
+}
+
+// --------------------------
+// SECRETS
+type SecretsConfiguration struct {
+	// File encrypted with `monitor secrets encrypt`
+	File            string             `yaml:"file" toml:"file" env:"SECRETS_FILE"`
+	Key             string             `yaml:"key" toml:"key" env:"SECRETS_KEY" secret:"true"`
+	Vault           VaultConfiguration `yaml:"vault" toml:"vault"`
+	RefreshInterval time.Duration      `yaml:"refresh_interval" toml:"refresh_interval" env:"SECRETS_REFRESH_INTERVAL"`
+}
+
+// A KV secrets engine (v1 or v2) of HashiCorp Vault or a compatible server, e.g. OpenBao
+type VaultConfiguration struct {
+	Address   string `yaml:"address" toml:"address" env:"VAULT_ADDR"`
+	Token     string `yaml:"token" toml:"token" env:"VAULT_TOKEN" secret:"true"`
+	Namespace string `yaml:"namespace" toml:"namespace" env:"VAULT_NAMESPACE"`
+
+	// API path of the secret, e.g. "secret/data/hx-monitor" for KV v2
+	Path string `yaml:"path" toml:"path" env:"VAULT_SECRET_PATH"`
 }
@@ -0,0 +1,69 @@
+package configuration
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"time"
+)
+
+// Reloads the configuration every secrets.refresh_interval until ctx is done, so that rotated secrets are picked up.
+// A configuration that fails to load or validate is logged and ignored, the previous one stays in use.
+// onChange is called after a changed configuration has been put to use.
+func Watch(ctx context.Context, path string, validate func(Config) error, onChange func(previous Config, next Config)) {
+	interval := Current().Secrets.RefreshInterval
+	if interval <= 0 {
+		slog.Debug("CONFIG", "action", "watch", "message", "Reloading is disabled")
+		return
+	}
+
+	slog.Info("CONFIG", "action", "watch", "interval", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		next, err := Load(path)
+		if err == nil {
+			err = validate(next)
+		}
+		if err != nil {
+			slog.Error("CONFIG", "action", "reload", "message", "Keeping previous configuration", "error", err)
+			continue
+		}
+
+		previous := Current()
+		if next == previous {
+			continue
+		}
+
+		Use(next)
+		slog.Info("CONFIG", "action", "reload", "changedSections", changedSections(previous, next))
+		if onChange != nil {
+			onChange(previous, next)
+		}
+
+		if next.Secrets.RefreshInterval > 0 && next.Secrets.RefreshInterval != interval {
+			interval = next.Secrets.RefreshInterval
+			ticker.Reset(interval)
+		}
+	}
+}
+
+// Returns the names of the top level sections that differ, without their values
+func changedSections(a Config, b Config) []string {
+	var result []string
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := 0; i < va.NumField(); i++ {
+		if va.Field(i).Interface() != vb.Field(i).Interface() {
+			result = append(result, va.Type().Field(i).Tag.Get("yaml"))
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,173 @@
+package configuration
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const secretsFetchTimeout time.Duration = 10 * time.Second
+
+// A source of secrets, keyed by the name of the env var they replace, e.g. MONGO_PASSWORD
+type SecretProvider interface {
+	Name() string
+
+	// Returns all secrets known to the provider. Secrets it does not know of are simply missing.
+	Fetch(ctx context.Context) (map[string]string, error)
+}
+
+// Returns the providers set up in the configuration, in ascending precedence
+func secretProviders(config SecretsConfiguration) ([]SecretProvider, error) {
+	var providers []SecretProvider
+	if config.File != "" {
+		if config.Key == "" {
+			return nil, errors.New("secrets.key (SECRETS_KEY) is required to decrypt secrets.file (SECRETS_FILE)")
+		}
+		providers = append(providers, encryptedFileProvider{path: config.File, key: config.Key})
+	}
+
+	if config.Vault.Address != "" {
+		if config.Vault.Token == "" || config.Vault.Path == "" {
+			return nil, errors.New("secrets.vault requires token (VAULT_TOKEN) and path (VAULT_SECRET_PATH)")
+		}
+		providers = append(providers, newVaultProvider(config.Vault))
+	}
+
+	return providers, nil
+}
+
+// Merges the secrets of all configured providers, later providers take precedence
+func fetchSecrets(config SecretsConfiguration) (map[string]string, error) {
+	providers, err := secretProviders(config)
+	if err != nil || len(providers) == 0 {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), secretsFetchTimeout)
+	defer cancel()
+
+	result := make(map[string]string)
+	for _, provider := range providers {
+		secrets, err := provider.Fetch(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch secrets from %s: %w", provider.Name(), err)
+		}
+
+		slog.Debug("CONFIG", "action", "fetchSecrets", "provider", provider.Name(), "amount", len(secrets))
+		for k, v := range secrets {
+			result[k] = v
+		}
+	}
+
+	return result, nil
+}
+
+// ---------------------------------------------
+// ENCRYPTED FILE
+
+// A YAML map of secrets, encrypted with AES-256-GCM and base64 encoded.
+// The nonce precedes the ciphertext.
+type encryptedFileProvider struct {
+	path string
+	key  string
+}
+
+func (p encryptedFileProvider) Name() string {
+	return "file " + p.path
+}
+
+func (p encryptedFileProvider) Fetch(ctx context.Context) (map[string]string, error) {
+	content, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := decrypt(p.key, strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make(map[string]string)
+	if err := yaml.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, fmt.Errorf("decrypted content is not a YAML map: %w", err)
+	}
+
+	return secrets, nil
+}
+
+// Returns a random key for EncryptSecrets, base64 encoded
+func GenerateSecretsKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Encrypts a YAML map of secrets for use as secrets.file
+func EncryptSecrets(key string, plaintext []byte) (string, error) {
+	secrets := make(map[string]string)
+	if err := yaml.Unmarshal(plaintext, &secrets); err != nil {
+		return "", fmt.Errorf("secrets must be a YAML map of env var names to values: %w", err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func decrypt(key string, encoded string) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("file is not base64 encoded: %w", err)
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("file is too short")
+	}
+
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("could not decrypt, wrong key or corrupted file")
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(key string) (cipher.AEAD, error) {
+	rawKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(rawKey) != 32 {
+		return nil, errors.New("key must be 32 bytes, base64 encoded")
+	}
+
+	block, err := aes.NewCipher(rawKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
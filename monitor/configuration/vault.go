@@ -0,0 +1,74 @@
+package configuration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Reads a secret of a KV secrets engine through the HTTP API of Vault or a compatible server
+type vaultProvider struct {
+	config VaultConfiguration
+	client *http.Client
+}
+
+func newVaultProvider(config VaultConfiguration) vaultProvider {
+	return vaultProvider{config: config, client: &http.Client{}}
+}
+
+func (p vaultProvider) Name() string {
+	return "vault " + p.config.Path
+}
+
+func (p vaultProvider) Fetch(ctx context.Context) (map[string]string, error) {
+	url := strings.TrimRight(p.config.Address, "/") + "/v1/" + strings.TrimLeft(p.config.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-Vault-Token", p.config.Token)
+	if p.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.config.Namespace)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var result struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("could not decode response: %w", err)
+	}
+
+	// KV v2 nests the secret alongside its metadata
+	data := result.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, hasMetadata := data["metadata"]; hasMetadata {
+			data = nested
+		}
+	}
+
+	secrets := make(map[string]string, len(data))
+	for k, v := range data {
+		if s, ok := v.(string); ok {
+			secrets[k] = s
+		} else if v != nil {
+			secrets[k] = fmt.Sprint(v)
+		}
+	}
+
+	return secrets, nil
+}
@@ -2,142 +2,94 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log/slog"
 	"time"
 
 	c "github.com/thisisnttheway/hx-monitor/configuration"
-	"github.com/thisisnttheway/hx-monitor/logger"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
-	client         *mongo.Client
-	contextTimeout time.Duration = 6 * time.Second
-)
+	// Returned when a query that expects a result matched nothing
+	ErrNotFound = errors.New("not found")
 
-func init() {
-	c.SetUpMongoConfig()
-}
+	// Returned when the database cannot be reached, as opposed to a query failing
+	ErrUnavailable = errors.New("database unavailable")
 
-func Connect() *mongo.Client {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	slog.Info("DB",
-		"action", "connect",
-		"host", c.GetMongoConfig().Host,
-		"port", c.GetMongoConfig().Port,
-		"authDatbase", c.GetMongoConfig().AuthDatabase,
-	)
-
-	var err error
-	client, err = mongo.Connect(ctx, options.Client().ApplyURI(c.GetMongoConfig().Uri))
-	if err != nil {
-		logger.LogErrorFatal("DB", fmt.Sprintf("Error while connecting: %v", err.Error()))
-	}
+	// Returned when an operation is attempted before Connect() succeeded
+	ErrNotConnected = errors.New("not connected to database")
 
-	cmd, result := bson.D{{"ping", 1}}, bson.D{}
-	if err := client.Database("admin").RunCommand(ctx, cmd).Decode(&result); err != nil {
-		logger.LogErrorFatal("DB", fmt.Sprintf("DB unreachable: %v", err))
-	}
+	// Returned when the selected driver does not support an operation
+	ErrUnsupported = errors.New("not supported by database driver")
+)
 
-	slog.Info("DB", "action", "connect", "success", true)
-	return client
-}
+// Applied to operations whose context has no deadline of its own
+var contextTimeout time.Duration = 6 * time.Second
 
-// Insert single document into database
-func InsertDocument(colName string, document interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), contextTimeout)
-	defer cancel()
+// Returns the name of the selected database driver
+func Driver() string {
+	return c.GetDatabaseConfig().Driver
+}
 
-	collection := client.Database(c.GetMongoConfig().Database).Collection(colName)
-	_, err := collection.InsertOne(ctx, document)
-	if err != nil {
-		slog.Error("DB", "error", fmt.Sprintf("Failed to insert document: %v", err))
-		return err
+// Connect to the configured database and set up the repositories
+func Connect(ctx context.Context) error {
+	switch Driver() {
+	case c.DriverMongo:
+		if err := connectMongo(ctx); err != nil {
+			return err
+		}
+		useMongoRepos()
+	case c.DriverSqlite:
+		if err := connectSqlite(ctx); err != nil {
+			return err
+		}
+		useSqliteRepos()
+	default:
+		return fmt.Errorf("unknown database driver '%s'", Driver())
 	}
 
-	slog.Debug("DB", "action", "insertDocument", "colName", colName, "document", document)
 	return nil
 }
 
-// Insert many documents into database
-func InsertDocuments(colName string, documents []interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), contextTimeout)
-	defer cancel()
-
-	collection := client.Database(c.GetMongoConfig().Database).Collection(colName)
-	_, err := collection.InsertMany(ctx, documents)
-	if err != nil {
-		slog.Error("DB", "error", fmt.Sprintf("Failed to insert documents: %v", err))
-		return err
+// Disconnect from the database
+func Disconnect(ctx context.Context) error {
+	switch Driver() {
+	case c.DriverMongo:
+		return disconnectMongo(ctx)
+	case c.DriverSqlite:
+		return disconnectSqlite()
 	}
 
-	slog.Info("DB", "action", "insertDocuments", "colName", colName, "documents", documents)
 	return nil
 }
 
-// Update a document in the database
-func UpdateDocument(colName string, filter interface{}, update interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), contextTimeout)
-	defer cancel()
-
-	collection := client.Database(c.GetMongoConfig().Database).Collection(colName)
-	_, err := collection.UpdateOne(ctx, filter, update)
-	if err != nil {
-		slog.Error("DB", "error", fmt.Sprintf("Failed to update document: %v", err))
-		return err
+// Reconnect with the current configuration, e.g. after credentials were rotated.
+// Only needed for drivers that authenticate.
+func Reconnect(ctx context.Context) error {
+	if Driver() == c.DriverMongo {
+		return reconnectMongo(ctx)
 	}
 
-	slog.Debug("DB", "action", "updateDocument", "colName", colName, "filter", filter, "document", update)
 	return nil
 }
 
-// Perform an aggregation operation
-func Aggregate[T any](colName string, pipeline mongo.Pipeline) ([]T, error) {
-	var results []T
-	ctx, cancel := context.WithTimeout(context.Background(), contextTimeout)
-	defer cancel()
-
-	collection := client.Database(c.GetMongoConfig().Database).Collection(colName)
-	cursor, err := collection.Aggregate(ctx, pipeline)
-	if err != nil {
-		slog.Error("DB", "error", fmt.Sprintf("Error querying document: %v", err.Error()))
-		return results, err
-	}
-	defer cursor.Close(ctx)
-
-	if err = cursor.All(ctx, &results); err != nil {
-		return results, err
+// Check whether the database is reachable
+func Ping(ctx context.Context) error {
+	switch Driver() {
+	case c.DriverMongo:
+		return pingMongo(ctx)
+	case c.DriverSqlite:
+		return pingSqlite(ctx)
 	}
 
-	return results, nil
+	return ErrNotConnected
 }
 
-// Get document from database
-func GetDocument[T any](colName string, filter interface{}) ([]T, error) {
-	var results []T
-	ctx, cancel := context.WithTimeout(context.Background(), contextTimeout)
-	defer cancel()
-
-	collection := client.Database(c.GetMongoConfig().Database).Collection(colName)
-	cursor, err := collection.Find(ctx, filter)
-	if err != nil {
-		slog.Error("DB", "error", fmt.Sprintf("Error querying document: %v", err.Error()))
-		return results, err
-	}
-	defer cursor.Close(ctx)
-
-	if err = cursor.All(ctx, &results); err != nil {
-		logger.LogErrorFatal("DB", fmt.Sprintf("Problem with MongoDB cursor: %v", err.Error()))
-	}
-
-	if len(results) == 0 {
-		err = fmt.Errorf("the database returned nothing for the given query: %v", filter)
+// Derives a context with the default timeout, unless the given context already has a deadline
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, hasDeadline := ctx.Deadline(); hasDeadline {
+		return context.WithCancel(ctx)
 	}
 
-	return results, err
+	return context.WithTimeout(ctx, contextTimeout)
 }
@@ -0,0 +1,361 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	c "github.com/thisisnttheway/hx-monitor/configuration"
+	"github.com/thisisnttheway/hx-monitor/metrics"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// Swapped as a whole when reconnecting, so that it can be used concurrently
+var client atomic.Pointer[mongo.Client]
+
+// Connect to MongoDB and verify the connection with a ping
+func connectMongo(ctx context.Context) error {
+	newClient, err := newMongoClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	client.Store(newClient)
+	slog.Info("DB", "action", "connect", "success", true)
+	return nil
+}
+
+func newMongoClient(ctx context.Context) (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	slog.Info("DB",
+		"action", "connect",
+		"driver", c.DriverMongo,
+		"host", c.GetMongoConfig().Host,
+		"port", c.GetMongoConfig().Port,
+		"authDatbase", c.GetMongoConfig().AuthDatabase,
+	)
+
+	clientOptions := options.Client().ApplyURI(c.GetMongoConfig().Uri()).SetMonitor(commandMonitor)
+	newClient, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error while connecting: %w", err)
+	}
+
+	cmd, result := bson.D{{"ping", 1}}, bson.D{}
+	if err := newClient.Database("admin").RunCommand(ctx, cmd).Decode(&result); err != nil {
+		newClient.Disconnect(context.Background())
+		return nil, fmt.Errorf("DB unreachable: %w", wrapError(err))
+	}
+
+	return newClient, nil
+}
+
+// Records the latency of every command
+var commandMonitor = &event.CommandMonitor{
+	Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+		metrics.DBOperationDuration.WithLabelValues(c.DriverMongo, e.CommandName, "success").Observe(e.Duration.Seconds())
+	},
+	Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+		metrics.DBOperationDuration.WithLabelValues(c.DriverMongo, e.CommandName, "error").Observe(e.Duration.Seconds())
+	},
+}
+
+// Connects with the current configuration, e.g. after credentials were rotated.
+// The previous client is kept if connecting fails, otherwise it is closed once in-flight operations had time to finish.
+func reconnectMongo(ctx context.Context) error {
+	newClient, err := newMongoClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	previous := client.Swap(newClient)
+	slog.Info("DB", "action", "reconnect", "success", true)
+	if previous != nil {
+		time.AfterFunc(contextTimeout, func() {
+			previous.Disconnect(context.Background())
+		})
+	}
+
+	return nil
+}
+
+func disconnectMongo(ctx context.Context) error {
+	current := client.Load()
+	if current == nil {
+		return nil
+	}
+
+	return current.Disconnect(ctx)
+}
+
+func pingMongo(ctx context.Context) error {
+	current := client.Load()
+	if current == nil {
+		return ErrNotConnected
+	}
+
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	cmd, result := bson.D{{"ping", 1}}, bson.D{}
+	return wrapError(current.Database("admin").RunCommand(ctx, cmd).Decode(&result))
+}
+
+// Marks errors caused by an unreachable database with ErrUnavailable
+func wrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var selectionErr topology.ServerSelectionError
+	if errors.As(err, &selectionErr) ||
+		mongo.IsNetworkError(err) ||
+		mongo.IsTimeout(err) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, mongo.ErrClientDisconnected) {
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+
+	return err
+}
+
+func collection(colName string) (*mongo.Collection, error) {
+	database, err := Database()
+	if err != nil {
+		return nil, err
+	}
+
+	return database.Collection(colName), nil
+}
+
+// Returns the MongoDB database, e.g. for schema management
+func Database() (*mongo.Database, error) {
+	if Driver() != c.DriverMongo {
+		return nil, ErrUnsupported
+	}
+	current := client.Load()
+	if current == nil {
+		return nil, ErrNotConnected
+	}
+
+	return current.Database(c.GetMongoConfig().Database), nil
+}
+
+// Insert single document into database
+func InsertDocument(ctx context.Context, colName string, document interface{}) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	col, err := collection(colName)
+	if err != nil {
+		return err
+	}
+
+	_, err = col.InsertOne(ctx, document)
+	if err != nil {
+		slog.Error("DB", "error", fmt.Sprintf("Failed to insert document: %v", err))
+		return wrapError(err)
+	}
+
+	slog.Debug("DB", "action", "insertDocument", "colName", colName, "document", document)
+	return nil
+}
+
+// Insert many documents into database
+func InsertDocuments(ctx context.Context, colName string, documents []interface{}) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	col, err := collection(colName)
+	if err != nil {
+		return err
+	}
+
+	_, err = col.InsertMany(ctx, documents)
+	if err != nil {
+		slog.Error("DB", "error", fmt.Sprintf("Failed to insert documents: %v", err))
+		return wrapError(err)
+	}
+
+	slog.Info("DB", "action", "insertDocuments", "colName", colName, "documents", documents)
+	return nil
+}
+
+// Update a document in the database. Returns ErrNotFound if the filter matched nothing.
+func UpdateDocument(ctx context.Context, colName string, filter interface{}, update interface{}) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	col, err := collection(colName)
+	if err != nil {
+		return err
+	}
+
+	result, err := col.UpdateOne(ctx, filter, update)
+	if err != nil {
+		slog.Error("DB", "error", fmt.Sprintf("Failed to update document: %v", err))
+		return wrapError(err)
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("%w: no document in '%s' matches %v", ErrNotFound, colName, filter)
+	}
+
+	slog.Debug("DB", "action", "updateDocument", "colName", colName, "filter", filter, "document", update)
+	return nil
+}
+
+// Update a document in the database, inserting it if the filter matches nothing
+func UpsertDocument(ctx context.Context, colName string, filter interface{}, update interface{}) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	col, err := collection(colName)
+	if err != nil {
+		return err
+	}
+
+	_, err = col.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		slog.Error("DB", "error", fmt.Sprintf("Failed to upsert document: %v", err))
+		return wrapError(err)
+	}
+
+	slog.Debug("DB", "action", "upsertDocument", "colName", colName, "filter", filter, "document", update)
+	return nil
+}
+
+// Delete a single document from the database. Returns ErrNotFound if the filter matched nothing.
+func DeleteDocument(ctx context.Context, colName string, filter interface{}) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	col, err := collection(colName)
+	if err != nil {
+		return err
+	}
+
+	result, err := col.DeleteOne(ctx, filter)
+	if err != nil {
+		slog.Error("DB", "error", fmt.Sprintf("Failed to delete document: %v", err))
+		return wrapError(err)
+	}
+	if result.DeletedCount == 0 {
+		return fmt.Errorf("%w: no document in '%s' matches %v", ErrNotFound, colName, filter)
+	}
+
+	slog.Debug("DB", "action", "deleteDocument", "colName", colName, "filter", filter)
+	return nil
+}
+
+// Count documents matching a filter
+func CountDocuments(ctx context.Context, colName string, filter interface{}) (int64, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	col, err := collection(colName)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := col.CountDocuments(ctx, filter)
+	if err != nil {
+		slog.Error("DB", "error", fmt.Sprintf("Failed to count documents: %v", err))
+		return 0, wrapError(err)
+	}
+
+	return count, nil
+}
+
+// Get documents from the database, sorted and limited. A limit of 0 means no limit.
+// An empty result is not an error.
+func FindDocuments[T any](ctx context.Context, colName string, filter interface{}, sort interface{}, limit int64) ([]T, error) {
+	var results []T
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	col, err := collection(colName)
+	if err != nil {
+		return results, err
+	}
+
+	opts := options.Find()
+	if sort != nil {
+		opts.SetSort(sort)
+	}
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+
+	cursor, err := col.Find(ctx, filter, opts)
+	if err != nil {
+		slog.Error("DB", "error", fmt.Sprintf("Error querying documents: %v", err.Error()))
+		return results, wrapError(err)
+	}
+	defer cursor.Close(ctx)
+
+	if err = cursor.All(ctx, &results); err != nil {
+		return results, wrapError(err)
+	}
+
+	return results, nil
+}
+
+// Get a single document from the database. Returns ErrNotFound if the filter matched nothing.
+func FindOne[T any](ctx context.Context, colName string, filter interface{}) (T, error) {
+	var result T
+	results, err := FindDocuments[T](ctx, colName, filter, nil, 1)
+	if err != nil {
+		return result, err
+	}
+	if len(results) == 0 {
+		return result, fmt.Errorf("%w: no document in '%s' matches %v", ErrNotFound, colName, filter)
+	}
+
+	return results[0], nil
+}
+
+// Open a change stream on a collection. The caller must close the stream.
+// Requires MongoDB to run as a replica set.
+func Watch(ctx context.Context, colName string, pipeline mongo.Pipeline) (*mongo.ChangeStream, error) {
+	col, err := collection(colName)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := col.Watch(ctx, pipeline)
+	return stream, wrapError(err)
+}
+
+// Perform an aggregation operation
+func Aggregate[T any](ctx context.Context, colName string, pipeline mongo.Pipeline) ([]T, error) {
+	var results []T
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	col, err := collection(colName)
+	if err != nil {
+		return results, err
+	}
+
+	cursor, err := col.Aggregate(ctx, pipeline)
+	if err != nil {
+		slog.Error("DB", "error", fmt.Sprintf("Error querying document: %v", err.Error()))
+		return results, wrapError(err)
+	}
+	defer cursor.Close(ctx)
+
+	if err = cursor.All(ctx, &results); err != nil {
+		return results, wrapError(err)
+	}
+
+	return results, nil
+}
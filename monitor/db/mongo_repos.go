@@ -0,0 +1,374 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/thisisnttheway/hx-monitor/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func useMongoRepos() {
+	Areas = mongoAreaRepo{}
+	Numbers = mongoNumberRepo{}
+	Calls = mongoCallRepo{}
+	Transcripts = mongoTranscriptRepo{}
+	AuditLog = mongoAuditRepo{}
+	APIKeys = mongoAPIKeyRepo{}
+}
+
+// ---------------------------------------------
+// AREAS
+type mongoAreaRepo struct{}
+
+func (mongoAreaRepo) List(ctx context.Context) ([]models.HXArea, error) {
+	return FindDocuments[models.HXArea](ctx, AreaCollection, bson.M{}, bson.D{{"name", 1}}, 0)
+}
+
+func (mongoAreaRepo) GetByID(ctx context.Context, id primitive.ObjectID) (models.HXArea, error) {
+	return FindOne[models.HXArea](ctx, AreaCollection, bson.M{"_id": id})
+}
+
+func (mongoAreaRepo) GetByName(ctx context.Context, name string) (models.HXArea, error) {
+	return FindOne[models.HXArea](ctx, AreaCollection, bson.M{"name": name})
+}
+
+func (mongoAreaRepo) ListByNumberName(ctx context.Context, numberName string) ([]models.HXArea, error) {
+	return FindDocuments[models.HXArea](ctx, AreaCollection, bson.M{"number_name": numberName}, bson.D{{"name", 1}}, 0)
+}
+
+func (mongoAreaRepo) CountByNumberName(ctx context.Context, numberName string) (int64, error) {
+	return CountDocuments(ctx, AreaCollection, bson.M{"number_name": numberName})
+}
+
+func (mongoAreaRepo) Insert(ctx context.Context, area models.HXArea) error {
+	return InsertDocument(ctx, AreaCollection, area)
+}
+
+func (mongoAreaRepo) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return DeleteDocument(ctx, AreaCollection, bson.M{"_id": id})
+}
+
+func (mongoAreaRepo) SetNumErrors(ctx context.Context, id primitive.ObjectID, numErrors int8) error {
+	return setMongoAreaField(ctx, id, "num_errors", numErrors)
+}
+
+func (mongoAreaRepo) SetNextAction(ctx context.Context, id primitive.ObjectID, nextAction time.Time) error {
+	return setMongoAreaField(ctx, id, "next_action", nextAction)
+}
+
+func (mongoAreaRepo) SetLastAction(ctx context.Context, id primitive.ObjectID, lastAction time.Time) error {
+	return setMongoAreaField(ctx, id, "last_action", lastAction)
+}
+
+func (mongoAreaRepo) SetPaused(ctx context.Context, id primitive.ObjectID, paused bool) error {
+	return setMongoAreaField(ctx, id, "paused", paused)
+}
+
+func (mongoAreaRepo) SetSubAreas(ctx context.Context, id primitive.ObjectID, subAreas []models.HXSubArea) error {
+	return setMongoAreaField(ctx, id, "sub_areas", subAreas)
+}
+
+func (mongoAreaRepo) UpdateSettings(ctx context.Context, id primitive.ObjectID, settings AreaSettings) error {
+	fields := bson.D{}
+	if settings.NumberName != nil {
+		fields = append(fields, bson.E{"number_name", *settings.NumberName})
+	}
+	if settings.NextAction != nil {
+		fields = append(fields, bson.E{"next_action", *settings.NextAction})
+	}
+	if settings.Paused != nil {
+		fields = append(fields, bson.E{"paused", *settings.Paused})
+	}
+	if settings.SubAreas != nil {
+		fields = append(fields, bson.E{"sub_areas", *settings.SubAreas})
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return UpdateDocument(ctx, AreaCollection, bson.M{"_id": id}, bson.D{{"$set", fields}})
+}
+
+func (mongoAreaRepo) ResetErrors(ctx context.Context, id primitive.ObjectID) error {
+	return UpdateDocument(ctx, AreaCollection, bson.M{"_id": id}, bson.D{{"$set", bson.D{
+		{"num_errors", 0},
+		{"last_error", ""},
+		{"retry_state", models.RetryNone},
+	}}})
+}
+
+func (mongoAreaRepo) Recheck(ctx context.Context, id primitive.ObjectID, nextAction time.Time) error {
+	return UpdateDocument(ctx, AreaCollection, bson.M{"_id": id}, bson.D{{"$set", bson.D{
+		{"next_action", nextAction},
+		{"num_errors", 0},
+		{"retry_state", models.RetryNone},
+	}}})
+}
+
+func (mongoAreaRepo) SetFailure(ctx context.Context, area models.HXArea) error {
+	return UpdateDocument(ctx, AreaCollection, bson.M{"_id": area.ID}, bson.D{{"$set", mongoFailureFields(area)}})
+}
+
+func (mongoAreaRepo) SetParseResult(ctx context.Context, area models.HXArea) error {
+	return UpdateDocument(ctx, AreaCollection, bson.M{"_id": area.ID}, bson.D{{"$set", append(mongoFailureFields(area),
+		bson.E{"sub_areas", area.SubAreas},
+		bson.E{"flight_operating_hours", area.FlightOperatingHours},
+		bson.E{"last_success", area.LastSuccess},
+	)}})
+}
+
+func mongoFailureFields(area models.HXArea) bson.D {
+	return bson.D{
+		{"last_action_success", area.LastActionSuccess},
+		{"last_error", area.LastError},
+		{"num_errors", area.NumErrors},
+		{"last_failure", area.LastFailure},
+		{"retry_state", area.RetryState},
+		{"next_action", area.NextAction},
+	}
+}
+
+func setMongoAreaField(ctx context.Context, id primitive.ObjectID, field string, value interface{}) error {
+	return UpdateDocument(ctx, AreaCollection, bson.M{"_id": id}, bson.D{{"$set", bson.D{{field, value}}}})
+}
+
+func (mongoAreaRepo) NearestNextAction(ctx context.Context) (time.Time, error) {
+	type AggregateResult struct {
+		NextAction time.Time `bson:"next_action"`
+	}
+
+	results, err := Aggregate[AggregateResult](ctx, AreaCollection, mongo.Pipeline{
+		bson.D{{"$match", bson.M{"paused": bson.M{"$ne": true}}}},
+		bson.D{{"$sort", bson.D{{"next_action", 1}}}},
+		bson.D{{"$limit", 1}},
+		bson.D{{"$project", bson.D{
+			{"_id", false},
+			{"next_action", true},
+		}}},
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(results) == 0 {
+		return time.Time{}, fmt.Errorf("%w: no area is being monitored", ErrNotFound)
+	}
+
+	return results[0].NextAction, nil
+}
+
+// Relays change stream events, requires MongoDB to run as a replica set
+func (mongoAreaRepo) Watch(ctx context.Context) (<-chan struct{}, error) {
+	stream, err := Watch(ctx, AreaCollection, mongo.Pipeline{})
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(chan struct{})
+	go func() {
+		defer close(changes)
+		defer stream.Close(context.Background())
+
+		for stream.Next(ctx) {
+			select {
+			case changes <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if err := stream.Err(); err != nil && ctx.Err() == nil {
+			slog.Warn("DB", "action", "watchAreas", "message", "Change stream ended", "error", err)
+		}
+	}()
+
+	return changes, nil
+}
+
+// ---------------------------------------------
+// NUMBERS
+type mongoNumberRepo struct{}
+
+func (mongoNumberRepo) List(ctx context.Context) ([]models.Number, error) {
+	return FindDocuments[models.Number](ctx, NumberCollection, bson.M{}, bson.D{{"name", 1}}, 0)
+}
+
+func (mongoNumberRepo) GetByID(ctx context.Context, id primitive.ObjectID) (models.Number, error) {
+	return FindOne[models.Number](ctx, NumberCollection, bson.M{"_id": id})
+}
+
+func (mongoNumberRepo) GetByName(ctx context.Context, name string) (models.Number, error) {
+	return FindOne[models.Number](ctx, NumberCollection, bson.M{"name": name})
+}
+
+func (mongoNumberRepo) GetByNumber(ctx context.Context, number string) (models.Number, error) {
+	return FindOne[models.Number](ctx, NumberCollection, bson.M{"number": number})
+}
+
+func (mongoNumberRepo) Insert(ctx context.Context, number models.Number) error {
+	return InsertDocument(ctx, NumberCollection, number)
+}
+
+func (mongoNumberRepo) Update(ctx context.Context, number models.Number) error {
+	return UpdateDocument(ctx, NumberCollection, bson.M{"_id": number.ID}, bson.D{{"$set", number}})
+}
+
+func (mongoNumberRepo) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return DeleteDocument(ctx, NumberCollection, bson.M{"_id": id})
+}
+
+// ---------------------------------------------
+// CALLS
+type mongoCallRepo struct{}
+
+func (mongoCallRepo) Start(ctx context.Context, call models.Call) error {
+	return UpsertDocument(ctx, CallCollection, bson.M{"sid": call.SID}, bson.D{
+		{"$set", bson.D{
+			{"number_id", call.NumberID},
+			{"hx_area_id", call.HXAreaID},
+			{"price", call.Price},
+			{"price_unit", call.PriceUnit},
+			{"updated_at", time.Now()},
+		}},
+		{"$setOnInsert", bson.D{
+			{"_id", call.ID},
+			{"time", call.Time},
+			{"status", call.Status},
+			{"timeline", bson.A{}},
+			{"duration", 0},
+			{"transcript_id", primitive.NilObjectID},
+			{"parse_success", false},
+			{"parse_error", ""},
+		}},
+	})
+}
+
+func (mongoCallRepo) AddEvent(ctx context.Context, sid string, event models.CallEvent, duration int) error {
+	set := bson.D{{"updated_at", time.Now()}}
+	setOnInsert := bson.D{
+		{"_id", primitive.NewObjectID()},
+		{"time", event.Time},
+		{"status", event.Status},
+		{"price", ""},
+		{"price_unit", ""},
+		{"number_id", primitive.NilObjectID},
+		{"hx_area_id", primitive.NilObjectID},
+		{"transcript_id", primitive.NilObjectID},
+		{"parse_success", false},
+		{"parse_error", ""},
+	}
+	if duration > 0 {
+		set = append(set, bson.E{"duration", duration})
+	} else {
+		setOnInsert = append(setOnInsert, bson.E{"duration", 0})
+	}
+
+	err := UpsertDocument(ctx, CallCollection, bson.M{"sid": sid}, bson.D{
+		{"$set", set},
+		{"$setOnInsert", setOnInsert},
+		{"$push", bson.D{{"timeline", event}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = UpdateDocument(ctx, CallCollection,
+		bson.M{"sid": sid, "status": bson.M{"$nin": models.FinishedCallStates}},
+		bson.D{{"$set", bson.D{{"status", event.Status}}}},
+	)
+	if errors.Is(err, ErrNotFound) {
+		// Already finished
+		return nil
+	}
+
+	return err
+}
+
+func (mongoCallRepo) SetParseOutcome(ctx context.Context, sid string, transcriptID primitive.ObjectID, success bool, parseError string) error {
+	return UpdateDocument(ctx, CallCollection, bson.M{"sid": sid}, bson.D{{"$set", bson.D{
+		{"transcript_id", transcriptID},
+		{"parse_success", success},
+		{"parse_error", parseError},
+	}}})
+}
+
+func (mongoCallRepo) GetBySID(ctx context.Context, sid string) (models.Call, error) {
+	return FindOne[models.Call](ctx, CallCollection, bson.M{"sid": sid})
+}
+
+func (mongoCallRepo) GetLatestForArea(ctx context.Context, areaID primitive.ObjectID) (models.Call, error) {
+	calls, err := FindDocuments[models.Call](ctx, CallCollection, bson.M{"hx_area_id": areaID}, bson.D{{"time", -1}}, 1)
+	if err != nil {
+		return models.Call{}, err
+	}
+	if len(calls) == 0 {
+		return models.Call{}, fmt.Errorf("%w: area '%s' has no calls", ErrNotFound, areaID.Hex())
+	}
+
+	return calls[0], nil
+}
+
+// ---------------------------------------------
+// TRANSCRIPTS
+type mongoTranscriptRepo struct{}
+
+func (mongoTranscriptRepo) Insert(ctx context.Context, transcript models.Transcript) error {
+	return InsertDocument(ctx, TranscriptCollection, transcript)
+}
+
+func (mongoTranscriptRepo) ListForArea(ctx context.Context, areaID primitive.ObjectID, limit int64) ([]models.Transcript, error) {
+	return FindDocuments[models.Transcript](ctx, TranscriptCollection, bson.M{"hx_area_id": areaID}, bson.D{{"date", -1}}, limit)
+}
+
+// ---------------------------------------------
+// AUDIT LOG
+type mongoAuditRepo struct{}
+
+func (mongoAuditRepo) Insert(ctx context.Context, entry models.AuditLogEntry) error {
+	return InsertDocument(ctx, AuditCollection, entry)
+}
+
+func (mongoAuditRepo) List(ctx context.Context, target string, actor string, limit int64) ([]models.AuditLogEntry, error) {
+	filter := bson.M{}
+	if target != "" {
+		filter["target"] = target
+	}
+	if actor != "" {
+		filter["actor"] = actor
+	}
+
+	return FindDocuments[models.AuditLogEntry](ctx, AuditCollection, filter, bson.D{{"time", -1}}, limit)
+}
+
+// ---------------------------------------------
+// API KEYS
+type mongoAPIKeyRepo struct{}
+
+func (mongoAPIKeyRepo) List(ctx context.Context) ([]models.APIKey, error) {
+	return FindDocuments[models.APIKey](ctx, APIKeyCollection, bson.M{}, bson.D{{"created_at", -1}}, 0)
+}
+
+func (mongoAPIKeyRepo) GetByID(ctx context.Context, id primitive.ObjectID) (models.APIKey, error) {
+	return FindOne[models.APIKey](ctx, APIKeyCollection, bson.M{"_id": id})
+}
+
+func (mongoAPIKeyRepo) GetActiveByHash(ctx context.Context, keyHash string) (models.APIKey, error) {
+	return FindOne[models.APIKey](ctx, APIKeyCollection, bson.M{"key_hash": keyHash, "revoked": false})
+}
+
+func (mongoAPIKeyRepo) Insert(ctx context.Context, key models.APIKey) error {
+	return InsertDocument(ctx, APIKeyCollection, key)
+}
+
+func (mongoAPIKeyRepo) SetLastUsed(ctx context.Context, id primitive.ObjectID, lastUsed time.Time) error {
+	return UpdateDocument(ctx, APIKeyCollection, bson.M{"_id": id}, bson.D{{"$set", bson.D{{"last_used", lastUsed}}}})
+}
+
+func (mongoAPIKeyRepo) Revoke(ctx context.Context, id primitive.ObjectID) error {
+	return UpdateDocument(ctx, APIKeyCollection, bson.M{"_id": id}, bson.D{{"$set", bson.D{{"revoked", true}}}})
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/thisisnttheway/hx-monitor/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Collections, or tables respectively
+const (
+	AreaCollection       string = "hx_areas"
+	NumberCollection     string = "numbers"
+	CallCollection       string = "calls"
+	TranscriptCollection string = "transcripts"
+	AuditCollection      string = "audit_log"
+	APIKeyCollection     string = "api_keys"
+)
+
+// Repositories of the selected driver, set up by Connect()
+var (
+	Areas       AreaRepo
+	Numbers     NumberRepo
+	Calls       CallRepo
+	Transcripts TranscriptRepo
+	AuditLog    AuditRepo
+	APIKeys     APIKeyRepo
+)
+
+// Fields of an area that admins change together, nil fields are kept
+type AreaSettings struct {
+	NumberName *string
+	NextAction *time.Time
+	Paused     *bool
+	SubAreas   *[]models.HXSubArea
+}
+
+// Getters return ErrNotFound if nothing matches, listings return an empty result instead
+type AreaRepo interface {
+	// Returns all areas, sorted by name
+	List(ctx context.Context) ([]models.HXArea, error)
+	GetByID(ctx context.Context, id primitive.ObjectID) (models.HXArea, error)
+	GetByName(ctx context.Context, name string) (models.HXArea, error)
+
+	// Returns all areas that are checked by calling the given number
+	ListByNumberName(ctx context.Context, numberName string) ([]models.HXArea, error)
+	CountByNumberName(ctx context.Context, numberName string) (int64, error)
+
+	Insert(ctx context.Context, area models.HXArea) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+
+	// Areas are written by the monitor, its callbacks and api-backend at the same time.
+	// Each setter only writes the fields it owns, so that concurrent writes of other fields are kept.
+	SetNumErrors(ctx context.Context, id primitive.ObjectID, numErrors int8) error
+	SetNextAction(ctx context.Context, id primitive.ObjectID, nextAction time.Time) error
+	SetLastAction(ctx context.Context, id primitive.ObjectID, lastAction time.Time) error
+	SetPaused(ctx context.Context, id primitive.ObjectID, paused bool) error
+	SetSubAreas(ctx context.Context, id primitive.ObjectID, subAreas []models.HXSubArea) error
+
+	// Writes the given settings in a single update
+	UpdateSettings(ctx context.Context, id primitive.ObjectID, settings AreaSettings) error
+
+	// Clears num_errors, last_error and retry_state
+	ResetErrors(ctx context.Context, id primitive.ObjectID) error
+
+	// Makes an area due at nextAction with a fresh retry budget, i.e. clears num_errors and retry_state
+	Recheck(ctx context.Context, id primitive.ObjectID, nextAction time.Time) error
+
+	// Stores the outcome of a failed check, i.e. last_action_success, last_error, num_errors, last_failure, retry_state and next_action
+	SetFailure(ctx context.Context, area models.HXArea) error
+
+	// Stores the outcome of a parsed transcript, i.e. the fields of SetFailure,
+	// sub_areas, flight_operating_hours and last_success
+	SetParseResult(ctx context.Context, area models.HXArea) error
+
+	// Returns the earliest next_action of all areas that are not paused
+	NearestNextAction(ctx context.Context) (time.Time, error)
+
+	// Signals changes made to areas by any process until ctx is done.
+	// Returns ErrUnsupported if the driver cannot observe changes.
+	Watch(ctx context.Context) (<-chan struct{}, error)
+}
+
+type NumberRepo interface {
+	// Returns all numbers, sorted by name
+	List(ctx context.Context) ([]models.Number, error)
+	GetByID(ctx context.Context, id primitive.ObjectID) (models.Number, error)
+	GetByName(ctx context.Context, name string) (models.Number, error)
+
+	// Returns a number by its phone number
+	GetByNumber(ctx context.Context, number string) (models.Number, error)
+
+	Insert(ctx context.Context, number models.Number) error
+
+	// Replaces all fields of a number
+	Update(ctx context.Context, number models.Number) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+type CallRepo interface {
+	// Records a call placed for an area. Status callbacks that arrived first are kept.
+	Start(ctx context.Context, call models.Call) error
+
+	// Appends a status event to a call, creating it if it does not exist yet.
+	// The status of a finished call is never replaced. A duration of 0 keeps the current duration.
+	AddEvent(ctx context.Context, sid string, event models.CallEvent, duration int) error
+
+	// Links a call to its transcript and the outcome of parsing it
+	SetParseOutcome(ctx context.Context, sid string, transcriptID primitive.ObjectID, success bool, parseError string) error
+
+	GetBySID(ctx context.Context, sid string) (models.Call, error)
+
+	// Returns the call that was started most recently for an area
+	GetLatestForArea(ctx context.Context, areaID primitive.ObjectID) (models.Call, error)
+}
+
+type TranscriptRepo interface {
+	Insert(ctx context.Context, transcript models.Transcript) error
+
+	// Returns the transcripts of an area, newest first. A limit of 0 means no limit.
+	ListForArea(ctx context.Context, areaID primitive.ObjectID, limit int64) ([]models.Transcript, error)
+}
+
+type AuditRepo interface {
+	Insert(ctx context.Context, entry models.AuditLogEntry) error
+
+	// Returns entries, newest first. Empty filters match everything.
+	List(ctx context.Context, target string, actor string, limit int64) ([]models.AuditLogEntry, error)
+}
+
+type APIKeyRepo interface {
+	// Returns all keys, newest first
+	List(ctx context.Context) ([]models.APIKey, error)
+	GetByID(ctx context.Context, id primitive.ObjectID) (models.APIKey, error)
+
+	// Returns a key that has not been revoked by its hash
+	GetActiveByHash(ctx context.Context, keyHash string) (models.APIKey, error)
+
+	Insert(ctx context.Context, key models.APIKey) error
+	SetLastUsed(ctx context.Context, id primitive.ObjectID, lastUsed time.Time) error
+	Revoke(ctx context.Context, id primitive.ObjectID) error
+}
@@ -0,0 +1,216 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	c "github.com/thisisnttheway/hx-monitor/configuration"
+	"github.com/thisisnttheway/hx-monitor/metrics"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Times are stored as UTC text with a fixed width, so that they sort correctly
+const sqliteTimeLayout string = "2006-01-02T15:04:05.000000000Z"
+
+var sqliteDb *sql.DB
+
+// Open the SQLite database. The schema is set up by the migrate command.
+func connectSqlite(ctx context.Context) error {
+	path := c.GetDatabaseConfig().SqlitePath
+	slog.Info("DB", "action", "connect", "driver", c.DriverSqlite, "path", path)
+
+	// monitor and api-backend may share the database file, WAL lets them read while the other writes
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", path)
+	conn, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return fmt.Errorf("error while opening: %w", err)
+	}
+
+	sqliteDb = conn
+	if err := pingSqlite(ctx); err != nil {
+		return fmt.Errorf("DB unreachable: %w", err)
+	}
+
+	slog.Info("DB", "action", "connect", "success", true)
+	return nil
+}
+
+func disconnectSqlite() error {
+	if sqliteDb == nil {
+		return nil
+	}
+
+	return sqliteDb.Close()
+}
+
+func pingSqlite(ctx context.Context) error {
+	if sqliteDb == nil {
+		return ErrNotConnected
+	}
+
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	return wrapSqliteError(sqliteDb.PingContext(ctx))
+}
+
+// Returns the SQLite database, e.g. for schema management
+func SqliteDB() (*sql.DB, error) {
+	if Driver() != c.DriverSqlite {
+		return nil, ErrUnsupported
+	}
+	if sqliteDb == nil {
+		return nil, ErrNotConnected
+	}
+
+	return sqliteDb, nil
+}
+
+// Maps SQLite errors to the errors of this package
+func wrapSqliteError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+
+	// Another process holding the lock for longer than busy_timeout is as good as unreachable
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		code := sqliteErr.Code() & 0xff
+		if code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED {
+			return fmt.Errorf("%w: %w", ErrUnavailable, err)
+		}
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, sql.ErrConnDone) {
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+
+	return err
+}
+
+// Implemented by both *sql.Row and *sql.Rows
+type sqliteScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Runs a query and scans every row
+func sqliteQuery[T any](ctx context.Context, scan func(sqliteScanner) (T, error), query string, args ...interface{}) ([]T, error) {
+	results := []T{}
+	if sqliteDb == nil {
+		return results, ErrNotConnected
+	}
+
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// Rows are read lazily, so scanning is part of the operation
+	start := time.Now()
+	results, err := scanSqliteRows(ctx, results, scan, query, args...)
+	metrics.DBOperationDuration.WithLabelValues(c.DriverSqlite, "query", metrics.Result(err)).Observe(time.Since(start).Seconds())
+
+	return results, err
+}
+
+func scanSqliteRows[T any](ctx context.Context, results []T, scan func(sqliteScanner) (T, error), query string, args ...interface{}) ([]T, error) {
+	rows, err := sqliteDb.QueryContext(ctx, query, args...)
+	if err != nil {
+		slog.Error("DB", "error", fmt.Sprintf("Error querying rows: %v", err.Error()))
+		return results, wrapSqliteError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		result, err := scan(rows)
+		if err != nil {
+			return results, wrapSqliteError(err)
+		}
+		results = append(results, result)
+	}
+
+	return results, wrapSqliteError(rows.Err())
+}
+
+// Runs a query that is expected to return a single row. Returns ErrNotFound if it returns none.
+func sqliteQueryOne[T any](ctx context.Context, scan func(sqliteScanner) (T, error), query string, args ...interface{}) (T, error) {
+	var result T
+	results, err := sqliteQuery(ctx, scan, query, args...)
+	if err != nil {
+		return result, err
+	}
+	if len(results) == 0 {
+		return result, fmt.Errorf("%w: the database returned nothing for the given query", ErrNotFound)
+	}
+
+	return results[0], nil
+}
+
+// Runs a statement. Returns ErrNotFound if mustAffect is set and no row was affected.
+func sqliteExec(ctx context.Context, mustAffect bool, query string, args ...interface{}) error {
+	if sqliteDb == nil {
+		return ErrNotConnected
+	}
+
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+	result, err := sqliteDb.ExecContext(ctx, query, args...)
+	metrics.DBOperationDuration.WithLabelValues(c.DriverSqlite, "exec", metrics.Result(err)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		slog.Error("DB", "error", fmt.Sprintf("Failed to execute statement: %v", err))
+		return wrapSqliteError(err)
+	}
+
+	if mustAffect {
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return wrapSqliteError(err)
+		}
+		if affected == 0 {
+			return fmt.Errorf("%w: statement affected no rows", ErrNotFound)
+		}
+	}
+
+	return nil
+}
+
+func toSqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+func fromSqliteTime(s string) time.Time {
+	t, err := time.Parse(sqliteTimeLayout, s)
+	if err != nil {
+		slog.Error("DB", "message", "Failed parsing stored time", "source", s, "error", err)
+	}
+
+	return t
+}
+
+func toSqliteJson(v interface{}) string {
+	o, _ := json.Marshal(v)
+	return string(o)
+}
+
+func fromSqliteJson(s string, target interface{}) {
+	if err := json.Unmarshal([]byte(s), target); err != nil {
+		slog.Error("DB", "message", "Failed parsing stored JSON", "source", s, "error", err)
+	}
+}
+
+// IDs are stored as hex strings, so that documents keep their IDs when moved between drivers
+func fromSqliteID(s string) primitive.ObjectID {
+	id, _ := primitive.ObjectIDFromHex(s)
+	return id
+}
@@ -0,0 +1,443 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/thisisnttheway/hx-monitor/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func useSqliteRepos() {
+	Areas = sqliteAreaRepo{}
+	Numbers = sqliteNumberRepo{}
+	Calls = sqliteCallRepo{}
+	Transcripts = sqliteTranscriptRepo{}
+	AuditLog = sqliteAuditRepo{}
+	APIKeys = sqliteAPIKeyRepo{}
+}
+
+// SQLite treats a negative limit as no limit
+func sqliteLimit(limit int64) int64 {
+	if limit <= 0 {
+		return -1
+	}
+
+	return limit
+}
+
+// ---------------------------------------------
+// AREAS
+type sqliteAreaRepo struct{}
+
+const sqliteAreaColumns string = "id, name, number_name, next_action, last_action, last_action_success, last_success, flight_operating_hours, sub_areas, last_error, num_errors, last_failure, retry_state, paused"
+
+func scanSqliteArea(row sqliteScanner) (models.HXArea, error) {
+	var area models.HXArea
+	var id, nextAction, lastAction, lastSuccess, operatingHours, subAreas, lastFailure string
+	err := row.Scan(
+		&id, &area.Name, &area.NumberName, &nextAction, &lastAction, &area.LastActionSuccess, &lastSuccess,
+		&operatingHours, &subAreas, &area.LastError, &area.NumErrors, &lastFailure, &area.RetryState, &area.Paused,
+	)
+
+	area.ID = fromSqliteID(id)
+	area.NextAction = fromSqliteTime(nextAction)
+	area.LastAction = fromSqliteTime(lastAction)
+	area.LastSuccess = fromSqliteTime(lastSuccess)
+	area.LastFailure = fromSqliteTime(lastFailure)
+	fromSqliteJson(operatingHours, &area.FlightOperatingHours)
+	fromSqliteJson(subAreas, &area.SubAreas)
+
+	return area, err
+}
+
+func (sqliteAreaRepo) List(ctx context.Context) ([]models.HXArea, error) {
+	return sqliteQuery(ctx, scanSqliteArea, "SELECT "+sqliteAreaColumns+" FROM hx_areas ORDER BY name")
+}
+
+func (sqliteAreaRepo) GetByID(ctx context.Context, id primitive.ObjectID) (models.HXArea, error) {
+	return sqliteQueryOne(ctx, scanSqliteArea, "SELECT "+sqliteAreaColumns+" FROM hx_areas WHERE id = ?", id.Hex())
+}
+
+func (sqliteAreaRepo) GetByName(ctx context.Context, name string) (models.HXArea, error) {
+	return sqliteQueryOne(ctx, scanSqliteArea, "SELECT "+sqliteAreaColumns+" FROM hx_areas WHERE name = ?", name)
+}
+
+func (sqliteAreaRepo) ListByNumberName(ctx context.Context, numberName string) ([]models.HXArea, error) {
+	return sqliteQuery(ctx, scanSqliteArea, "SELECT "+sqliteAreaColumns+" FROM hx_areas WHERE number_name = ? ORDER BY name", numberName)
+}
+
+func (sqliteAreaRepo) CountByNumberName(ctx context.Context, numberName string) (int64, error) {
+	return sqliteQueryOne(ctx, func(row sqliteScanner) (int64, error) {
+		var count int64
+		return count, row.Scan(&count)
+	}, "SELECT COUNT(*) FROM hx_areas WHERE number_name = ?", numberName)
+}
+
+func (sqliteAreaRepo) Insert(ctx context.Context, area models.HXArea) error {
+	return sqliteExec(ctx, false,
+		"INSERT INTO hx_areas ("+sqliteAreaColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		area.ID.Hex(), area.Name, area.NumberName, toSqliteTime(area.NextAction), toSqliteTime(area.LastAction),
+		area.LastActionSuccess, toSqliteTime(area.LastSuccess), toSqliteJson(area.FlightOperatingHours), toSqliteJson(area.SubAreas),
+		area.LastError, area.NumErrors, toSqliteTime(area.LastFailure), area.RetryState, area.Paused,
+	)
+}
+
+func (sqliteAreaRepo) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return sqliteExec(ctx, true, "DELETE FROM hx_areas WHERE id = ?", id.Hex())
+}
+
+func (sqliteAreaRepo) SetNumErrors(ctx context.Context, id primitive.ObjectID, numErrors int8) error {
+	return sqliteExec(ctx, true, "UPDATE hx_areas SET num_errors = ? WHERE id = ?", numErrors, id.Hex())
+}
+
+func (sqliteAreaRepo) SetNextAction(ctx context.Context, id primitive.ObjectID, nextAction time.Time) error {
+	return sqliteExec(ctx, true, "UPDATE hx_areas SET next_action = ? WHERE id = ?", toSqliteTime(nextAction), id.Hex())
+}
+
+func (sqliteAreaRepo) SetLastAction(ctx context.Context, id primitive.ObjectID, lastAction time.Time) error {
+	return sqliteExec(ctx, true, "UPDATE hx_areas SET last_action = ? WHERE id = ?", toSqliteTime(lastAction), id.Hex())
+}
+
+func (sqliteAreaRepo) SetPaused(ctx context.Context, id primitive.ObjectID, paused bool) error {
+	return sqliteExec(ctx, true, "UPDATE hx_areas SET paused = ? WHERE id = ?", paused, id.Hex())
+}
+
+func (sqliteAreaRepo) SetSubAreas(ctx context.Context, id primitive.ObjectID, subAreas []models.HXSubArea) error {
+	return sqliteExec(ctx, true, "UPDATE hx_areas SET sub_areas = ? WHERE id = ?", toSqliteJson(subAreas), id.Hex())
+}
+
+func (sqliteAreaRepo) UpdateSettings(ctx context.Context, id primitive.ObjectID, settings AreaSettings) error {
+	var columns []string
+	var args []interface{}
+	if settings.NumberName != nil {
+		columns, args = append(columns, "number_name = ?"), append(args, *settings.NumberName)
+	}
+	if settings.NextAction != nil {
+		columns, args = append(columns, "next_action = ?"), append(args, toSqliteTime(*settings.NextAction))
+	}
+	if settings.Paused != nil {
+		columns, args = append(columns, "paused = ?"), append(args, *settings.Paused)
+	}
+	if settings.SubAreas != nil {
+		columns, args = append(columns, "sub_areas = ?"), append(args, toSqliteJson(*settings.SubAreas))
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+
+	return sqliteExec(ctx, true, "UPDATE hx_areas SET "+strings.Join(columns, ", ")+" WHERE id = ?", append(args, id.Hex())...)
+}
+
+func (sqliteAreaRepo) ResetErrors(ctx context.Context, id primitive.ObjectID) error {
+	return sqliteExec(ctx, true,
+		"UPDATE hx_areas SET num_errors = 0, last_error = '', retry_state = ? WHERE id = ?",
+		models.RetryNone, id.Hex(),
+	)
+}
+
+func (sqliteAreaRepo) Recheck(ctx context.Context, id primitive.ObjectID, nextAction time.Time) error {
+	return sqliteExec(ctx, true,
+		"UPDATE hx_areas SET next_action = ?, num_errors = 0, retry_state = ? WHERE id = ?",
+		toSqliteTime(nextAction), models.RetryNone, id.Hex(),
+	)
+}
+
+func (sqliteAreaRepo) SetFailure(ctx context.Context, area models.HXArea) error {
+	return sqliteExec(ctx, true,
+		`UPDATE hx_areas SET last_action_success = ?, last_error = ?, num_errors = ?, last_failure = ?, retry_state = ?, next_action = ?
+		WHERE id = ?`,
+		area.LastActionSuccess, area.LastError, area.NumErrors, toSqliteTime(area.LastFailure), area.RetryState,
+		toSqliteTime(area.NextAction), area.ID.Hex(),
+	)
+}
+
+func (sqliteAreaRepo) SetParseResult(ctx context.Context, area models.HXArea) error {
+	return sqliteExec(ctx, true,
+		`UPDATE hx_areas SET last_action_success = ?, last_error = ?, num_errors = ?, last_failure = ?, retry_state = ?, next_action = ?,
+			sub_areas = ?, flight_operating_hours = ?, last_success = ?
+		WHERE id = ?`,
+		area.LastActionSuccess, area.LastError, area.NumErrors, toSqliteTime(area.LastFailure), area.RetryState,
+		toSqliteTime(area.NextAction), toSqliteJson(area.SubAreas), toSqliteJson(area.FlightOperatingHours),
+		toSqliteTime(area.LastSuccess), area.ID.Hex(),
+	)
+}
+
+func (sqliteAreaRepo) NearestNextAction(ctx context.Context) (time.Time, error) {
+	nextAction, err := sqliteQueryOne(ctx, func(row sqliteScanner) (string, error) {
+		var nextAction string
+		return nextAction, row.Scan(&nextAction)
+	}, "SELECT next_action FROM hx_areas WHERE paused = 0 ORDER BY next_action LIMIT 1")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return fromSqliteTime(nextAction), nil
+}
+
+// SQLite has no way of notifying other processes about changes
+func (sqliteAreaRepo) Watch(ctx context.Context) (<-chan struct{}, error) {
+	return nil, ErrUnsupported
+}
+
+// ---------------------------------------------
+// NUMBERS
+type sqliteNumberRepo struct{}
+
+const sqliteNumberColumns string = "id, name, number, last_called, last_call_status, script"
+
+func scanSqliteNumber(row sqliteScanner) (models.Number, error) {
+	var number models.Number
+	var id, lastCalled, script string
+	err := row.Scan(&id, &number.Name, &number.Number, &lastCalled, &number.LastCallStatus, &script)
+
+	number.ID = fromSqliteID(id)
+	number.LastCalled = fromSqliteTime(lastCalled)
+	fromSqliteJson(script, &number.Script)
+
+	return number, err
+}
+
+func (sqliteNumberRepo) List(ctx context.Context) ([]models.Number, error) {
+	return sqliteQuery(ctx, scanSqliteNumber, "SELECT "+sqliteNumberColumns+" FROM numbers ORDER BY name")
+}
+
+func (sqliteNumberRepo) GetByID(ctx context.Context, id primitive.ObjectID) (models.Number, error) {
+	return sqliteQueryOne(ctx, scanSqliteNumber, "SELECT "+sqliteNumberColumns+" FROM numbers WHERE id = ?", id.Hex())
+}
+
+func (sqliteNumberRepo) GetByName(ctx context.Context, name string) (models.Number, error) {
+	return sqliteQueryOne(ctx, scanSqliteNumber, "SELECT "+sqliteNumberColumns+" FROM numbers WHERE name = ?", name)
+}
+
+func (sqliteNumberRepo) GetByNumber(ctx context.Context, number string) (models.Number, error) {
+	return sqliteQueryOne(ctx, scanSqliteNumber, "SELECT "+sqliteNumberColumns+" FROM numbers WHERE number = ? LIMIT 1", number)
+}
+
+func (sqliteNumberRepo) Insert(ctx context.Context, number models.Number) error {
+	return sqliteExec(ctx, false,
+		"INSERT INTO numbers ("+sqliteNumberColumns+") VALUES (?, ?, ?, ?, ?, ?)",
+		number.ID.Hex(), number.Name, number.Number, toSqliteTime(number.LastCalled), number.LastCallStatus, toSqliteJson(number.Script),
+	)
+}
+
+func (sqliteNumberRepo) Update(ctx context.Context, number models.Number) error {
+	return sqliteExec(ctx, true,
+		"UPDATE numbers SET name = ?, number = ?, last_called = ?, last_call_status = ?, script = ? WHERE id = ?",
+		number.Name, number.Number, toSqliteTime(number.LastCalled), number.LastCallStatus, toSqliteJson(number.Script), number.ID.Hex(),
+	)
+}
+
+func (sqliteNumberRepo) Delete(ctx context.Context, id primitive.ObjectID) error {
+	return sqliteExec(ctx, true, "DELETE FROM numbers WHERE id = ?", id.Hex())
+}
+
+// ---------------------------------------------
+// CALLS
+type sqliteCallRepo struct{}
+
+const sqliteCallColumns string = "id, sid, time, updated_at, status, timeline, duration, price, price_unit, number_id, hx_area_id, transcript_id, parse_success, parse_error"
+
+// Used in statements to keep the status of finished calls
+var sqliteFinishedCallStates = "'" + strings.Join(models.FinishedCallStates, "', '") + "'"
+
+func scanSqliteCall(row sqliteScanner) (models.Call, error) {
+	var call models.Call
+	var id, callTime, updatedAt, timeline, numberID, areaID, transcriptID string
+	err := row.Scan(
+		&id, &call.SID, &callTime, &updatedAt, &call.Status, &timeline, &call.Duration, &call.Price, &call.PriceUnit,
+		&numberID, &areaID, &transcriptID, &call.ParseSuccess, &call.ParseError,
+	)
+
+	call.ID = fromSqliteID(id)
+	call.Time = fromSqliteTime(callTime)
+	call.UpdatedAt = fromSqliteTime(updatedAt)
+	fromSqliteJson(timeline, &call.Timeline)
+	call.NumberID = fromSqliteID(numberID)
+	call.HXAreaID = fromSqliteID(areaID)
+	call.TranscriptID = fromSqliteID(transcriptID)
+
+	return call, err
+}
+
+func (sqliteCallRepo) Start(ctx context.Context, call models.Call) error {
+	return sqliteExec(ctx, false,
+		`INSERT INTO calls (id, sid, time, updated_at, status, timeline, number_id, hx_area_id, price, price_unit, transcript_id)
+		VALUES (?, ?, ?, ?, ?, '[]', ?, ?, ?, ?, ?)
+		ON CONFLICT (sid) DO UPDATE SET
+			updated_at = excluded.updated_at,
+			number_id = excluded.number_id,
+			hx_area_id = excluded.hx_area_id,
+			price = excluded.price,
+			price_unit = excluded.price_unit`,
+		call.ID.Hex(), call.SID, toSqliteTime(call.Time), toSqliteTime(time.Now()), call.Status,
+		call.NumberID.Hex(), call.HXAreaID.Hex(), call.Price, call.PriceUnit, primitive.NilObjectID.Hex(),
+	)
+}
+
+func (sqliteCallRepo) AddEvent(ctx context.Context, sid string, event models.CallEvent, duration int) error {
+	nilID := primitive.NilObjectID.Hex()
+	return sqliteExec(ctx, false,
+		`INSERT INTO calls (id, sid, time, updated_at, status, timeline, duration, number_id, hx_area_id, transcript_id)
+		VALUES (?, ?, ?, ?, ?, json_array(json(?)), ?, ?, ?, ?)
+		ON CONFLICT (sid) DO UPDATE SET
+			updated_at = excluded.updated_at,
+			status = CASE WHEN status IN (`+sqliteFinishedCallStates+`) THEN status ELSE excluded.status END,
+			timeline = json_insert(timeline, '$[#]', json(?)),
+			duration = CASE WHEN excluded.duration > 0 THEN excluded.duration ELSE duration END`,
+		primitive.NewObjectID().Hex(), sid, toSqliteTime(event.Time), toSqliteTime(time.Now()), event.Status,
+		toSqliteJson(event), duration, nilID, nilID, nilID,
+		toSqliteJson(event),
+	)
+}
+
+func (sqliteCallRepo) SetParseOutcome(ctx context.Context, sid string, transcriptID primitive.ObjectID, success bool, parseError string) error {
+	return sqliteExec(ctx, true,
+		"UPDATE calls SET transcript_id = ?, parse_success = ?, parse_error = ? WHERE sid = ?",
+		transcriptID.Hex(), success, parseError, sid,
+	)
+}
+
+func (sqliteCallRepo) GetBySID(ctx context.Context, sid string) (models.Call, error) {
+	return sqliteQueryOne(ctx, scanSqliteCall, "SELECT "+sqliteCallColumns+" FROM calls WHERE sid = ?", sid)
+}
+
+func (sqliteCallRepo) GetLatestForArea(ctx context.Context, areaID primitive.ObjectID) (models.Call, error) {
+	return sqliteQueryOne(ctx, scanSqliteCall,
+		"SELECT "+sqliteCallColumns+" FROM calls WHERE hx_area_id = ? ORDER BY time DESC LIMIT 1",
+		areaID.Hex(),
+	)
+}
+
+// ---------------------------------------------
+// TRANSCRIPTS
+type sqliteTranscriptRepo struct{}
+
+const sqliteTranscriptColumns string = "id, transcript, date, cost, number_id, hx_area_id, call_sid"
+
+func scanSqliteTranscript(row sqliteScanner) (models.Transcript, error) {
+	var transcript models.Transcript
+	var id, date, numberID, areaID string
+	err := row.Scan(&id, &transcript.Transcript, &date, &transcript.Cost, &numberID, &areaID, &transcript.CallSID)
+
+	transcript.ID = fromSqliteID(id)
+	transcript.Date = fromSqliteTime(date)
+	transcript.NumberID = fromSqliteID(numberID)
+	transcript.HXAreaID = fromSqliteID(areaID)
+
+	return transcript, err
+}
+
+func (sqliteTranscriptRepo) Insert(ctx context.Context, transcript models.Transcript) error {
+	return sqliteExec(ctx, false,
+		"INSERT INTO transcripts ("+sqliteTranscriptColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)",
+		transcript.ID.Hex(), transcript.Transcript, toSqliteTime(transcript.Date), transcript.Cost,
+		transcript.NumberID.Hex(), transcript.HXAreaID.Hex(), transcript.CallSID,
+	)
+}
+
+func (sqliteTranscriptRepo) ListForArea(ctx context.Context, areaID primitive.ObjectID, limit int64) ([]models.Transcript, error) {
+	return sqliteQuery(ctx, scanSqliteTranscript,
+		"SELECT "+sqliteTranscriptColumns+" FROM transcripts WHERE hx_area_id = ? ORDER BY date DESC LIMIT ?",
+		areaID.Hex(), sqliteLimit(limit),
+	)
+}
+
+// ---------------------------------------------
+// AUDIT LOG
+type sqliteAuditRepo struct{}
+
+const sqliteAuditColumns string = `id, time, actor, "action", target, "before", "after", remote_ip`
+
+func scanSqliteAuditEntry(row sqliteScanner) (models.AuditLogEntry, error) {
+	var entry models.AuditLogEntry
+	var id, entryTime string
+	var before, after sql.NullString
+	err := row.Scan(&id, &entryTime, &entry.Actor, &entry.Action, &entry.Target, &before, &after, &entry.RemoteIP)
+
+	entry.ID = fromSqliteID(id)
+	entry.Time = fromSqliteTime(entryTime)
+	if before.Valid {
+		fromSqliteJson(before.String, &entry.Before)
+	}
+	if after.Valid {
+		fromSqliteJson(after.String, &entry.After)
+	}
+
+	return entry, err
+}
+
+// Stores nil as NULL rather than as JSON "null"
+func toSqliteNullJson(v interface{}) sql.NullString {
+	if v == nil {
+		return sql.NullString{}
+	}
+
+	return sql.NullString{String: toSqliteJson(v), Valid: true}
+}
+
+func (sqliteAuditRepo) Insert(ctx context.Context, entry models.AuditLogEntry) error {
+	return sqliteExec(ctx, false,
+		"INSERT INTO audit_log ("+sqliteAuditColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		entry.ID.Hex(), toSqliteTime(entry.Time), entry.Actor, entry.Action, entry.Target,
+		toSqliteNullJson(entry.Before), toSqliteNullJson(entry.After), entry.RemoteIP,
+	)
+}
+
+func (sqliteAuditRepo) List(ctx context.Context, target string, actor string, limit int64) ([]models.AuditLogEntry, error) {
+	return sqliteQuery(ctx, scanSqliteAuditEntry,
+		"SELECT "+sqliteAuditColumns+` FROM audit_log
+		WHERE (?1 = '' OR target = ?1) AND (?2 = '' OR actor = ?2)
+		ORDER BY time DESC LIMIT ?3`,
+		target, actor, sqliteLimit(limit),
+	)
+}
+
+// ---------------------------------------------
+// API KEYS
+type sqliteAPIKeyRepo struct{}
+
+const sqliteAPIKeyColumns string = "id, name, prefix, key_hash, scopes, created_at, created_by, last_used, revoked"
+
+func scanSqliteAPIKey(row sqliteScanner) (models.APIKey, error) {
+	var key models.APIKey
+	var id, scopes, createdAt, lastUsed string
+	err := row.Scan(&id, &key.Name, &key.Prefix, &key.KeyHash, &scopes, &createdAt, &key.CreatedBy, &lastUsed, &key.Revoked)
+
+	key.ID = fromSqliteID(id)
+	key.CreatedAt = fromSqliteTime(createdAt)
+	key.LastUsed = fromSqliteTime(lastUsed)
+	fromSqliteJson(scopes, &key.Scopes)
+
+	return key, err
+}
+
+func (sqliteAPIKeyRepo) List(ctx context.Context) ([]models.APIKey, error) {
+	return sqliteQuery(ctx, scanSqliteAPIKey, "SELECT "+sqliteAPIKeyColumns+" FROM api_keys ORDER BY created_at DESC")
+}
+
+func (sqliteAPIKeyRepo) GetByID(ctx context.Context, id primitive.ObjectID) (models.APIKey, error) {
+	return sqliteQueryOne(ctx, scanSqliteAPIKey, "SELECT "+sqliteAPIKeyColumns+" FROM api_keys WHERE id = ?", id.Hex())
+}
+
+func (sqliteAPIKeyRepo) GetActiveByHash(ctx context.Context, keyHash string) (models.APIKey, error) {
+	return sqliteQueryOne(ctx, scanSqliteAPIKey, "SELECT "+sqliteAPIKeyColumns+" FROM api_keys WHERE key_hash = ? AND revoked = 0", keyHash)
+}
+
+func (sqliteAPIKeyRepo) Insert(ctx context.Context, key models.APIKey) error {
+	return sqliteExec(ctx, false,
+		"INSERT INTO api_keys ("+sqliteAPIKeyColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		key.ID.Hex(), key.Name, key.Prefix, key.KeyHash, toSqliteJson(key.Scopes),
+		toSqliteTime(key.CreatedAt), key.CreatedBy, toSqliteTime(key.LastUsed), key.Revoked,
+	)
+}
+
+func (sqliteAPIKeyRepo) SetLastUsed(ctx context.Context, id primitive.ObjectID, lastUsed time.Time) error {
+	return sqliteExec(ctx, true, "UPDATE api_keys SET last_used = ? WHERE id = ?", toSqliteTime(lastUsed), id.Hex())
+}
+
+func (sqliteAPIKeyRepo) Revoke(ctx context.Context, id primitive.ObjectID) error {
+	return sqliteExec(ctx, true, "UPDATE api_keys SET revoked = 1 WHERE id = ?", id.Hex())
+}
@@ -0,0 +1,188 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/thisisnttheway/hx-monitor/db"
+	"github.com/thisisnttheway/hx-monitor/models"
+)
+
+const checkTimeout time.Duration = 5 * time.Second
+
+// A named check, nil means healthy
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// Serves /healthz (liveness) and /readyz (readiness) from registered checks
+type Checker struct {
+	mu        sync.RWMutex
+	liveness  []Check
+	readiness []Check
+}
+
+func New() *Checker {
+	return &Checker{}
+}
+
+// Adds a check that fails if the process is stuck and must be restarted
+func (c *Checker) AddLiveness(name string, check func(ctx context.Context) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.liveness = append(c.liveness, Check{Name: name, Check: check})
+}
+
+// Adds a check that fails while the process can not do its work, e.g. without a database
+func (c *Checker) AddReadiness(name string, check func(ctx context.Context) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readiness = append(c.readiness, Check{Name: name, Check: check})
+}
+
+// Handler for /healthz
+func (c *Checker) Liveness(w http.ResponseWriter, r *http.Request) {
+	c.mu.RLock()
+	checks := c.liveness
+	c.mu.RUnlock()
+
+	respond(w, r, checks)
+}
+
+// Handler for /readyz, readiness implies liveness
+func (c *Checker) Readiness(w http.ResponseWriter, r *http.Request) {
+	c.mu.RLock()
+	checks := append(append([]Check{}, c.liveness...), c.readiness...)
+	c.mu.RUnlock()
+
+	respond(w, r, checks)
+}
+
+type response struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Runs all checks concurrently and responds with 503 if any of them fails
+func respond(w http.ResponseWriter, r *http.Request, checks []Check) {
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	results := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = check.Check(ctx)
+		}()
+	}
+	wg.Wait()
+
+	resp := response{Status: "ok", Checks: make(map[string]string, len(checks))}
+	for i, check := range checks {
+		if results[i] != nil {
+			resp.Status = "fail"
+			resp.Checks[check.Name] = results[i].Error()
+			slog.Warn("HEALTH", "path", r.URL.Path, "check", check.Name, "error", results[i])
+		} else {
+			resp.Checks[check.Name] = "ok"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ---------------------------------------------
+// COMMON CHECKS
+
+func Database(ctx context.Context) error {
+	return db.Ping(ctx)
+}
+
+// Fails if an area that is not paused is overdue by more than staleAfter,
+// e.g. because its calls keep failing or nothing processes it anymore
+func AreaFreshness(list func(ctx context.Context) ([]models.HXArea, error), staleAfter time.Duration) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		areas, err := list(ctx)
+		if err != nil {
+			return err
+		}
+
+		var stale []string
+		for _, area := range areas {
+			if !area.Paused && time.Since(area.NextAction) > staleAfter {
+				stale = append(stale, area.Name)
+			}
+		}
+		if len(stale) > 0 {
+			return fmt.Errorf("areas overdue by more than %s: %v", staleAfter, stale)
+		}
+
+		return nil
+	}
+}
+
+// Fails if last, as returned by tick, is older than maxAge
+func Heartbeat(tick func() time.Time, maxAge time.Duration) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		last := tick()
+		if last.IsZero() {
+			return errors.New("no heartbeat yet")
+		}
+		if age := time.Since(last); age > maxAge {
+			return fmt.Errorf("last heartbeat %s ago", age.Round(time.Second))
+		}
+
+		return nil
+	}
+}
+
+// Requests url and fails unless it responds with 200, for container health checks
+func Probe(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var body response
+		json.NewDecoder(resp.Body).Decode(&body)
+		return fmt.Errorf("unhealthy, status %d: %v", resp.StatusCode, body.Checks)
+	}
+
+	return nil
+}
+
+// Returns the URL of path on a server listening on address, e.g. ":9090", from within the same host
+func LocalURL(address string, path string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+
+	return "http://" + net.JoinHostPort(host, port) + path, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/thisisnttheway/hx-monitor/configuration"
+	"github.com/thisisnttheway/hx-monitor/health"
+)
+
+const healthcheckTimeout time.Duration = 10 * time.Second
+
+// Handles "healthcheck [live|ready]", which probes a running monitor on the metrics address.
+// Distroless images have no curl, so container health checks use this instead.
+func runHealthcheck(args []string) error {
+	path := "/readyz"
+	if len(args) > 0 {
+		switch args[0] {
+		case "live":
+			path = "/healthz"
+		case "ready":
+		default:
+			return errors.New("unknown healthcheck command, must be 'live' or 'ready'")
+		}
+	}
+
+	cfg, err := configuration.Load(*configPath)
+	if err != nil {
+		return err
+	}
+	if cfg.Metrics.ListenAddress == "" {
+		return errors.New("metrics.listen_address (METRICS_LISTEN_ADDRESS) is empty, health endpoints are disabled")
+	}
+
+	url, err := health.LocalURL(cfg.Metrics.ListenAddress, path)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthcheckTimeout)
+	defer cancel()
+	if err := health.Probe(ctx, url); err != nil {
+		return err
+	}
+
+	fmt.Println("ok")
+	return nil
+}
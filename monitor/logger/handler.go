@@ -0,0 +1,140 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"strings"
+	"sync"
+
+	c "github.com/thisisnttheway/hx-monitor/configuration"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Minimum levels, by default and per component
+type Levels struct {
+	mu         sync.RWMutex
+	level      slog.Level
+	components map[string]slog.Level
+
+	// Lowest of all levels, so that disabled records are dropped early
+	min slog.Level
+}
+
+func NewLevels(cfg c.LoggingConfiguration) (*Levels, error) {
+	l := &Levels{}
+	if err := l.Configure(cfg); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Replaces all levels, including those set at runtime
+func (l *Levels) Configure(cfg c.LoggingConfiguration) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return err
+	}
+	components, err := c.ParseLogLevels(cfg.Levels)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.level = level
+	l.components = components
+	l.updateMin()
+	return nil
+}
+
+// Sets the level of a component, or resets it to the default if level is nil
+func (l *Levels) Set(component string, level *slog.Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	component = strings.ToUpper(component)
+	if level == nil {
+		delete(l.components, component)
+	} else {
+		l.components[component] = *level
+	}
+	l.updateMin()
+}
+
+func (l *Levels) SetDefault(level slog.Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.level = level
+	l.updateMin()
+}
+
+// Returns the default level and the levels of components that differ from it
+func (l *Levels) Get() (slog.Level, map[string]slog.Level) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.level, maps.Clone(l.components)
+}
+
+func (l *Levels) of(component string) slog.Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if level, ok := l.components[component]; ok {
+		return level
+	}
+
+	return l.level
+}
+
+func (l *Levels) minimum() slog.Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.min
+}
+
+func (l *Levels) updateMin() {
+	l.min = l.level
+	for _, level := range l.components {
+		l.min = min(l.min, level)
+	}
+}
+
+// Filters records by the level of their component and adds the attributes carried by the context
+type handler struct {
+	next   slog.Handler
+	levels *Levels
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.levels.minimum()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < h.levels.of(r.Message) {
+		return nil
+	}
+
+	r.AddAttrs(attrsFromContext(ctx)...)
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		r.AddAttrs(
+			slog.String("traceId", span.TraceID().String()),
+			slog.String("spanId", span.SpanID().String()),
+		)
+	}
+
+	return h.next.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &handler{next: h.next.WithAttrs(attrs), levels: h.levels}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{next: h.next.WithGroup(name), levels: h.levels}
+}
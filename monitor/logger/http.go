@@ -0,0 +1,69 @@
+package logger
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// Levels as listed by LevelHandler
+type LevelsResponse struct {
+	Level      string            `json:"level"`
+	Components map[string]string `json:"components"`
+}
+
+// Handler for /loglevel, to change levels at runtime until the next restart or configuration reload.
+// GET lists the levels. PUT ?component=DB&level=debug sets the level of a component,
+// without level it resets the component to the default level, without component it sets the default level.
+func LevelHandler(w http.ResponseWriter, r *http.Request) {
+	if levels == nil {
+		http.Error(w, "Logging is not set up", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		component, levelName := r.URL.Query().Get("component"), r.URL.Query().Get("level")
+
+		var level *slog.Level
+		if levelName != "" {
+			level = new(slog.Level)
+			if err := level.UnmarshalText([]byte(levelName)); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		switch {
+		case component != "":
+			levels.Set(component, level)
+		case level != nil:
+			levels.SetDefault(*level)
+		default:
+			http.Error(w, "Either component or level is required", http.StatusBadRequest)
+			return
+		}
+		slog.Info("LOGGER", "action", "setLevel", "component", component, "level", levelName)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	level, components := levels.Get()
+	resp := LevelsResponse{Level: level.String(), Components: make(map[string]string, len(components))}
+	for component, level := range components {
+		resp.Components[component] = level.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Serves LevelHandler on its own listener, so that whoever can scrape metrics can not change log levels
+func NewLevelServer(address string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/loglevel", LevelHandler)
+
+	return &http.Server{Addr: address, Handler: mux}
+}
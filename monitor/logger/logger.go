@@ -1,12 +1,72 @@
 package logger
 
 import (
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"time"
+
+	c "github.com/thisisnttheway/hx-monitor/configuration"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
+// Levels of the default logger, nil before Setup
+var levels *Levels
+
 // Logs a fatal error and panics
 func LogErrorFatal(module string, message string) {
 	slog.Error(module, "fatal", message)
 	os.Exit(1)
 }
+
+// Replaces the default logger with one configured by cfg. The component, i.e. the message, determines the level.
+func Setup(cfg c.LoggingConfiguration) error {
+	l, err := NewLevels(cfg)
+	if err != nil {
+		return err
+	}
+
+	var output io.Writer = os.Stderr
+	if cfg.File != "" {
+		output = io.MultiWriter(os.Stderr, &lumberjack.Logger{
+			Filename:   cfg.File,
+			MaxSize:    cfg.FileMaxSizeMB,
+			MaxBackups: cfg.FileMaxBackups,
+			MaxAge:     days(cfg.FileMaxAge),
+		})
+	}
+
+	options := &slog.HandlerOptions{
+		Level:       slog.LevelDebug, // Filtered by handler
+		ReplaceAttr: redactAttr,
+	}
+
+	var next slog.Handler
+	switch cfg.Format {
+	case c.LogFormatText:
+		next = slog.NewTextHandler(output, options)
+	case c.LogFormatJSON:
+		next = slog.NewJSONHandler(output, options)
+	default:
+		return fmt.Errorf("unknown log format '%s'", cfg.Format)
+	}
+
+	levels = l
+	slog.SetDefault(slog.New(&handler{next: next, levels: l}))
+	return nil
+}
+
+// Applies the levels of a reloaded configuration. Format and file only change on restart.
+func Configure(cfg c.LoggingConfiguration) error {
+	if levels == nil {
+		return Setup(cfg)
+	}
+
+	return levels.Configure(cfg)
+}
+
+// Rounds up to whole days, as lumberjack does not support shorter durations
+func days(d time.Duration) int {
+	return int((d + 24*time.Hour - 1) / (24 * time.Hour))
+}
@@ -0,0 +1,78 @@
+package logger
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+const redacted string = "<redacted>"
+
+var (
+	// Digits of a phone number, with or without country code
+	phoneNumberPattern = regexp.MustCompile(`\+?\b\d{9,15}\b`)
+
+	secretKeyParts = []string{"password", "secret", "token", "apikey", "api_key", "authorization"}
+)
+
+// Replaces the values of secret attributes and masks phone numbers in all others.
+// Structured values are only turned into strings if they contain a phone number.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	switch a.Value.Kind() {
+	case slog.KindString:
+		if isSecretKey(a.Key) {
+			return slog.String(a.Key, redacted)
+		}
+		return slog.String(a.Key, maskPhoneNumbers(a.Value.String()))
+	case slog.KindAny:
+		formatted := fmt.Sprintf("%+v", a.Value.Any())
+		if masked := maskPhoneNumbers(formatted); masked != formatted {
+			return slog.String(a.Key, masked)
+		}
+	}
+
+	return a
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, part := range secretKeyParts {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Keeps the last three digits, so that numbers can still be told apart.
+// Digits following a '.' are fractions, e.g. the nanoseconds of a time, and are kept.
+func maskPhoneNumbers(value string) string {
+	matches := phoneNumberPattern.FindAllStringIndex(value, -1)
+	if matches == nil {
+		return value
+	}
+
+	var result strings.Builder
+	last := 0
+	for _, match := range matches {
+		start, end := match[0], match[1]
+		if start > 0 && value[start-1] == '.' {
+			continue
+		}
+
+		number := value[start:end]
+		prefix := ""
+		if strings.HasPrefix(number, "+") {
+			prefix, number = "+", number[1:]
+		}
+
+		result.WriteString(value[last:start])
+		result.WriteString(prefix + strings.Repeat("*", len(number)-3) + number[len(number)-3:])
+		last = end
+	}
+	result.WriteString(value[last:])
+
+	return result.String()
+}
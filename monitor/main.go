@@ -1,121 +1,72 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log/slog"
 	"os"
-	"time"
+	"os/signal"
+	"syscall"
 
-	"github.com/thisisnttheway/hx-monitor/callback"
-	"github.com/thisisnttheway/hx-monitor/caller"
+	"github.com/thisisnttheway/hx-monitor/app"
 	"github.com/thisisnttheway/hx-monitor/configuration"
-	"github.com/thisisnttheway/hx-monitor/db"
-	"github.com/thisisnttheway/hx-monitor/logger"
-	"github.com/thisisnttheway/hx-monitor/monitor"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 var (
-	sleepTime time.Duration = 30 * time.Second
-	forceCall *bool
+	forceCall  *bool
+	configPath *string
 )
 
-// Check if certain env vars have been set
-func preFlightChecks() {
-	// Callback
-	_, exists := os.LookupEnv("NGROK_AUTHTOKEN")
-	if !exists {
-		_, exists := os.LookupEnv("TWILIO_API_CALLBACK_URL")
-		if !exists {
-			logger.LogErrorFatal("MAIN", "Neither NGROK_AUTHTOKEN auth token or TWILIO_API_CALLBACK_URL is set")
-		}
-	}
-}
-
-// Returns the nearest NextAction time of hx_areas. Default: time.Now()
-func getNearestNextActionTime() time.Time {
-	result := time.Now()
-	type AggregateResult struct {
-		NextAction time.Time `bson:"next_action"`
+func run() error {
+	if err := loadConfig(false); err != nil {
+		return err
 	}
 
-	// Only get next_action and sort ascending
-	results, err := db.Aggregate[AggregateResult]("hx_areas", mongo.Pipeline{
-		bson.D{{"$sort", bson.D{
-			{"next_action", 1},
-		}}},
-		bson.D{{"$project", bson.D{
-			{"_id", false},
-			{"next_action", true},
-		}}},
-	})
+	// New calls are no longer placed once a signal is received
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	if err == nil && len(results) > 0 {
-		result = results[0].NextAction
-	} else {
-		slog.Warn("MAIN",
-			"action", "getNearestNextActionTime",
-			"message", "Using default value instead of DB",
-			"returnValue", result,
-			"errorDb", err,
-		)
+	a := app.New(configuration.Current(), *configPath)
+	a.ForceCall = *forceCall
+	if err := a.Start(ctx); err != nil {
+		return err
 	}
 
-	return result
-}
-
-func init() {
-	preFlightChecks()
-	db.Connect()
-
-	// Callback URL handler
-	go func() {
-		callback.Serve()
-	}()
-}
-
-func run() error {
-	// Set up config
-	slog.Debug("MAIN", "event", "setUpTwilioConfig")
-	configuration.SetUpTwilioConfig()
-
-	slog.Debug("MAIN", "event", "getNumbers")
-	numbers := caller.GetNumbers()
-	for _, v := range numbers {
-		slog.Info("MAIN",
-			"action", "indexNumbers",
-			"number", v.Number,
-			"name", v.Name,
-		)
+	if err := a.Run(ctx); err != nil {
+		return err
 	}
 
-	// Main loop
-	for {
-		nextActionableTime := getNearestNextActionTime()
-		if *forceCall || time.Now().After(nextActionableTime) {
-			*forceCall = false
-			slog.Info("MAIN",
-				"action", "monitorHxAreas",
-			)
-
-			monitor.MonitorHxAreas()
-		} else {
-			slog.Info("MAIN", "action", "awaitNextAction",
-				"eta", time.Until(nextActionableTime),
-				"nextActionTime", nextActionableTime,
-			)
-		}
-
-		time.Sleep(sleepTime)
-	}
+	// A second signal terminates immediately
+	stop()
+	return a.Shutdown()
 }
 
 func main() {
 	forceCall = flag.Bool("force-call", false, "Force immediate processing of areas")
+	configPath = flag.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file, env vars take precedence")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n       %s [flags] migrate [up|status]\n       %s [flags] config check\n       %s [flags] secrets [keygen|encrypt <file>]\n       %s [flags] healthcheck [live|ready]\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	err := run()
+	var err error
+	switch flag.Arg(0) {
+	case "":
+		err = run()
+	case "migrate":
+		err = runMigrate(flag.Args()[1:])
+	case "config":
+		err = runConfig(flag.Args()[1:])
+	case "secrets":
+		err = runSecrets(flag.Args()[1:])
+	case "healthcheck":
+		err = runHealthcheck(flag.Args()[1:])
+	default:
+		flag.Usage()
+		err = fmt.Errorf("unknown command '%s'", flag.Arg(0))
+	}
 	if err != nil {
 		slog.Error("MAIN", "error", err)
 		os.Exit(1)
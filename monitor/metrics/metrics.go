@@ -0,0 +1,212 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/thisisnttheway/hx-monitor/models"
+)
+
+const namespace string = "hx"
+
+var (
+	// Calls by final status, or "not-placed" if the call could not be placed
+	Calls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "calls_total",
+		Help:      "Calls placed, by final status",
+	}, []string{"status"})
+
+	// Calls that could not be placed, failed or timed out, by caller.FailureKind
+	CallFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "call_failures_total",
+		Help:      "Calls that could not be placed, failed or timed out, by kind of failure",
+	}, []string{"kind"})
+
+	CallDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "call_duration_seconds",
+		Help:      "Duration of completed calls as reported by Twilio",
+		Buckets:   []float64{5, 10, 20, 30, 40, 50, 60, 90, 120},
+	})
+
+	CallCost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "call_cost_total",
+		Help:      "Cost of calls as reported by Twilio, by currency",
+	}, []string{"unit"})
+
+	TranscriptionFragments = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transcription_fragments_total",
+		Help:      "Transcription callbacks received, by event",
+	}, []string{"event"})
+
+	LLMRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "llm_request_duration_seconds",
+		Help:      "Latency of content generation requests",
+		Buckets:   prometheus.ExponentialBuckets(0.25, 2, 8),
+	}, []string{"model", "result"})
+
+	// Type is one of "prompt", "response" and "total", the latter includes tokens used for thinking
+	LLMTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "llm_tokens_total",
+		Help:      "Tokens used for content generation, by model and type",
+	}, []string{"model", "type"})
+
+	Parses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "parses_total",
+		Help:      "Transcripts parsed, by result",
+	}, []string{"result"})
+
+	AlertsActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "alerts_active",
+		Help:      "Active alerts, by kind",
+	}, []string{"kind"})
+
+	DBOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_operation_duration_seconds",
+		Help:      "Latency of database operations, by driver, operation and result",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 8),
+	}, []string{"driver", "operation", "result"})
+)
+
+// Returns "success" or "error"
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+
+	return "success"
+}
+
+// ---------------------------------------------
+// AREAS
+
+// Reports the freshness of every area, read when scraped
+type areaCollector struct {
+	list func(ctx context.Context) ([]models.HXArea, error)
+
+	sinceLastSuccess *prometheus.Desc
+	untilNextAction  *prometheus.Desc
+	numErrors        *prometheus.Desc
+}
+
+const areaCollectTimeout time.Duration = 5 * time.Second
+
+// Registers gauges describing every area returned by list
+func RegisterAreas(list func(ctx context.Context) ([]models.HXArea, error)) {
+	prometheus.MustRegister(&areaCollector{
+		list: list,
+		sinceLastSuccess: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "area", "seconds_since_last_success"),
+			"Seconds since the status of the area was last parsed successfully, missing if it never was",
+			[]string{"area"}, nil,
+		),
+		untilNextAction: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "area", "seconds_until_next_action"),
+			"Seconds until the area is due to be called, negative if overdue",
+			[]string{"area", "paused"}, nil,
+		),
+		numErrors: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "area", "errors"),
+			"Consecutive failures of the area",
+			[]string{"area"}, nil,
+		),
+	})
+}
+
+func (c *areaCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.sinceLastSuccess
+	ch <- c.untilNextAction
+	ch <- c.numErrors
+}
+
+func (c *areaCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), areaCollectTimeout)
+	defer cancel()
+
+	areas, err := c.list(ctx)
+	if err != nil {
+		slog.Error("METRICS", "action", "collectAreas", "error", err)
+		ch <- prometheus.NewInvalidMetric(c.untilNextAction, err)
+		return
+	}
+
+	now := time.Now()
+	for _, area := range areas {
+		if !area.LastSuccess.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.sinceLastSuccess, prometheus.GaugeValue, now.Sub(area.LastSuccess).Seconds(), area.Name)
+		}
+
+		paused := "false"
+		if area.Paused {
+			paused = "true"
+		}
+		ch <- prometheus.MustNewConstMetric(c.untilNextAction, prometheus.GaugeValue, area.NextAction.Sub(now).Seconds(), area.Name, paused)
+		ch <- prometheus.MustNewConstMetric(c.numErrors, prometheus.GaugeValue, float64(area.NumErrors), area.Name)
+	}
+}
+
+// ---------------------------------------------
+// SERVER
+
+// Serves /metrics on its own address, so that it is not exposed along with public endpoints
+type Server struct {
+	address    string
+	mux        *http.ServeMux
+	httpServer *http.Server
+}
+
+func NewServer(address string) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return &Server{
+		address:    address,
+		mux:        mux,
+		httpServer: &http.Server{Addr: address, Handler: mux},
+	}
+}
+
+// Serves further internal endpoints, e.g. health checks. Must be called before Serve.
+func (s *Server) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+// Serves until Shutdown, does nothing if no address is set
+func (s *Server) Serve() error {
+	if s.address == "" {
+		slog.Info("METRICS", "action", "serve", "enabled", false)
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("METRICS", "action", "serve", "listenAddress", listener.Addr())
+	if err := s.httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
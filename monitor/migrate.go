@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/thisisnttheway/hx-monitor/db"
+	"github.com/thisisnttheway/hx-monitor/migrations"
+)
+
+// Handles "migrate [up|status]"
+func runMigrate(args []string) error {
+	if err := loadConfig(true); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if err := db.Connect(ctx); err != nil {
+		return err
+	}
+	defer db.Disconnect(ctx)
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		return migrations.Run(ctx)
+	case "status":
+		status, err := migrations.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range status {
+			if m.Applied {
+				fmt.Printf("[+] %3d %s (applied %s)\n", m.Version, m.Description, m.AppliedAt.Format("2006-01-02 15:04:05"))
+			} else {
+				fmt.Printf("[ ] %3d %s\n", m.Version, m.Description)
+			}
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command '%s', must be 'up' or 'status'", command)
+	}
+}
@@ -0,0 +1,211 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/thisisnttheway/hx-monitor/configuration"
+	"github.com/thisisnttheway/hx-monitor/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const migrationsCollection string = "schema_migrations"
+
+// A single, versioned change to the MongoDB schema.
+// Migrations must be idempotent, as a migration that failed halfway is retried as a whole.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, database *mongo.Database) error
+}
+
+// A single, versioned change to the SQLite schema, applied in a transaction
+type SqlMigration struct {
+	Version     int
+	Description string
+	Statements  []string
+}
+
+// Document in schema_migrations, one per applied migration
+type appliedMigration struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"applied_at"`
+}
+
+type MigrationStatus struct {
+	Version     int
+	Description string
+	Applied     bool
+	AppliedAt   time.Time
+}
+
+// Returns all known MongoDB migrations in ascending order
+func All() []Migration {
+	result := append([]Migration{}, mongoMigrations...)
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Version < result[j].Version
+	})
+
+	return result
+}
+
+func getApplied(ctx context.Context, database *mongo.Database) (map[int]appliedMigration, error) {
+	cursor, err := database.Collection(migrationsCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var applied []appliedMigration
+	if err := cursor.All(ctx, &applied); err != nil {
+		return nil, err
+	}
+
+	result := make(map[int]appliedMigration, len(applied))
+	for _, a := range applied {
+		result[a.Version] = a
+	}
+
+	return result, nil
+}
+
+// Returns the state of every known migration of the selected driver
+func Status(ctx context.Context) ([]MigrationStatus, error) {
+	if db.Driver() == configuration.DriverSqlite {
+		return sqliteStatus(ctx)
+	}
+
+	database, err := db.Database()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := getApplied(ctx, database)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []MigrationStatus
+	for _, m := range All() {
+		a, isApplied := applied[m.Version]
+		result = append(result, MigrationStatus{
+			Version:     m.Version,
+			Description: m.Description,
+			Applied:     isApplied,
+			AppliedAt:   a.AppliedAt,
+		})
+	}
+
+	return result, nil
+}
+
+// Applies all pending migrations of the selected driver in order, stopping at the first failure
+func Run(ctx context.Context) error {
+	if db.Driver() == configuration.DriverSqlite {
+		return runSqlite(ctx)
+	}
+
+	database, err := db.Database()
+	if err != nil {
+		return err
+	}
+
+	applied, err := getApplied(ctx, database)
+	if err != nil {
+		return err
+	}
+
+	pending := 0
+	for _, m := range All() {
+		if _, isApplied := applied[m.Version]; isApplied {
+			continue
+		}
+
+		pending++
+		slog.Info("MIGRATE", "action", "apply", "version", m.Version, "description", m.Description)
+		if err := m.Up(ctx, database); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Description, err)
+		}
+
+		_, err := database.Collection(migrationsCollection).InsertOne(ctx, appliedMigration{
+			Version:     m.Version,
+			Description: m.Description,
+			AppliedAt:   time.Now().UTC(),
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d was applied but could not be recorded: %w", m.Version, err)
+		}
+	}
+
+	slog.Info("MIGRATE", "action", "run", "applied", pending, "known", len(mongoMigrations))
+	return nil
+}
+
+// ---------------------------------------------
+// HELPERS
+
+// Creates a collection unless it already exists
+func ensureCollection(ctx context.Context, database *mongo.Database, colName string) error {
+	err := database.CreateCollection(ctx, colName)
+
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Name == "NamespaceExists" {
+		return nil
+	}
+
+	return err
+}
+
+// Sets the JSON schema validator of a collection.
+// Uses the "moderate" level, so documents that were invalid before can still be updated.
+func setValidator(ctx context.Context, database *mongo.Database, colName string, schema bson.M) error {
+	if err := ensureCollection(ctx, database, colName); err != nil {
+		return err
+	}
+
+	return database.RunCommand(ctx, bson.D{
+		{"collMod", colName},
+		{"validator", bson.M{"$jsonSchema": schema}},
+		{"validationLevel", "moderate"},
+		{"validationAction", "error"},
+	}).Err()
+}
+
+// Drops an index unless it does not exist
+func dropIndex(ctx context.Context, database *mongo.Database, colName string, name string) error {
+	_, err := database.Collection(colName).Indexes().DropOne(ctx, name)
+
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && (cmdErr.Name == "IndexNotFound" || cmdErr.Name == "NamespaceNotFound") {
+		return nil
+	}
+
+	return err
+}
+
+func createIndexes(ctx context.Context, database *mongo.Database, colName string, indexes ...mongo.IndexModel) error {
+	_, err := database.Collection(colName).Indexes().CreateMany(ctx, indexes)
+	return err
+}
+
+func index(keys bson.D, name string) mongo.IndexModel {
+	return mongo.IndexModel{Keys: keys, Options: options.Index().SetName(name)}
+}
+
+func uniqueIndex(keys bson.D, name string) mongo.IndexModel {
+	return mongo.IndexModel{Keys: keys, Options: options.Index().SetName(name).SetUnique(true)}
+}
+
+func ttlIndex(field string, name string, ttl time.Duration) mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys:    bson.D{{field, 1}},
+		Options: options.Index().SetName(name).SetExpireAfterSeconds(int32(ttl.Seconds())),
+	}
+}
@@ -0,0 +1,288 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/thisisnttheway/hx-monitor/db"
+)
+
+// Append only. Never change or reorder a migration that may already have been applied somewhere.
+var sqliteMigrations = []SqlMigration{
+	{
+		Version:     1,
+		Description: "Create tables and indexes",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS numbers (
+				id               TEXT PRIMARY KEY,
+				name             TEXT NOT NULL UNIQUE CHECK (name <> ''),
+				number           TEXT NOT NULL CHECK (number <> ''),
+				last_called      TEXT NOT NULL,
+				last_call_status TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE INDEX IF NOT EXISTS numbers_number ON numbers (number)`,
+
+			`CREATE TABLE IF NOT EXISTS hx_areas (
+				id                     TEXT PRIMARY KEY,
+				name                   TEXT NOT NULL UNIQUE CHECK (name <> ''),
+				number_name            TEXT NOT NULL,
+				next_action            TEXT NOT NULL,
+				last_action            TEXT NOT NULL,
+				last_action_success    INTEGER NOT NULL DEFAULT 0,
+				flight_operating_hours TEXT NOT NULL DEFAULT 'null',
+				sub_areas              TEXT NOT NULL DEFAULT '[]',
+				last_error             TEXT NOT NULL DEFAULT '',
+				num_errors             INTEGER NOT NULL DEFAULT 0 CHECK (num_errors >= 0),
+				paused                 INTEGER NOT NULL DEFAULT 0
+			)`,
+			`CREATE INDEX IF NOT EXISTS hx_areas_number_name ON hx_areas (number_name)`,
+			`CREATE INDEX IF NOT EXISTS hx_areas_next_action ON hx_areas (next_action)`,
+
+			`CREATE TABLE IF NOT EXISTS calls (
+				id        TEXT PRIMARY KEY,
+				sid       TEXT NOT NULL,
+				time      TEXT NOT NULL,
+				status    TEXT NOT NULL,
+				cost      TEXT NOT NULL DEFAULT '',
+				number_id TEXT NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS calls_sid ON calls (sid)`,
+			`CREATE INDEX IF NOT EXISTS calls_number_id_time ON calls (number_id, time)`,
+
+			`CREATE TABLE IF NOT EXISTS transcripts (
+				id         TEXT PRIMARY KEY,
+				transcript TEXT NOT NULL,
+				date       TEXT NOT NULL,
+				cost       TEXT NOT NULL DEFAULT '',
+				number_id  TEXT NOT NULL,
+				hx_area_id TEXT NOT NULL,
+				call_sid   TEXT NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS transcripts_hx_area_id_date ON transcripts (hx_area_id, date)`,
+			`CREATE INDEX IF NOT EXISTS transcripts_call_sid ON transcripts (call_sid)`,
+
+			`CREATE TABLE IF NOT EXISTS api_keys (
+				id         TEXT PRIMARY KEY,
+				name       TEXT NOT NULL,
+				prefix     TEXT NOT NULL,
+				key_hash   TEXT NOT NULL UNIQUE,
+				scopes     TEXT NOT NULL,
+				created_at TEXT NOT NULL,
+				created_by TEXT NOT NULL,
+				last_used  TEXT NOT NULL,
+				revoked    INTEGER NOT NULL DEFAULT 0
+			)`,
+
+			`CREATE TABLE IF NOT EXISTS audit_log (
+				id        TEXT PRIMARY KEY,
+				time      TEXT NOT NULL,
+				actor     TEXT NOT NULL,
+				"action"  TEXT NOT NULL,
+				target    TEXT NOT NULL,
+				"before"  TEXT,
+				"after"   TEXT,
+				remote_ip TEXT NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS audit_log_time ON audit_log (time)`,
+			`CREATE INDEX IF NOT EXISTS audit_log_target_time ON audit_log (target, time)`,
+			`CREATE INDEX IF NOT EXISTS audit_log_actor_time ON audit_log (actor, time)`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "Merge calls into one row per call SID",
+		Statements: []string{
+			`CREATE TABLE calls_merged (
+				id            TEXT PRIMARY KEY,
+				sid           TEXT NOT NULL UNIQUE,
+				time          TEXT NOT NULL,
+				updated_at    TEXT NOT NULL,
+				status        TEXT NOT NULL,
+				timeline      TEXT NOT NULL DEFAULT '[]',
+				duration      INTEGER NOT NULL DEFAULT 0 CHECK (duration >= 0),
+				price         TEXT NOT NULL DEFAULT '',
+				price_unit    TEXT NOT NULL DEFAULT '',
+				number_id     TEXT NOT NULL,
+				hx_area_id    TEXT NOT NULL,
+				transcript_id TEXT NOT NULL,
+				parse_success INTEGER NOT NULL DEFAULT 0,
+				parse_error   TEXT NOT NULL DEFAULT ''
+			)`,
+			`INSERT INTO calls_merged (id, sid, time, updated_at, status, timeline, number_id, hx_area_id, transcript_id)
+			SELECT
+				(SELECT id FROM calls f WHERE f.sid = c.sid ORDER BY f.time LIMIT 1),
+				c.sid,
+				MIN(c.time),
+				MAX(c.time),
+				(SELECT status FROM calls l WHERE l.sid = c.sid ORDER BY l.time DESC LIMIT 1),
+				(SELECT json_group_array(json_object('status', e.status, 'time', e.time, 'sequence_number', 0))
+					FROM (SELECT status, time FROM calls e WHERE e.sid = c.sid ORDER BY e.time) e),
+				(SELECT number_id FROM calls f WHERE f.sid = c.sid ORDER BY f.time LIMIT 1),
+				'000000000000000000000000',
+				'000000000000000000000000'
+			FROM calls c
+			GROUP BY c.sid`,
+			`DROP TABLE calls`,
+			`ALTER TABLE calls_merged RENAME TO calls`,
+			`CREATE INDEX calls_hx_area_id_time ON calls (hx_area_id, time)`,
+		},
+	},
+	{
+		Version:     3,
+		Description: "Track when areas were last parsed successfully",
+		Statements: []string{
+			`ALTER TABLE hx_areas ADD COLUMN last_success TEXT NOT NULL DEFAULT '0001-01-01T00:00:00.000000000Z'`,
+			`UPDATE hx_areas SET last_success = last_action WHERE last_action_success = 1`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "Track the retry state of areas",
+		Statements: []string{
+			`ALTER TABLE hx_areas ADD COLUMN last_failure TEXT NOT NULL DEFAULT '0001-01-01T00:00:00.000000000Z'`,
+			`ALTER TABLE hx_areas ADD COLUMN retry_state TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "Normalize numbers to E.164",
+		// Mirrors phone.Normalize. Numbers that are still invalid fail when they are called.
+		Statements: []string{
+			`UPDATE numbers SET number = REPLACE(REPLACE(REPLACE(REPLACE(REPLACE(REPLACE(REPLACE(TRIM(number),
+				'(0)', ''), ' ', ''), '-', ''), '.', ''), '(', ''), ')', ''), '/', '')`,
+			`UPDATE numbers SET number = '+' || SUBSTR(number, 3) WHERE number LIKE '00%'`,
+			`UPDATE numbers SET number = '+41' || SUBSTR(number, 2) WHERE number LIKE '0%'`,
+			`UPDATE numbers SET number = '+41' || number WHERE number NOT LIKE '+%'`,
+		},
+	},
+	{
+		Version:     6,
+		Description: "Add call scripts to numbers",
+		Statements: []string{
+			`ALTER TABLE numbers ADD COLUMN script TEXT NOT NULL DEFAULT 'null'`,
+		},
+	},
+}
+
+const sqliteMigrationsTable string = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version     INTEGER PRIMARY KEY,
+	description TEXT NOT NULL,
+	applied_at  TEXT NOT NULL
+)`
+
+// Returns all known SQLite migrations in ascending order
+func AllSql() []SqlMigration {
+	result := append([]SqlMigration{}, sqliteMigrations...)
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Version < result[j].Version
+	})
+
+	return result
+}
+
+func getAppliedSqlite(ctx context.Context, database *sql.DB) (map[int]time.Time, error) {
+	if _, err := database.ExecContext(ctx, sqliteMigrationsTable); err != nil {
+		return nil, err
+	}
+
+	rows, err := database.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+
+		result[version], _ = time.Parse(time.RFC3339, appliedAt)
+	}
+
+	return result, rows.Err()
+}
+
+func sqliteStatus(ctx context.Context) ([]MigrationStatus, error) {
+	database, err := db.SqliteDB()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := getAppliedSqlite(ctx, database)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []MigrationStatus
+	for _, m := range AllSql() {
+		appliedAt, isApplied := applied[m.Version]
+		result = append(result, MigrationStatus{
+			Version:     m.Version,
+			Description: m.Description,
+			Applied:     isApplied,
+			AppliedAt:   appliedAt,
+		})
+	}
+
+	return result, nil
+}
+
+func runSqlite(ctx context.Context) error {
+	database, err := db.SqliteDB()
+	if err != nil {
+		return err
+	}
+
+	applied, err := getAppliedSqlite(ctx, database)
+	if err != nil {
+		return err
+	}
+
+	pending := 0
+	for _, m := range AllSql() {
+		if _, isApplied := applied[m.Version]; isApplied {
+			continue
+		}
+
+		pending++
+		slog.Info("MIGRATE", "action", "apply", "version", m.Version, "description", m.Description)
+		if err := applySqlite(ctx, database, m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Description, err)
+		}
+	}
+
+	slog.Info("MIGRATE", "action", "run", "applied", pending, "known", len(sqliteMigrations))
+	return nil
+}
+
+// Applies a migration and records it in the same transaction
+func applySqlite(ctx context.Context, database *sql.DB, m SqlMigration) error {
+	tx, err := database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range m.Statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT OR IGNORE INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)",
+		m.Version, m.Description, time.Now().UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
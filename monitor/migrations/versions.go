@@ -0,0 +1,415 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/thisisnttheway/hx-monitor/db"
+	"github.com/thisisnttheway/hx-monitor/models"
+	"github.com/thisisnttheway/hx-monitor/phone"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Calls are only needed to determine whether the latest call of an area completed
+const callsRetention time.Duration = 90 * 24 * time.Hour
+
+// Append only. Never change or reorder a migration that may already have been applied somewhere.
+var mongoMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "Create indexes for lookups and $lookup pipelines",
+		Up: func(ctx context.Context, database *mongo.Database) error {
+			if err := createIndexes(ctx, database, db.NumberCollection,
+				uniqueIndex(bson.D{{"name", 1}}, "name_unique"),
+				index(bson.D{{"number", 1}}, "number"),
+			); err != nil {
+				return err
+			}
+
+			if err := createIndexes(ctx, database, db.AreaCollection,
+				uniqueIndex(bson.D{{"name", 1}}, "name_unique"),
+				index(bson.D{{"number_name", 1}}, "number_name"),
+				index(bson.D{{"next_action", 1}}, "next_action"),
+			); err != nil {
+				return err
+			}
+
+			if err := createIndexes(ctx, database, db.CallCollection,
+				index(bson.D{{"sid", 1}}, "sid"),
+				index(bson.D{{"number_id", 1}, {"time", -1}}, "number_id_time"),
+			); err != nil {
+				return err
+			}
+
+			if err := createIndexes(ctx, database, db.TranscriptCollection,
+				index(bson.D{{"hx_area_id", 1}, {"date", -1}}, "hx_area_id_date"),
+				index(bson.D{{"call_sid", 1}}, "call_sid"),
+			); err != nil {
+				return err
+			}
+
+			// Collections of api-backend
+			if err := createIndexes(ctx, database, db.APIKeyCollection,
+				uniqueIndex(bson.D{{"key_hash", 1}}, "key_hash_unique"),
+			); err != nil {
+				return err
+			}
+
+			return createIndexes(ctx, database, db.AuditCollection,
+				index(bson.D{{"time", -1}}, "time"),
+				index(bson.D{{"target", 1}, {"time", -1}}, "target_time"),
+				index(bson.D{{"actor", 1}, {"time", -1}}, "actor_time"),
+			)
+		},
+	},
+	{
+		Version:     2,
+		Description: "Backfill fields added to hx_areas after the initial seed",
+		Up: func(ctx context.Context, database *mongo.Database) error {
+			areas := database.Collection(db.AreaCollection)
+			backfills := []struct {
+				field string
+				value interface{}
+			}{
+				{"paused", false},
+				{"num_errors", 0},
+				{"last_error", ""},
+				{"last_action_success", false},
+				{"sub_areas", bson.A{}},
+			}
+
+			for _, b := range backfills {
+				_, err := areas.UpdateMany(ctx,
+					bson.M{b.field: bson.M{"$exists": false}},
+					bson.D{{"$set", bson.D{{b.field, b.value}}}},
+				)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		Version:     3,
+		Description: "Add JSON schema validators",
+		Up: func(ctx context.Context, database *mongo.Database) error {
+			number := bson.A{"int", "long", "double"}
+			nullableDate := bson.A{"date", "null"}
+
+			if err := setValidator(ctx, database, db.NumberCollection, bson.M{
+				"bsonType": "object",
+				"required": bson.A{"name", "number"},
+				"properties": bson.M{
+					"name":   bson.M{"bsonType": "string", "minLength": 1},
+					"number": bson.M{"bsonType": "string", "minLength": 1},
+				},
+			}); err != nil {
+				return err
+			}
+
+			if err := setValidator(ctx, database, db.AreaCollection, bson.M{
+				"bsonType": "object",
+				"required": bson.A{"name", "number_name"},
+				"properties": bson.M{
+					"name":                   bson.M{"bsonType": "string", "minLength": 1},
+					"number_name":            bson.M{"bsonType": "string"},
+					"next_action":            bson.M{"bsonType": nullableDate},
+					"last_action":            bson.M{"bsonType": nullableDate},
+					"last_action_success":    bson.M{"bsonType": "bool"},
+					"last_error":             bson.M{"bsonType": "string"},
+					"num_errors":             bson.M{"bsonType": number, "minimum": 0},
+					"paused":                 bson.M{"bsonType": "bool"},
+					"flight_operating_hours": bson.M{"bsonType": bson.A{"array", "null"}, "items": bson.M{"bsonType": "date"}},
+					"sub_areas": bson.M{
+						"bsonType": bson.A{"array", "null"},
+						"items": bson.M{
+							"bsonType": "object",
+							"required": bson.A{"name", "full_name"},
+							"properties": bson.M{
+								"name":      bson.M{"bsonType": "string"},
+								"full_name": bson.M{"bsonType": "string"},
+								"active":    bson.M{"bsonType": "bool"},
+							},
+						},
+					},
+				},
+			}); err != nil {
+				return err
+			}
+
+			if err := setValidator(ctx, database, db.CallCollection, bson.M{
+				"bsonType": "object",
+				"required": bson.A{"sid", "time", "status"},
+				"properties": bson.M{
+					"sid":       bson.M{"bsonType": "string"},
+					"time":      bson.M{"bsonType": "date"},
+					"status":    bson.M{"bsonType": "string"},
+					"number_id": bson.M{"bsonType": "objectId"},
+				},
+			}); err != nil {
+				return err
+			}
+
+			return setValidator(ctx, database, db.TranscriptCollection, bson.M{
+				"bsonType": "object",
+				"required": bson.A{"transcript", "date", "hx_area_id"},
+				"properties": bson.M{
+					"transcript": bson.M{"bsonType": "string"},
+					"date":       bson.M{"bsonType": "date"},
+					"hx_area_id": bson.M{"bsonType": "objectId"},
+					"number_id":  bson.M{"bsonType": "objectId"},
+					"call_sid":   bson.M{"bsonType": "string"},
+				},
+			})
+		},
+	},
+	{
+		Version:     4,
+		Description: "Expire old calls",
+		Up: func(ctx context.Context, database *mongo.Database) error {
+			return createIndexes(ctx, database, db.CallCollection,
+				ttlIndex("time", "time_ttl", callsRetention),
+			)
+		},
+	},
+	{
+		Version:     5,
+		Description: "Merge calls into one document per call SID",
+		Up: func(ctx context.Context, database *mongo.Database) error {
+			if err := mergeCallEvents(ctx, database); err != nil {
+				return err
+			}
+
+			// Replaced by a unique index on the same key, and calls are no longer looked up by number
+			for _, name := range []string{"sid", "number_id_time"} {
+				if err := dropIndex(ctx, database, db.CallCollection, name); err != nil {
+					return err
+				}
+			}
+
+			if err := createIndexes(ctx, database, db.CallCollection,
+				uniqueIndex(bson.D{{"sid", 1}}, "sid_unique"),
+				index(bson.D{{"hx_area_id", 1}, {"time", -1}}, "hx_area_id_time"),
+			); err != nil {
+				return err
+			}
+
+			return setValidator(ctx, database, db.CallCollection, bson.M{
+				"bsonType": "object",
+				"required": bson.A{"sid", "time", "status", "timeline"},
+				"properties": bson.M{
+					"sid":        bson.M{"bsonType": "string"},
+					"time":       bson.M{"bsonType": "date"},
+					"updated_at": bson.M{"bsonType": "date"},
+					"status":     bson.M{"bsonType": "string"},
+					"timeline": bson.M{
+						"bsonType": "array",
+						"items": bson.M{
+							"bsonType": "object",
+							"required": bson.A{"status", "time"},
+							"properties": bson.M{
+								"status": bson.M{"bsonType": "string"},
+								"time":   bson.M{"bsonType": "date"},
+							},
+						},
+					},
+					"duration":      bson.M{"bsonType": bson.A{"int", "long"}, "minimum": 0},
+					"number_id":     bson.M{"bsonType": "objectId"},
+					"hx_area_id":    bson.M{"bsonType": "objectId"},
+					"transcript_id": bson.M{"bsonType": "objectId"},
+					"parse_success": bson.M{"bsonType": "bool"},
+					"parse_error":   bson.M{"bsonType": "string"},
+				},
+			})
+		},
+	},
+	{
+		Version:     6,
+		Description: "Track when areas were last parsed successfully",
+		Up: func(ctx context.Context, database *mongo.Database) error {
+			areas := database.Collection(db.AreaCollection)
+			_, err := areas.UpdateMany(ctx,
+				bson.M{"last_success": bson.M{"$exists": false}, "last_action_success": true},
+				mongo.Pipeline{bson.D{{"$set", bson.D{{"last_success", "$last_action"}}}}},
+			)
+			if err != nil {
+				return err
+			}
+
+			_, err = areas.UpdateMany(ctx,
+				bson.M{"last_success": bson.M{"$exists": false}},
+				bson.D{{"$set", bson.D{{"last_success", time.Time{}}}}},
+			)
+			return err
+		},
+	},
+	{
+		Version:     7,
+		Description: "Track the retry state of areas",
+		Up: func(ctx context.Context, database *mongo.Database) error {
+			_, err := database.Collection(db.AreaCollection).UpdateMany(ctx,
+				bson.M{"retry_state": bson.M{"$exists": false}},
+				bson.D{{"$set", bson.D{{"last_failure", time.Time{}}, {"retry_state", models.RetryNone}}}},
+			)
+			return err
+		},
+	},
+	{
+		Version:     8,
+		Description: "Normalize numbers to E.164",
+		Up: func(ctx context.Context, database *mongo.Database) error {
+			if err := normalizeNumbers(ctx, database); err != nil {
+				return err
+			}
+
+			return setValidator(ctx, database, db.NumberCollection, bson.M{
+				"bsonType": "object",
+				"required": bson.A{"name", "number"},
+				"properties": bson.M{
+					"name":   bson.M{"bsonType": "string", "minLength": 1},
+					"number": bson.M{"bsonType": "string", "pattern": `^\+[1-9]\d{6,14}$`},
+				},
+			})
+		},
+	},
+	{
+		Version:     9,
+		Description: "Add call scripts to numbers",
+		Up: func(ctx context.Context, database *mongo.Database) error {
+			return setValidator(ctx, database, db.NumberCollection, bson.M{
+				"bsonType": "object",
+				"required": bson.A{"name", "number"},
+				"properties": bson.M{
+					"name":   bson.M{"bsonType": "string", "minLength": 1},
+					"number": bson.M{"bsonType": "string", "pattern": `^\+[1-9]\d{6,14}$`},
+					"script": bson.M{
+						"bsonType": bson.A{"array", "null"},
+						"items": bson.M{
+							"bsonType": "object",
+							"required": bson.A{"action"},
+							"properties": bson.M{
+								"action":   bson.M{"enum": bson.A{models.CallStepWait, models.CallStepDigits, models.CallStepLanguage}},
+								"seconds":  bson.M{"bsonType": bson.A{"int", "long"}, "minimum": 1},
+								"digits":   bson.M{"bsonType": "string", "pattern": `^[0-9*#w]+$`},
+								"language": bson.M{"bsonType": "string"},
+							},
+						},
+					},
+				},
+			})
+		},
+	},
+}
+
+// Rewrites numbers in E.164 format. Numbers that can not be normalized are kept and fail when they are called.
+func normalizeNumbers(ctx context.Context, database *mongo.Database) error {
+	numbers := database.Collection(db.NumberCollection)
+	cursor, err := numbers.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	normalized := 0
+	for cursor.Next(ctx) {
+		var number models.Number
+		if err := cursor.Decode(&number); err != nil {
+			return err
+		}
+
+		e164, err := phone.Normalize(number.Number)
+		if err != nil {
+			slog.Warn("MIGRATE", "action", "normalizeNumber", "name", number.Name, "number", number.Number, "error", err)
+			continue
+		}
+		if e164 == number.Number {
+			continue
+		}
+
+		_, err = numbers.UpdateOne(ctx, bson.M{"_id": number.ID}, bson.D{{"$set", bson.D{{"number", e164}}}})
+		if err != nil {
+			return err
+		}
+		normalized++
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	slog.Info("MIGRATE", "action", "normalizeNumbers", "normalized", normalized)
+	return nil
+}
+
+// Merges the documents that used to be inserted for every status callback into one document per call SID.
+// The merged document is written before the originals are deleted, so that a retry can not lose calls.
+func mergeCallEvents(ctx context.Context, database *mongo.Database) error {
+	calls := database.Collection(db.CallCollection)
+	cursor, err := calls.Aggregate(ctx, mongo.Pipeline{
+		bson.D{{"$match", bson.M{"timeline": bson.M{"$exists": false}}}},
+		bson.D{{"$sort", bson.D{{"time", 1}}}},
+		bson.D{{"$group", bson.D{
+			{"_id", "$sid"},
+			{"ids", bson.M{"$push": "$_id"}},
+			{"time", bson.M{"$first": "$time"}},
+			{"updated_at", bson.M{"$last": "$time"}},
+			{"status", bson.M{"$last": "$status"}},
+			{"number_id", bson.M{"$first": "$number_id"}},
+			{"timeline", bson.M{"$push": bson.M{"status": "$status", "time": "$time", "sequence_number": 0}}},
+		}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	merged := 0
+	for cursor.Next(ctx) {
+		var group struct {
+			SID       string               `bson:"_id"`
+			IDs       []primitive.ObjectID `bson:"ids"`
+			Time      time.Time            `bson:"time"`
+			UpdatedAt time.Time            `bson:"updated_at"`
+			Status    string               `bson:"status"`
+			NumberID  primitive.ObjectID   `bson:"number_id"`
+			Timeline  []models.CallEvent   `bson:"timeline"`
+		}
+		if err := cursor.Decode(&group); err != nil {
+			return err
+		}
+
+		_, err := calls.UpdateOne(ctx,
+			bson.M{"sid": group.SID, "timeline": bson.M{"$exists": true}},
+			bson.D{{"$setOnInsert", models.Call{
+				ID:        primitive.NewObjectID(),
+				SID:       group.SID,
+				Time:      group.Time,
+				UpdatedAt: group.UpdatedAt,
+				Status:    group.Status,
+				Timeline:  group.Timeline,
+				NumberID:  group.NumberID,
+			}}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return fmt.Errorf("could not merge calls of '%s': %w", group.SID, err)
+		}
+
+		if _, err := calls.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": group.IDs}}); err != nil {
+			return err
+		}
+		merged++
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	slog.Info("MIGRATE", "action", "mergeCallEvents", "calls", merged)
+	return nil
+}
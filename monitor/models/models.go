@@ -1,6 +1,9 @@
 package models
 
 import (
+	"fmt"
+	"regexp"
+	"slices"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -14,6 +17,88 @@ type Number struct {
 	Number         string             `bson:"number" json:"number"`
 	LastCalled     time.Time          `bson:"last_called" json:"last_called"`
 	LastCallStatus string             `bson:"last_call_status" json:"last_call_status"`
+	Script         CallScript         `bson:"script" json:"script"`
+}
+
+// Steps to navigate the menu of a phone system before its announcement plays, e.g. to select a language or area
+type CallScript []CallStep
+
+type CallStep struct {
+	Action   string `bson:"action" json:"action"`
+	Seconds  int    `bson:"seconds,omitempty" json:"seconds,omitempty"`   // CallStepWait
+	Digits   string `bson:"digits,omitempty" json:"digits,omitempty"`     // CallStepDigits, CallStepLanguage
+	Language string `bson:"language,omitempty" json:"language,omitempty"` // CallStepLanguage, e.g. "en-US"
+}
+
+const (
+	// Waits for Seconds, e.g. for the menu to be read
+	CallStepWait string = "wait"
+
+	// Presses Digits. 'w' waits for half a second, e.g. "ww1"
+	CallStepDigits string = "digits"
+
+	// Presses Digits to select a language, the announcement is then transcribed in Language
+	CallStepLanguage string = "language"
+)
+
+const maxCallStepWait int = 60
+
+var (
+	callStepDigits   = regexp.MustCompile(`^[0-9*#w]+$`)
+	callStepLanguage = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2})?$`)
+)
+
+func (s CallScript) Validate() error {
+	languages := 0
+	for i, step := range s {
+		switch step.Action {
+		case CallStepWait:
+			if step.Seconds < 1 || step.Seconds > maxCallStepWait {
+				return fmt.Errorf("step %d: 'seconds' must be between 1 and %d", i, maxCallStepWait)
+			}
+		case CallStepDigits:
+			if !callStepDigits.MatchString(step.Digits) {
+				return fmt.Errorf("step %d: 'digits' must only contain 0-9, '*', '#' and 'w'", i)
+			}
+		case CallStepLanguage:
+			if step.Digits != "" && !callStepDigits.MatchString(step.Digits) {
+				return fmt.Errorf("step %d: 'digits' must only contain 0-9, '*', '#' and 'w'", i)
+			}
+			if !callStepLanguage.MatchString(step.Language) {
+				return fmt.Errorf("step %d: 'language' must be a language code like 'en-US'", i)
+			}
+			languages++
+		default:
+			return fmt.Errorf("step %d: unknown action '%s'", i, step.Action)
+		}
+	}
+
+	if languages > 1 {
+		return fmt.Errorf("only one language can be selected")
+	}
+
+	return nil
+}
+
+// Language selected by the script, empty if none is
+func (s CallScript) Language() string {
+	for _, step := range s {
+		if step.Action == CallStepLanguage {
+			return step.Language
+		}
+	}
+
+	return ""
+}
+
+// Approximate time it takes to run the script, each digit takes about half a second
+func (s CallScript) Length() time.Duration {
+	var length time.Duration
+	for _, step := range s {
+		length += time.Duration(step.Seconds)*time.Second + time.Duration(len(step.Digits))*500*time.Millisecond
+	}
+
+	return length
 }
 
 type HXArea struct {
@@ -22,26 +107,61 @@ type HXArea struct {
 	NextAction           time.Time          `bson:"next_action" json:"next_action"`
 	LastAction           time.Time          `bson:"last_action" json:"last_action"`
 	LastActionSuccess    bool               `bson:"last_action_success" json:"last_action_success"`
+	LastSuccess          time.Time          `bson:"last_success" json:"last_success"`
 	FlightOperatingHours []time.Time        `bson:"flight_operating_hours" json:"flight_operating_hours"`
 	SubAreas             []HXSubArea        `bson:"sub_areas" json:"sub_areas"`
 	NumberName           string             `bson:"number_name" json:"number_name"`
 	LastError            string             `bson:"last_error" json:"last_error"`
 	NumErrors            int8               `bson:"num_errors" json:"num_errors"`
+	LastFailure          time.Time          `bson:"last_failure" json:"last_failure"`
+	RetryState           string             `bson:"retry_state" json:"retry_state"`
+	Paused               bool               `bson:"paused" json:"paused"`
 }
 
+// Retry states of an area, its next_action is the time of the next attempt
+const (
+	RetryNone    string = ""
+	RetryBackoff string = "backoff"
+	RetryCoolOff string = "cool-off"
+)
+
 type HXSubArea struct {
 	FullName string `bson:"full_name" json:"full_name"`
 	Name     string `bson:"name" json:"name"`
 	Active   bool   `bson:"active" json:"active"`
 }
 
+// One document per call, updated as status callbacks arrive
 type Call struct {
-	ID       primitive.ObjectID `bson:"_id" json:"id"`
-	SID      string             `bson:"sid" json:"sid"`
-	Time     time.Time          `bson:"time" json:"time"`
-	Status   string             `bson:"status" json:"status"`
-	Cost     string             `bson:"cost" json:"cost"`
-	NumberID primitive.ObjectID `bson:"number_id" json:"number_id"`
+	ID           primitive.ObjectID `bson:"_id" json:"id"`
+	SID          string             `bson:"sid" json:"sid"`
+	Time         time.Time          `bson:"time" json:"time"`
+	UpdatedAt    time.Time          `bson:"updated_at" json:"updated_at"`
+	Status       string             `bson:"status" json:"status"`
+	Timeline     []CallEvent        `bson:"timeline" json:"timeline"`
+	Duration     int                `bson:"duration" json:"duration"`
+	Price        string             `bson:"price" json:"price"`
+	PriceUnit    string             `bson:"price_unit" json:"price_unit"`
+	NumberID     primitive.ObjectID `bson:"number_id" json:"number_id"`
+	HXAreaID     primitive.ObjectID `bson:"hx_area_id" json:"hx_area_id"`
+	TranscriptID primitive.ObjectID `bson:"transcript_id" json:"transcript_id"`
+	ParseSuccess bool               `bson:"parse_success" json:"parse_success"`
+	ParseError   string             `bson:"parse_error" json:"parse_error"`
+}
+
+// A status reported for a call
+type CallEvent struct {
+	Status         string    `bson:"status" json:"status"`
+	Time           time.Time `bson:"time" json:"time"`
+	SequenceNumber int       `bson:"sequence_number" json:"sequence_number"`
+}
+
+// Statuses after which a call will not change anymore
+var FinishedCallStates = []string{"completed", "busy", "no-answer", "canceled", "failed"}
+
+// Whether the call has reached a final status
+func (c Call) IsFinished() bool {
+	return slices.Contains(FinishedCallStates, c.Status)
 }
 
 type Transcript struct {
@@ -54,6 +174,29 @@ type Transcript struct {
 	CallSID    string             `bson:"call_sid" json:"call_sid"`
 }
 
+type AuditLogEntry struct {
+	ID       primitive.ObjectID `bson:"_id" json:"id"`
+	Time     time.Time          `bson:"time" json:"time"`
+	Actor    string             `bson:"actor" json:"actor"`
+	Action   string             `bson:"action" json:"action"`
+	Target   string             `bson:"target" json:"target"`
+	Before   interface{}        `bson:"before,omitempty" json:"before,omitempty"`
+	After    interface{}        `bson:"after,omitempty" json:"after,omitempty"`
+	RemoteIP string             `bson:"remote_ip" json:"remote_ip"`
+}
+
+type APIKey struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	Name      string             `bson:"name" json:"name"`
+	Prefix    string             `bson:"prefix" json:"prefix"`
+	KeyHash   string             `bson:"key_hash" json:"-"`
+	Scopes    []string           `bson:"scopes" json:"scopes"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	CreatedBy string             `bson:"created_by" json:"created_by"`
+	LastUsed  time.Time          `bson:"last_used" json:"last_used"`
+	Revoked   bool               `bson:"revoked" json:"revoked"`
+}
+
 // ---------------------------------------------
 // PARSER
 type AirspaceMeiringenStatus struct {
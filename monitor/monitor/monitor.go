@@ -1,18 +1,25 @@
 package monitor
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math"
+	"slices"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/thisisnttheway/hx-monitor/caller"
 	"github.com/thisisnttheway/hx-monitor/db"
 	"github.com/thisisnttheway/hx-monitor/logger"
+	"github.com/thisisnttheway/hx-monitor/metrics"
 	"github.com/thisisnttheway/hx-monitor/models"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/thisisnttheway/hx-monitor/retry"
+	"github.com/thisisnttheway/hx-monitor/tracing"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ActionableNumber struct {
@@ -20,193 +27,340 @@ type ActionableNumber struct {
 	MustActNow bool
 }
 
-type CallConfiguration struct {
-	DoTranscription bool
-	DoRecording     bool
+var (
+	callStaleAfter time.Duration = 10 * time.Minute
+)
+
+// Places calls
+type Telephony interface {
+	Call(ctx context.Context, number models.Number) (caller.CallResponse, error)
 }
 
-var (
-	_callConfiguration CallConfiguration
+// Keeps track of the areas and calls their numbers when they are due.
+// Up to a fixed amount of areas are checked at once, but never two with the same number.
+// MonitorHxAreas must not be called concurrently.
+type Monitor struct {
+	telephony Telephony
 
-	// { "<area>": <num_fails> }
-	_areaFailureCounts map[string]int8 = make(map[string]int8)
+	// Holds a token for every area being checked
+	workers chan struct{}
+
+	// Dispatches and checks that have not completed yet
+	pending sync.WaitGroup
+
+	mu sync.Mutex
 
 	// { "<area>": <being_processed> }
-	_areaProcessingQueue   map[string]bool = make(map[string]bool)
-	maxFailsPerArea        int8            = 3
-	onErrorNextActionDelay time.Duration   = 5 * time.Minute
-)
+	areaProcessingQueue map[string]bool
 
-func init() {
-	_callConfiguration.DoTranscription = true
-	_callConfiguration.DoRecording = false
+	// Areas that are waiting for a worker or being checked
+	queued map[string]bool
+
+	// Number names that are being called by a check
+	busyNumbers map[string]bool
+
+	// Calls placed by checks that have not ended yet, see CallEnded
+	heldCalls map[string]models.HXArea
+
+	// { "<callSid>": <ended_at> } of calls that ended before their check held them
+	endedCalls map[string]time.Time
+}
+
+func New(telephony Telephony, workers int) *Monitor {
+	return &Monitor{
+		telephony:           telephony,
+		workers:             make(chan struct{}, max(workers, 1)),
+		areaProcessingQueue: make(map[string]bool),
+		queued:              make(map[string]bool),
+		busyNumbers:         make(map[string]bool),
+		heldCalls:           make(map[string]models.HXArea),
+		endedCalls:          make(map[string]time.Time),
+	}
 }
 
-func GetAreaProcessingState(areaName string) bool {
-	return _areaProcessingQueue[areaName]
+func (m *Monitor) GetAreaProcessingState(areaName string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.areaProcessingQueue[areaName]
 }
 
-func DeleteAreaFromProcessingQueue(areaName string) {
-	delete(_areaProcessingQueue, areaName)
+func (m *Monitor) DeleteAreaFromProcessingQueue(areaName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.areaProcessingQueue, areaName)
 }
 
-func setAreaProcessingState(areaName string, state bool) {
-	_areaProcessingQueue[areaName] = state
+func (m *Monitor) setAreaProcessingState(areaName string, state bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.areaProcessingQueue[areaName] = state
 }
 
-// Determines if an area is being processed based on its last_action timestamp and associated, non-completed calls
-func areasNumberIsBeingCalled(area models.HXArea) (bool, error) {
-	// based on models.HXArea
-	type AggregateResult struct {
-		AreaID      primitive.ObjectID `bson:"_id"`
-		AreaName    string             `bson:"name"`
-		CallDetails []models.Call      `bson:"call_details"`
+// Determines if the number of an area is being called for it or any other area with the same number
+func numberIsBeingCalled(ctx context.Context, area models.HXArea) (bool, error) {
+	areas, err := db.Areas.ListByNumberName(ctx, area.NumberName)
+	if err != nil {
+		slog.Error("MONITOR", "action", "listAreasByNumber", "error", err, "numberName", area.NumberName)
+		return false, err
 	}
 
-	results, err := db.Aggregate[AggregateResult]("hx_areas", mongo.Pipeline{
-		bson.D{{"$match", bson.M{"_id": area.ID}}},
-
-		// Enumerate numbers and calls
-		bson.D{{"$lookup", bson.D{
-			{"from", "numbers"},
-			{"localField", "number_name"},
-			{"foreignField", "name"},
-			{"as", "number_details"},
-		}}},
-		bson.D{{"$unwind", "$number_details"}},
-		bson.D{{"$lookup", bson.D{
-			{"from", "calls"},
-			{"localField", "number_details._id"},
-			{"foreignField", "number_id"},
-			{"as", "call_details"},
-		}}},
-
-		// Only return select fields and further filter call_details
-		bson.D{{"$project", bson.D{
-			{"_id", true},
-			{"name", true},
-			{"last_action", true},
-			{"call_details", bson.D{
-				{"$filter", bson.D{
-					{"input", "$call_details"},
-					{"cond", bson.D{
-						{"$gte", bson.A{"$$this.time", area.LastAction}},
-					}},
-				}}},
-			}},
-		}},
-	})
-	if err != nil {
+	for _, other := range areas {
+		if b, err := areaIsBeingCalled(ctx, other); b || err != nil {
+			return b, err
+		}
+	}
+
+	return false, nil
+}
+
+// Determines if an area is being processed based on the state of the latest call placed for it.
+// Calls that never reach a final state, e.g. due to lost callbacks, are given up on after callStaleAfter.
+func areaIsBeingCalled(ctx context.Context, area models.HXArea) (bool, error) {
+	call, err := db.Calls.GetLatestForArea(ctx, area.ID)
+	if errors.Is(err, db.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
 		slog.Error("MONITOR",
-			"action", "aggregateHxAreas",
+			"action", "getLatestCall",
 			"error", err,
 			"areaName", area.Name,
-			"areaLastAction", area.LastAction,
 			"areaId", area.ID,
 		)
 		return false, err
 	}
 
-	if len(results) == 0 {
+	isStale := time.Since(call.UpdatedAt) > callStaleAfter
+	slog.Debug("MONITOR",
+		"action", "getLatestCall",
+		"areaName", area.Name,
+		"callSid", call.SID,
+		"status", call.Status,
+		"updatedAt", call.UpdatedAt,
+	)
+
+	if call.IsFinished() {
+		return false, nil
+	}
+	if isStale {
 		slog.Warn("MONITOR",
-			"action", "aggregateHxAreas",
-			"message", "Length of aggregated result is 0",
+			"action", "getLatestCall",
+			"message", "Latest call has not finished in time, giving up on it",
 			"areaName", area.Name,
-			"areaLastAction", area.LastAction,
-			"areaId", area.ID,
+			"callSid", call.SID,
+			"status", call.Status,
+			"updatedAt", call.UpdatedAt,
 		)
-
 		return false, nil
 	}
 
-	hasCompletedCalls := false
-	if len(results[0].CallDetails) > 0 {
-		for _, s := range results[0].CallDetails {
-			if s.Status == "completed" {
-				hasCompletedCalls = true
-				break
-			}
-		}
-	} else {
-		// Either no calls have ever been made, or calls older than LastAction actually did complete
-		hasCompletedCalls = true
-		slog.Warn("MONITOR",
-			"action", "aggregateHxAreas",
-			"message", "Area has had no calls newer than referenceTime",
-			"areaName", area.Name,
-			"referenceTime", area.LastAction,
-			"areaId", area.ID,
+	return true, nil
+}
+
+// Call a number and either start transcription or recording
+func (m *Monitor) initCall(ctx context.Context, area models.HXArea, number models.Number) (caller.CallResponse, error) {
+	call, err := m.telephony.Call(ctx, number)
+	if err != nil {
+		kind := caller.Classify(err)
+		metrics.Calls.WithLabelValues("not-placed").Inc()
+		metrics.CallFailures.WithLabelValues(string(kind)).Inc()
+		slog.ErrorContext(ctx, "MONITOR",
+			"message", fmt.Sprintf("Failure calling number '%s'", number.Number),
+			"kind", kind,
+			"error", err,
 		)
+
+		return call, err
 	}
 
-	o, _ := json.Marshal(results)
-	slog.Debug("MONITOR",
-		"action", "aggregateHxAreas",
-		"areaName", area.Name,
-		"hasCompletedCalls", hasCompletedCalls,
-		"resultFromDb", string(o),
-	)
+	startedAt := call.DateCreated
+	if startedAt.IsZero() {
+		startedAt = time.Now()
+	}
 
-	// If area has completed calls = Area is not being processed
-	return !hasCompletedCalls, nil
-}
+	var price string
+	if call.Price != 0 {
+		price = strconv.FormatFloat(float64(call.Price), 'f', -1, 32)
 
-// Increments the amount of fails for an area and returns the amount of fails (post increment)
-func incrementAreaFails(areaName string) int8 {
-	v, ok := _areaFailureCounts[areaName]
-	if ok {
-		if v < maxFailsPerArea {
-			_areaFailureCounts[areaName] = v + 1
-		}
-	} else {
-		_areaFailureCounts[areaName] = 1
+		// Twilio reports charges as negative amounts
+		metrics.CallCost.WithLabelValues(call.PriceUnit).Add(math.Abs(float64(call.Price)))
 	}
 
-	return _areaFailureCounts[areaName]
+	err = db.Calls.Start(ctx, models.Call{
+		ID:        primitive.NewObjectID(),
+		SID:       call.SID,
+		Time:      startedAt,
+		Status:    call.Status,
+		Price:     price,
+		PriceUnit: call.PriceUnit,
+		NumberID:  number.ID,
+		HXAreaID:  area.ID,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "MONITOR", "action", "recordCall", "callSid", call.SID, "error", err)
+	}
+
+	return call, nil
 }
 
-// Removes area failures for a given area
-func removeAreaFails(areaName string) {
-	_, exists := _areaFailureCounts[areaName]
-	if exists {
-		delete(_areaFailureCounts, areaName)
+// Records a failed check of an area, so that it is retried according to the retry policy
+func recordFailure(ctx context.Context, area models.HXArea, err error) {
+	now := time.Now()
+	var callErr *caller.CallError
+	if errors.As(err, &callErr) && callErr.Permanent() {
+		retry.FailPermanently(&area, err.Error(), now)
+	} else {
+		retry.Fail(&area, err.Error(), now)
 	}
 
-	db.UpdateDocument(
-		"hx_areas",
-		bson.M{"name": areaName},
-		bson.D{{"$set",
-			bson.D{{"num_errors", 0}},
-		}},
+	slog.WarnContext(ctx, "MONITOR",
+		"action", "scheduleRetry",
+		"fails", area.NumErrors,
+		"retryState", area.RetryState,
+		"nextAction", area.NextAction,
+		"lastError", area.LastError,
 	)
+	if err := db.Areas.SetFailure(ctx, area); err != nil {
+		slog.ErrorContext(ctx, "MONITOR", "action", "setFailure", "error", err)
+	}
 }
 
-// Call a number and either start transcription or recording
-func initCall(number string) caller.CallResponse {
-	call, err := caller.Call(
-		number,
-		_callConfiguration.DoTranscription,
-		_callConfiguration.DoRecording,
+// Calls the number of a due area, unless it is already being called for any area.
+// Returns whether a call was placed, its number is then held until the call ends, see CallEnded.
+// Every check is traced on its own, the callbacks of the call join its trace.
+func (m *Monitor) checkArea(ctx context.Context, hxArea models.HXArea) bool {
+	ctx, span := tracing.Tracer().Start(ctx, "monitor.checkArea",
+		trace.WithNewRoot(),
+		trace.WithAttributes(tracing.Area.String(hxArea.Name)),
 	)
+	defer span.End()
+	ctx = logger.With(ctx, "areaName", hxArea.Name)
+
+	// Check if this number is not already being called, e.g. by another instance
+	b, err := numberIsBeingCalled(ctx, hxArea)
 	if err != nil {
-		slog.Error("MONITOR",
-			"message", fmt.Sprintf("Failure calling number '%s'", number),
+		slog.ErrorContext(ctx, "MONITOR",
+			"action", "scheduleCall",
+			"skip", true,
 			"error", err,
 		)
+		tracing.Fail(span, err)
+		return false
+	}
+	if b {
+		slog.InfoContext(ctx, "MONITOR",
+			"action", "scheduleCall",
+			"skip", true,
+		)
+		span.AddEvent("alreadyBeingCalled")
+		return false
+	}
+
+	// Failures have already been delayed by the retry policy when they were recorded
+	if hxArea.RetryState != models.RetryNone {
+		slog.InfoContext(ctx, "MONITOR",
+			"action", "retry",
+			"fails", hxArea.NumErrors,
+			"retryState", hxArea.RetryState,
+			"lastError", hxArea.LastError,
+		)
+		span.AddEvent("retry")
+	}
+
+	number, err := db.Numbers.GetByName(ctx, hxArea.NumberName)
+	if err != nil {
+		slog.ErrorContext(ctx, "MONITOR",
+			"message", fmt.Sprintf("Could not enumerate number '%s'", hxArea.NumberName),
+			"error", err.Error(),
+		)
+		tracing.Fail(span, err)
+
+		// Tried again on the next iteration, unless the number does not exist
+		if errors.Is(err, db.ErrNotFound) {
+			recordFailure(ctx, hxArea, caller.NewCallError(caller.FailureInvalidNumber, err))
+		}
+		return false
+	}
+
+	// Call and set last_action
+	slog.InfoContext(ctx, "MONITOR",
+		"action", "call",
+		"numberName", hxArea.NumberName,
+		"number", number.Number,
+	)
+	call, err := m.initCall(ctx, hxArea, number)
+	if err := db.Areas.SetLastAction(ctx, hxArea.ID, time.Now()); err != nil {
+		slog.ErrorContext(ctx, "MONITOR", "action", "setLastAction", "error", err)
+	}
+	if err != nil {
+		tracing.Fail(span, err)
+		recordFailure(ctx, hxArea, err)
+		return false
+	}
+
+	span.SetAttributes(tracing.CallSid.String(call.SID))
+
+	// Updating the rest of the area is being handled by the callback module
+	return m.holdCall(call.SID, hxArea)
+}
+
+// Keeps the number and area of a placed call busy until it ends.
+// Returns false if the call has already ended, the number is then not held.
+func (m *Monitor) holdCall(callSid string, area models.HXArea) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-		logger.LogErrorFatal("MONITOR", err.Error())
+	if _, ok := m.endedCalls[callSid]; ok {
+		delete(m.endedCalls, callSid)
+		return false
 	}
+	m.heldCalls[callSid] = area
+	m.areaProcessingQueue[area.Name] = true
 
-	return call
+	return true
 }
 
-// Monitor HX areas: Keep track of states and schedule calls if necessary
-func MonitorHxAreas() error {
-	hxAreas, err := db.GetDocument[models.HXArea]("hx_areas", bson.D{})
-	if len(hxAreas) == 0 || err != nil {
-		return fmt.Errorf("no hx_areas found (err: %v)", err)
+// Releases the number and area of a call once it is done or the watchdog gave up on it
+func (m *Monitor) CallEnded(callSid string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	area, ok := m.heldCalls[callSid]
+	if !ok {
+		// The check placing the call may not have held it yet
+		m.endedCalls[callSid] = time.Now()
+		for sid, endedAt := range m.endedCalls {
+			if time.Since(endedAt) > callStaleAfter {
+				delete(m.endedCalls, sid)
+			}
+		}
+		return
 	}
 
+	delete(m.heldCalls, callSid)
+	delete(m.busyNumbers, area.NumberName)
+	delete(m.areaProcessingQueue, area.Name)
+	slog.Debug("MONITOR", "event", "callEnded", "callSid", callSid, "areaName", area.Name, "numberName", area.NumberName)
+}
+
+// Monitor HX areas: Keep track of states and schedule calls if necessary.
+// Due areas are checked in the background, the most overdue first. Areas still being checked from a previous call are skipped.
+// Once ctx is done no further areas are checked, but the ongoing checks are completed, see Wait.
+func (m *Monitor) MonitorHxAreas(ctx context.Context) error {
+	stop := ctx
+	ctx = context.WithoutCancel(ctx)
+
+	hxAreas, err := db.Areas.List(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get hx_areas: %w", err)
+	}
+	if len(hxAreas) == 0 {
+		return fmt.Errorf("no hx_areas found: %w", db.ErrNotFound)
+	}
+
+	var due []models.HXArea
 	for _, hxArea := range hxAreas {
 		mustActNow := time.Now().UTC().After(hxArea.NextAction)
 		slog.Info("MONITOR",
@@ -214,96 +368,40 @@ func MonitorHxAreas() error {
 			"nextAction", hxArea.NextAction,
 			"numberName", hxArea.NumberName,
 			"numErrors", hxArea.NumErrors,
+			"retryState", hxArea.RetryState,
 			"mustActNow", mustActNow,
 			"lastActionSuccess", hxArea.LastActionSuccess,
+			"paused", hxArea.Paused,
 		)
 
+		if hxArea.Paused {
+			m.setAreaProcessingState(hxArea.Name, false)
+			continue
+		}
+
 		if mustActNow {
-			if GetAreaProcessingState(hxArea.Name) {
-				slog.Info("MONITOR_DEBUG", "event", "skipAreaDueToProcessingState", "area", hxArea.Name)
+			if m.GetAreaProcessingState(hxArea.Name) {
+				slog.Debug("MONITOR", "event", "skipAreaDueToProcessingState", "areaName", hxArea.Name)
 				continue
 			}
-
-			// Check if this number is not already being called
-			b, _ := areasNumberIsBeingCalled(hxArea)
-			if !b {
-				if !hxArea.LastActionSuccess {
-					areaFails := incrementAreaFails(hxArea.Name)
-					db.UpdateDocument(
-						"hx_areas",
-						bson.M{"_id": hxArea.ID},
-						bson.D{{"$set",
-							bson.D{{"num_errors", areaFails}},
-						}},
-					)
-
-					if areaFails >= maxFailsPerArea {
-						slog.Warn("MONITOR",
-							"message", "Have exceeded the max amount of retries for area",
-							"areaName", hxArea.Name,
-							"fails", areaFails,
-							"maxFails", maxFailsPerArea,
-							"skip", true,
-						)
-						continue
-					} else {
-						// Delay processing for X amount of time on next run
-						newNextAction := time.Now().Add(onErrorNextActionDelay)
-						err := db.UpdateDocument(
-							"hx_areas",
-							bson.M{"_id": hxArea.ID},
-							bson.D{{"$set",
-								bson.D{{"next_action", newNextAction}},
-							}},
-						)
-						if err != nil {
-							slog.Error("MONITOR", "action", "delayNextAction", "error", err)
-						}
-					}
-				}
-
-				setAreaProcessingState(hxArea.Name, true)
-
-				number, err := db.GetDocument[models.Number]("numbers", bson.M{"name": hxArea.NumberName})
-				if err != nil {
-					slog.Error("MONITOR",
-						"message", fmt.Sprintf("Could not enumerate number '%s'", hxArea.NumberName),
-						"error", err.Error(),
-					)
-					continue
-				}
-
-				// Call and set last_action
-				slog.Info("MONITOR",
-					"action", "call",
-					"numberName", hxArea.NumberName,
-					"number", number[0].Number,
-				)
-				initCall(number[0].Number)
-
-				db.UpdateDocument(
-					"hx_areas",
-					bson.M{"_id": hxArea.ID},
-					bson.D{{"$set",
-						bson.D{{"last_action", time.Now()}},
-					}},
-				)
-
-				// Updating the rest of the area is being handled by the callback module
-			} else {
-				slog.Info("MONTOR",
-					"action", "scheduleCall",
-					"skip", true,
-					"areaName", hxArea.Name,
-				)
+			if !m.enqueue(hxArea.Name) {
+				slog.Debug("MONITOR", "event", "skipAreaBeingChecked", "areaName", hxArea.Name)
+				continue
 			}
+
+			due = append(due, hxArea)
 		} else {
-			setAreaProcessingState(hxArea.Name, false)
-			if !hxArea.LastActionSuccess {
-				removeAreaFails(hxArea.Name)
-			}
+			m.setAreaProcessingState(hxArea.Name, false)
 		}
 	}
 
+	// Areas that had to wait, e.g. for their number, are not overtaken by areas that became due later
+	slices.SortStableFunc(due, func(a, b models.HXArea) int {
+		return a.NextAction.Compare(b.NextAction)
+	})
+
+	m.pending.Add(1)
+	go m.dispatch(stop, ctx, due)
+
 	return nil
 }
@@ -0,0 +1,89 @@
+package monitor
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/thisisnttheway/hx-monitor/models"
+)
+
+// Checks the given areas in order, each as soon as a worker is free, until stop is done
+func (m *Monitor) dispatch(stop context.Context, ctx context.Context, areas []models.HXArea) {
+	defer m.pending.Done()
+
+	for i, area := range areas {
+		select {
+		case m.workers <- struct{}{}:
+		case <-stop.Done():
+			slog.Info("MONITOR", "action", "stop", "message", "Not processing remaining areas", "remaining", len(areas)-i)
+			for _, skipped := range areas[i:] {
+				m.dequeue(skipped.Name)
+			}
+			return
+		}
+
+		// The area stays due and is checked again on the next iteration
+		if !m.lockNumber(area.NumberName) {
+			slog.Info("MONITOR", "action", "scheduleCall", "areaName", area.Name, "numberName", area.NumberName, "skip", true, "reason", "numberBusy")
+			<-m.workers
+			m.dequeue(area.Name)
+			continue
+		}
+
+		m.pending.Add(1)
+		go func() {
+			defer m.pending.Done()
+			defer func() { <-m.workers }()
+			defer m.dequeue(area.Name)
+
+			if !m.checkArea(ctx, area) {
+				m.unlockNumber(area.NumberName)
+			}
+		}()
+	}
+}
+
+// Waits until the checks started by MonitorHxAreas have completed
+func (m *Monitor) Wait() {
+	m.pending.Wait()
+}
+
+// Marks an area as queued, unless it already is
+func (m *Monitor) enqueue(areaName string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.queued[areaName] {
+		return false
+	}
+	m.queued[areaName] = true
+
+	return true
+}
+
+func (m *Monitor) dequeue(areaName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.queued, areaName)
+}
+
+// Reserves a number for a check, unless another check or its call holds it
+func (m *Monitor) lockNumber(numberName string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.busyNumbers[numberName] {
+		return false
+	}
+	m.busyNumbers[numberName] = true
+
+	return true
+}
+
+func (m *Monitor) unlockNumber(numberName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.busyNumbers, numberName)
+}
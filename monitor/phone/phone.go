@@ -0,0 +1,45 @@
+package phone
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Numbers without an international prefix are Swiss
+const DefaultCountryCode string = "41"
+
+var (
+	e164 = regexp.MustCompile(`^\+[1-9]\d{6,14}$`)
+
+	// Separators commonly used when writing numbers, and the national trunk prefix often written
+	// in brackets after the country code, e.g. "+41 (0)79 123 45 67"
+	separators = strings.NewReplacer("(0)", "", " ", "", "-", "", ".", "", "(", "", ")", "", "/", "")
+)
+
+// Converts a number to E.164, e.g. "+41791234567".
+// Accepts separators, the "00" international prefix and national numbers of DefaultCountryCode.
+func Normalize(number string) (string, error) {
+	result := separators.Replace(strings.TrimSpace(number))
+
+	switch {
+	case strings.HasPrefix(result, "+"):
+	case strings.HasPrefix(result, "00"):
+		result = "+" + result[2:]
+	case strings.HasPrefix(result, "0"):
+		result = "+" + DefaultCountryCode + result[1:]
+	default:
+		result = "+" + DefaultCountryCode + result
+	}
+
+	if !Valid(result) {
+		return "", fmt.Errorf("'%s' is not a valid phone number", number)
+	}
+
+	return result, nil
+}
+
+// Whether a number is in E.164 format
+func Valid(number string) bool {
+	return e164.MatchString(number)
+}
@@ -0,0 +1,66 @@
+package retry
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+
+	c "github.com/thisisnttheway/hx-monitor/configuration"
+	"github.com/thisisnttheway/hx-monitor/models"
+)
+
+// Records a failure of an area and moves its next_action to the next attempt, according to the retry policy.
+// The area still has to be saved.
+func Fail(area *models.HXArea, reason string, now time.Time) {
+	fail(area, reason, now, false)
+}
+
+// Records a failure that retrying will not fix, e.g. an invalid number, so that the area cools off right away
+func FailPermanently(area *models.HXArea, reason string, now time.Time) {
+	fail(area, reason, now, true)
+}
+
+func fail(area *models.HXArea, reason string, now time.Time, permanent bool) {
+	config := c.GetRetryConfig()
+
+	fails := area.NumErrors
+	if !area.LastFailure.IsZero() && now.Sub(area.LastFailure) > config.ResetAfter {
+		fails = 0
+	}
+	if fails < math.MaxInt8 {
+		fails++
+	}
+	if permanent {
+		fails = int8(max(int(fails), config.MaxAttempts))
+	}
+
+	delay, state := Delay(config, fails)
+	area.LastActionSuccess = false
+	area.LastError = reason
+	area.NumErrors = fails
+	area.LastFailure = now
+	area.RetryState = state
+	area.NextAction = now.Add(delay)
+}
+
+// Forgets the failures of an area after it has been checked successfully
+func Succeed(area *models.HXArea) {
+	area.NumErrors = 0
+	area.RetryState = models.RetryNone
+}
+
+// Returns how long to wait after the given amount of consecutive failures, and the resulting retry state.
+// Backs off exponentially until MaxAttempts is reached, then waits for CoolOff.
+func Delay(config c.RetryConfiguration, fails int8) (time.Duration, string) {
+	if int(fails) >= config.MaxAttempts {
+		return jitter(float64(config.CoolOff), config.Jitter), models.RetryCoolOff
+	}
+
+	delay := min(float64(config.InitialDelay)*math.Pow(config.Multiplier, float64(fails-1)), float64(config.MaxDelay))
+	return min(jitter(delay, config.Jitter), config.MaxDelay), models.RetryBackoff
+}
+
+// Varies a delay randomly by up to ±fraction, so that areas failing together are not retried together
+func jitter(delay float64, fraction float64) time.Duration {
+	return time.Duration(delay * (1 + fraction*(2*rand.Float64()-1)))
+}
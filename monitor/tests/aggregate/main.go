@@ -19,10 +19,6 @@ var mongoDatabase = getEnv("MONGODB_DATABASE", "hx")
 var client *mongo.Client
 var contextTimeout time.Duration = 6 * time.Second
 
-func init() {
-	client = Connect()
-}
-
 // Get environment variable with a default value
 func getEnv(key string, defaultValue string) string {
 	val, ok := os.LookupEnv(key)
@@ -83,6 +79,8 @@ func Aggregate[T any](colName string, pipeline mongo.Pipeline) ([]T, error) {
 }
 
 func main() {
+	client = Connect()
+
 	type AggregateResult struct {
 		AreaID      primitive.ObjectID `bson:"_id"`
 		AreaName    string             `bson:"name"`
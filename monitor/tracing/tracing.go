@@ -0,0 +1,121 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	c "github.com/thisisnttheway/hx-monitor/configuration"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName string = "github.com/thisisnttheway/hx-monitor"
+
+// Span attributes
+const (
+	Area       = attribute.Key("hx.area")
+	CallSid    = attribute.Key("twilio.call.sid")
+	CallStatus = attribute.Key("twilio.call.status")
+)
+
+// Sets up the global tracer provider from cfg. Without an exporter spans are discarded.
+// The returned function flushes pending spans and must be called before exiting.
+func Setup(ctx context.Context, cfg c.TracingConfiguration, serviceName string) (func(ctx context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "":
+		slog.Info("TRACING", "action", "setup", "enabled", false)
+		return func(ctx context.Context) error { return nil }, nil
+	case c.TracingExporterStdout:
+		exporter, err = stdouttrace.New()
+	case c.TracingExporterOTLP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		err = fmt.Errorf("unknown exporter '%s'", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", serviceName)))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	slog.Info("TRACING", "action", "setup", "enabled", true, "exporter", cfg.Exporter, "sampleRatio", cfg.SampleRatio)
+	return provider.Shutdown, nil
+}
+
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Marks the span as failed with err, if any
+func Fail(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// Adds the trace context of ctx to the query of a callback URL.
+// Twilio requests the URL as given, so that its callbacks join the trace of the call.
+func CallbackURL(ctx context.Context, callbackUrl string) string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return callbackUrl
+	}
+
+	u, err := url.Parse(callbackUrl)
+	if err != nil {
+		return callbackUrl
+	}
+
+	query := u.Query()
+	for key, value := range carrier {
+		query.Set(key, value)
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// Returns the context of a callback request, carrying the trace context added by CallbackURL
+func FromCallback(r *http.Request) context.Context {
+	carrier := propagation.MapCarrier{}
+	for key, values := range r.URL.Query() {
+		if len(values) > 0 {
+			carrier[key] = values[0]
+		}
+	}
+
+	return otel.GetTextMapPropagator().Extract(r.Context(), carrier)
+}
@@ -2,20 +2,63 @@ package transcript
 
 import (
 	"context"
-	"log"
+	"sync"
 
+	c "github.com/thisisnttheway/hx-monitor/configuration"
 	"google.golang.org/genai"
 )
 
-var (
-	genaiClient *genai.Client
-)
+// Parses transcripts with a generative AI model
+type Parser struct {
+	mu     sync.Mutex
+	config c.AIConfiguration
+	client *genai.Client
+}
+
+func NewParser(config c.AIConfiguration) *Parser {
+	return &Parser{config: config}
+}
 
-func init() {
-	ctx := context.Background()
-	var err error
-	genaiClient, err = genai.NewClient(ctx, nil)
+// Replaces the configuration, the client is recreated on next use
+func (p *Parser) Configure(config c.AIConfiguration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.config = config
+	p.client = nil
+}
+
+// Fails if no client can be created for the configured backend
+func (p *Parser) Ready(ctx context.Context) error {
+	_, _, err := p.getClient(ctx)
+	return err
+}
+
+// Returns the client for the configured backend and the model to use, creating the client on first use
+func (p *Parser) getClient(ctx context.Context) (*genai.Client, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.client != nil {
+		return p.client, p.config.Model, nil
+	}
+
+	clientConfig := &genai.ClientConfig{Backend: genai.BackendGeminiAPI, APIKey: p.config.ApiKey}
+	if p.config.UseVertexAI {
+		clientConfig.Backend = genai.BackendVertexAI
+		if p.config.Project != "" {
+			// Project and API key are mutually exclusive
+			clientConfig.APIKey = ""
+			clientConfig.Project = p.config.Project
+			clientConfig.Location = p.config.Location
+		}
+	}
+
+	client, err := genai.NewClient(ctx, clientConfig)
 	if err != nil {
-		log.Fatal(err)
+		return nil, "", err
 	}
+
+	p.client = client
+	return p.client, p.config.Model, nil
 }
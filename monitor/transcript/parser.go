@@ -5,63 +5,89 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
-	"os"
 	"strings"
 	"time"
 
 	_ "embed"
 
+	"github.com/thisisnttheway/hx-monitor/metrics"
 	"github.com/thisisnttheway/hx-monitor/models"
+	"github.com/thisisnttheway/hx-monitor/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/genai"
 )
 
 var (
-	model       string  = "gemini-flash-lite-latest"
 	temperature float32 = 0.1
 
 	//go:embed sysprompt_meiringen.txt
 	syspromptMeiringen string
 )
 
-func init() {
-	v, exists := os.LookupEnv("GOOGLE_AI_MODEL")
-	if exists {
-		model = v
+// Generates content and records its latency and token usage
+func generateContent(ctx context.Context, client *genai.Client, model string, input string, config *genai.GenerateContentConfig) (*genai.GenerateContentResponse, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "llm.generateContent",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("gen_ai.request.model", model)),
+	)
+	defer span.End()
+
+	start := time.Now()
+	result, err := client.Models.GenerateContent(ctx, model, genai.Text(input), config)
+	metrics.LLMRequestDuration.WithLabelValues(model, metrics.Result(err)).Observe(time.Since(start).Seconds())
+	tracing.Fail(span, err)
+
+	if err == nil && result.UsageMetadata != nil {
+		usage := result.UsageMetadata
+		metrics.LLMTokens.WithLabelValues(model, "prompt").Add(float64(usage.PromptTokenCount))
+		metrics.LLMTokens.WithLabelValues(model, "response").Add(float64(usage.CandidatesTokenCount))
+		metrics.LLMTokens.WithLabelValues(model, "total").Add(float64(usage.TotalTokenCount))
+		span.SetAttributes(
+			attribute.Int("gen_ai.usage.input_tokens", int(usage.PromptTokenCount)),
+			attribute.Int("gen_ai.usage.output_tokens", int(usage.CandidatesTokenCount)),
+		)
 	}
 
-	slog.Info("PARSER", "aiModelToUse", model, "fromEnvVar", exists)
+	return result, err
 }
 
 // Parse Meiringens airspace status phone system
-func ParseAirspaceTranscriptMeiringen(transcript string, ctx context.Context) (models.AirspaceMeiringenStatus, error) {
+func (p *Parser) ParseAirspaceTranscriptMeiringen(ctx context.Context, transcript string) (_ models.AirspaceMeiringenStatus, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "transcript.parse")
+	defer func() {
+		tracing.Fail(span, err)
+		span.End()
+	}()
+
 	areaMeiringenStatus := models.AirspaceMeiringenStatus{}
 
-	syspromptMeiringen = strings.Replace(syspromptMeiringen, "%TIME%", time.Now().Format(time.RFC1123Z), 1)
+	client, model, err := p.getClient(ctx)
+	if err != nil {
+		return areaMeiringenStatus, fmt.Errorf("could not create AI client: %w", err)
+	}
+
+	sysprompt := strings.Replace(syspromptMeiringen, "%TIME%", time.Now().Format(time.RFC1123Z), 1)
 	config := &genai.GenerateContentConfig{
 		Temperature:      &temperature,
 		ResponseMIMEType: "application/json",
 		SystemInstruction: &genai.Content{
 			Parts: []*genai.Part{
-				{Text: syspromptMeiringen},
+				{Text: sysprompt},
 			},
 		},
 		//ResponseSchema: &genai.Schema{} - We can't pass models.AirspaceMeiringenStatus to it :(
 		// However, the AI generally seems to respond with a correct schema
 	}
 
-	slog.Info("PARSER", "action", "startGeneration", "model", model, "input", transcript)
-	result, err := genaiClient.Models.GenerateContent(
-		ctx,
-		model,
-		genai.Text(transcript),
-		config,
-	)
+	slog.InfoContext(ctx, "PARSER", "action", "startGeneration", "model", model, "input", transcript)
+	result, err := generateContent(ctx, client, model, transcript, config)
 	if err != nil {
-		slog.Error("PARSER", "action", "startGeneration", "err", err)
+		slog.ErrorContext(ctx, "PARSER", "action", "startGeneration", "err", err)
 		return areaMeiringenStatus, fmt.Errorf("could not generate content from AI: %v", err)
 	}
 
-	slog.Info("PARSER", "action", "receiveResponse",
+	slog.InfoContext(ctx, "PARSER", "action", "receiveResponse",
 		"text", result.Text(),
 		"totalTokenCount", result.UsageMetadata.TotalTokenCount,
 		"modelVersion", result.ModelVersion,
@@ -69,7 +95,7 @@ func ParseAirspaceTranscriptMeiringen(transcript string, ctx context.Context) (m
 
 	err = json.Unmarshal([]byte(result.Text()), &areaMeiringenStatus)
 	if err != nil {
-		slog.Error("PARSER", "action", "unmarshalGenAiContent", "err", err)
+		slog.ErrorContext(ctx, "PARSER", "action", "unmarshalGenAiContent", "err", err)
 		return areaMeiringenStatus, fmt.Errorf("could not unmarshal AI response: %v", err)
 	}
 
@@ -80,7 +106,7 @@ func ParseAirspaceTranscriptMeiringen(transcript string, ctx context.Context) (m
 	// Reprompt if nextUpdate is in the past (or now)
 	now := time.Now()
 	if !areaMeiringenStatus.NextUpdate.After(now) {
-		slog.Warn("PARSER", "action", "nextUpdateInPast", "nextUpdate", areaMeiringenStatus.NextUpdate, "now", now)
+		slog.WarnContext(ctx, "PARSER", "action", "nextUpdateInPast", "nextUpdate", areaMeiringenStatus.NextUpdate, "now", now)
 
 		// Reprompt the model to reinterpret just the nextUpdate field
 		repromptConfig := &genai.GenerateContentConfig{
@@ -103,31 +129,26 @@ func ParseAirspaceTranscriptMeiringen(transcript string, ctx context.Context) (m
 			},
 		}
 
-		slog.Info("PARSER", "action", "repromptForNextUpdate", "transcript", transcript)
-		repromptResult, err := genaiClient.Models.GenerateContent(
-			ctx,
-			model,
-			genai.Text(transcript),
-			repromptConfig,
-		)
+		slog.InfoContext(ctx, "PARSER", "action", "repromptForNextUpdate", "transcript", transcript)
+		repromptResult, err := generateContent(ctx, client, model, transcript, repromptConfig)
 		if err != nil {
-			slog.Error("PARSER", "action", "repromptForNextUpdate", "err", err)
+			slog.ErrorContext(ctx, "PARSER", "action", "repromptForNextUpdate", "err", err)
 		} else {
 			var nextUpdateData struct {
 				NextUpdate time.Time `json:"nextUpdate"`
 			}
 			err = json.Unmarshal([]byte(repromptResult.Text()), &nextUpdateData)
 			if err != nil {
-				slog.Error("PARSER", "action", "unmarshalNextUpdateReprompt", "err", err)
+				slog.ErrorContext(ctx, "PARSER", "action", "unmarshalNextUpdateReprompt", "err", err)
 			} else {
 				areaMeiringenStatus.NextUpdate = nextUpdateData.NextUpdate.In(loc)
-				slog.Info("PARSER", "action", "nextUpdateRepromptSucceeded", "newNextUpdate", areaMeiringenStatus.NextUpdate)
+				slog.InfoContext(ctx, "PARSER", "action", "nextUpdateRepromptSucceeded", "newNextUpdate", areaMeiringenStatus.NextUpdate)
 			}
 		}
 	}
 
 	o, _ := json.Marshal(areaMeiringenStatus)
-	slog.Debug("PARSER", "airspaceStatusJson", string(o))
+	slog.DebugContext(ctx, "PARSER", "airspaceStatusJson", string(o))
 
 	return areaMeiringenStatus, nil
 }
@@ -0,0 +1,119 @@
+package twiml
+
+import (
+	"encoding/xml"
+)
+
+// A TwiML verb, see https://www.twilio.com/docs/voice/twiml
+type Verb interface {
+	verb()
+}
+
+// Verbs that may be nested in <Gather>
+type GatherVerb interface {
+	Verb
+	gatherVerb()
+}
+
+// Instructions for a call. Attributes and text are escaped when rendered.
+type Response struct {
+	XMLName xml.Name `xml:"Response"`
+	Verbs   []Verb
+}
+
+func NewResponse(verbs ...Verb) *Response {
+	return &Response{Verbs: verbs}
+}
+
+func (r *Response) Append(verbs ...Verb) *Response {
+	r.Verbs = append(r.Verbs, verbs...)
+	return r
+}
+
+// Renders the response as TwiML document
+func (r *Response) Render() (string, error) {
+	document, err := xml.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+
+	return xml.Header + string(document), nil
+}
+
+// Starts tasks that run alongside the following verbs
+type Start struct {
+	XMLName       xml.Name `xml:"Start"`
+	Transcription *Transcription
+}
+
+// Transcribes a call live, must be nested in <Start>
+type Transcription struct {
+	XMLName           xml.Name `xml:"Transcription"`
+	StatusCallbackUrl string   `xml:"statusCallbackUrl,attr,omitempty"`
+	Track             string   `xml:"track,attr,omitempty"`
+	LanguageCode      string   `xml:"languageCode,attr,omitempty"`
+	Hints             string   `xml:"hints,attr,omitempty"`
+	PartialResults    bool     `xml:"partialResults,attr"`
+}
+
+// Waits silently
+type Pause struct {
+	XMLName xml.Name `xml:"Pause"`
+	Length  int      `xml:"length,attr,omitempty"` // Seconds, Twilio defaults to 1
+}
+
+// Records the call until MaxLength is reached or the call ends
+type Record struct {
+	XMLName                 xml.Name `xml:"Record"`
+	MaxLength               int      `xml:"maxLength,attr,omitempty"` // Seconds
+	Timeout                 int      `xml:"timeout,attr,omitempty"`   // Seconds of silence that end the recording
+	PlayBeep                bool     `xml:"playBeep,attr"`
+	RecordingStatusCallback string   `xml:"recordingStatusCallback,attr,omitempty"`
+}
+
+// Plays an audio file, or sends DTMF tones if Digits is set.
+// Digits may contain 'w' to wait half a second, e.g. "ww1".
+type Play struct {
+	XMLName xml.Name `xml:"Play"`
+	Digits  string   `xml:"digits,attr,omitempty"`
+	Loop    int      `xml:"loop,attr,omitempty"`
+	Url     string   `xml:",chardata"`
+}
+
+// Reads a text to the callee
+type Say struct {
+	XMLName  xml.Name `xml:"Say"`
+	Voice    string   `xml:"voice,attr,omitempty"`
+	Language string   `xml:"language,attr,omitempty"`
+	Text     string   `xml:",chardata"`
+}
+
+// Collects DTMF digits or speech of the callee while the nested verbs run, e.g. for menus
+type Gather struct {
+	XMLName             xml.Name `xml:"Gather"`
+	Input               string   `xml:"input,attr,omitempty"` // "dtmf", "speech" or "dtmf speech"
+	Action              string   `xml:"action,attr,omitempty"`
+	Method              string   `xml:"method,attr,omitempty"`
+	Timeout             int      `xml:"timeout,attr,omitempty"` // Seconds
+	NumDigits           int      `xml:"numDigits,attr,omitempty"`
+	FinishOnKey         string   `xml:"finishOnKey,attr,omitempty"`
+	ActionOnEmptyResult bool     `xml:"actionOnEmptyResult,attr,omitempty"`
+	Verbs               []GatherVerb
+}
+
+// Ends the call
+type Hangup struct {
+	XMLName xml.Name `xml:"Hangup"`
+}
+
+func (Start) verb()  {}
+func (Pause) verb()  {}
+func (Record) verb() {}
+func (Play) verb()   {}
+func (Say) verb()    {}
+func (Gather) verb() {}
+func (Hangup) verb() {}
+
+func (Pause) gatherVerb() {}
+func (Play) gatherVerb()  {}
+func (Say) gatherVerb()   {}
@@ -0,0 +1,59 @@
+package twiml
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	cases := []struct {
+		name     string
+		response *Response
+		expected string
+	}{
+		{
+			name:     "empty",
+			response: NewResponse(),
+			expected: `<Response></Response>`,
+		},
+		{
+			name:     "escaping",
+			response: NewResponse(Say{Language: "de-CH", Text: `<Hangup/> & "quotes" 'too'`}),
+			expected: `<Response><Say language="de-CH">&lt;Hangup/&gt; &amp; &#34;quotes&#34; &#39;too&#39;</Say></Response>`,
+		},
+		{
+			name:     "escapedAttributes",
+			response: NewResponse(Start{Transcription: &Transcription{StatusCallbackUrl: "https://hx.example.com/transcription?a=1&b=\"2\""}}),
+			expected: `<Response><Start><Transcription statusCallbackUrl="https://hx.example.com/transcription?a=1&amp;b=&#34;2&#34;" partialResults="false"></Transcription></Start></Response>`,
+		},
+		{
+			name: "gatherMenu",
+			response: NewResponse(
+				Gather{Input: "dtmf", NumDigits: 1, Timeout: 5, Verbs: []GatherVerb{
+					Say{Text: "Press 1"},
+					Pause{Length: 2},
+				}},
+				Play{Digits: "ww1"},
+				Hangup{},
+			),
+			expected: `<Response><Gather input="dtmf" timeout="5" numDigits="1"><Say>Press 1</Say><Pause length="2"></Pause></Gather><Play digits="ww1"></Play><Hangup></Hangup></Response>`,
+		},
+		{
+			name:     "append",
+			response: NewResponse(Pause{Length: 1}).Append(Play{Url: "https://hx.example.com/a.mp3", Loop: 2}, Record{MaxLength: 10, PlayBeep: true}),
+			expected: `<Response><Pause length="1"></Pause><Play loop="2">https://hx.example.com/a.mp3</Play><Record maxLength="10" playBeep="true"></Record></Response>`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := tc.response.Render()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := xml.Header + tc.expected; actual != expected {
+				t.Errorf("\nexpected: %s\nactual:   %s", expected, actual)
+			}
+		})
+	}
+}
@@ -11,13 +11,23 @@ db.calls.drop()
 db.numbers.drop()
 db.hx_areas.drop()
 db.hx_sub_areas.drop()
+db.schema_migrations.drop()
 
-db.numbers.insertMany([
+numbers = [
     {
         name: "meiringen",
         number: "+41800496347"
     }
-])
+]
+
+// Numbers must be in E.164 format, see README.md
+invalid = numbers.filter(n => !/^\+[1-9]\d{6,14}\$/.test(n.number))
+if (invalid.length > 0) {
+    print("Invalid numbers, expected E.164 (e.g. +41800496347): " + invalid.map(n => n.name + "=" + n.number).join(", "))
+    quit(1)
+}
+
+db.numbers.insertMany(numbers)
 
 db.hx_areas.insertMany([
     {
@@ -65,4 +75,5 @@ db.hx_areas.insertMany([
 EOF
 )"
 
-echo "> Have seeded DB"
\ No newline at end of file
+echo "> Have seeded DB"
+echo "> Dropping collections also dropped their indexes and validators, run 'monitor migrate' to recreate them"
\ No newline at end of file